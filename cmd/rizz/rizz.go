@@ -1,34 +1,49 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"os"
 
 	display "github.com/cyamas/rizz/internal/display"
 )
 
 func main() {
 	fmt.Println("rizz will be a simple text editor one day!")
-	args := os.Args
+	encoding := flag.String("encoding", "", "read the file with this encoding instead of detecting it")
+	flag.Parse()
+	args := flag.Args()
 	d := display.NewDisplay()
 	d.Init()
 	quit := func() {
 		maybePanic := recover()
+		if maybePanic != nil {
+			d.WriteSwapFiles()
+		}
 		d.Screen.Fini()
 		if maybePanic != nil {
 			panic(maybePanic)
 		}
 	}
 	defer quit()
-	d.ActiveBuf = display.NewBuffer(d.Highlighter)
-	if len(args) == 2 {
-		d.ActiveBuf.ReadFile(args[1])
-
+	for _, arg := range args {
+		buf := display.NewBuffer(d.Highlighter)
+		if err := buf.ReadFile(arg); err != nil {
+			d.ShowError(err)
+			continue
+		}
+		if *encoding != "" {
+			if err := buf.ReopenWithEncoding(*encoding); err != nil {
+				d.ShowError(err)
+			}
+		}
+		d.AddBuffer(buf)
+	}
+	if len(d.Buffers()) == 0 {
+		d.AddBuffer(display.NewBuffer(d.Highlighter))
 	}
 	d.InitBufWindow()
 	d.SetBufWindow()
 	d.Mode = display.Normal
-	display.Cur.X = display.LeftMarginSize
-	display.Cur.Y = 0
+	d.CheckSwapFile()
 	d.Run()
 }
@@ -1,26 +1,21 @@
 package display
 
-func (l *Line) autoIndent(tabs int) {
-	ogX := bufPos.X
-	bufPos.X = 0
-	for i := 0; i < tabs; i++ {
-		l.addKeyTab()
-	}
-	bufPos.X = ogX
+func (l *Line) autoIndent(col int, s Settings) {
+	l.runes = append(s.indentRunes(col), l.runes...)
 }
 
-func (l *Line) autoClose(r rune) {
+func (l *Line) autoClose(idx int, r rune) {
 	switch r {
 	case '{':
-		l.addRune('}')
+		l.addRune(idx, '}')
 	case '[':
-		l.addRune(']')
+		l.addRune(idx, ']')
 	case '(':
-		l.addRune(')')
+		l.addRune(idx, ')')
 	case '"':
-		l.addRune('"')
+		l.addRune(idx, '"')
 	case '\'':
-		l.addRune('\'')
+		l.addRune(idx, '\'')
 	}
 }
 
@@ -33,23 +28,35 @@ func (l *Line) firstWordIndex() int {
 	return len(l.runes)
 }
 
-func (l *Line) tabCountForNewLine() int {
-	count := 0
+func (l *Line) indentForNewLine(s Settings) int {
+	col := 0
 	if l.length() == 0 {
 		return 0
 	}
 	lastRune := l.runes[l.length()-1]
 	if lastRune == ':' || isOpenBracket(lastRune) {
-		count++
+		col += s.ShiftWidth
 	}
 	for i, r := range l.runes {
 		if r != '\t' && r != ' ' {
-			count += i / LeftMarginSize
+			col += l.colAt(i, s.TabWidth)
 			break
 		}
 
 	}
-	return count
+	return col
+}
+
+func (l *Line) indentStart(idx int, s Settings) int {
+	if idx >= l.firstWordIndex() || l.runes[idx] != ' ' {
+		return idx
+	}
+	target := (l.colAt(idx+1, s.TabWidth) - 1) / s.ShiftWidth * s.ShiftWidth
+	start := idx
+	for start > 0 && l.runes[start-1] == ' ' && l.colAt(start-1, s.TabWidth) >= target {
+		start--
+	}
+	return start
 }
 
 func isOpenBracket(r rune) bool {
@@ -1,9 +1,11 @@
 package display
 
 import (
-	"bufio"
-	"log"
+	"errors"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/cyamas/rizz/internal/highlighter"
 )
@@ -12,6 +14,17 @@ type Buffer struct {
 	content     *LineArray
 	path        string
 	windowStart int
+	cursor      position
+	settings    Settings
+	format      fileFormat
+	modified    bool
+	edits       int
+	swapEdits   int
+	hasSwap     bool
+	noSwap      bool
+	swapChecked bool
+	disk        diskState
+	seenDisk    diskState
 	history     *History
 	highlighter *highlighter.Highlighter
 }
@@ -19,107 +32,220 @@ type Buffer struct {
 func NewBuffer(h *highlighter.Highlighter) *Buffer {
 	return &Buffer{
 		content:     newLineArray(h),
+		settings:    defaultSettings(),
+		format:      defaultFileFormat(),
 		history:     NewHistory(),
 		highlighter: h,
 	}
 }
 
 func (b *Buffer) getLine(idx int) *Line {
-	return b.content.lines[idx]
-}
-
-func (b *Buffer) currLine() *Line {
-	return b.getLine(bufPos.Y)
+	return b.content.line(idx)
 }
 
 func (b *Buffer) lastLine() *Line {
-	return b.content.lines[b.length()-1]
+	return b.content.lastLine()
 }
 
-func (b *Buffer) ReadFile(filename string) {
-	dir, err := os.Getwd()
+func (b *Buffer) ReadFile(filename string) error {
+	path, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+	b.path = path
+	b.settings = settingsForPath(b.path)
+	content, err := b.setContentFromFile()
 	if err != nil {
-		log.Fatalln("Could not get working directory", err)
+		b.path = ""
+		return err
 	}
-	b.path = dir + "/" + filename
-	b.content = b.setContentFromFile()
+	b.content = content
+	b.history = b.loadUndoFile()
+	b.modified = false
+	return nil
 }
 
-func (b *Buffer) setContentFromFile() *LineArray {
-	file, err := os.Open(b.path)
+func (b *Buffer) setContentFromFile() (*LineArray, error) {
+	data, err := os.ReadFile(b.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		b.disk = diskState{}
+		b.seenDisk = b.disk
+		return newLineArray(b.highlighter), nil
+	}
 	if err != nil {
-		log.Println("could not open file", err)
+		return nil, err
 	}
-	defer file.Close()
+	b.recordDiskState(data)
+	format, text := detectFileFormat(data)
+	b.format = format
+	return b.contentFromText(text), nil
+}
 
-	reader := bufio.NewReader(file)
-	content := newLineArray(b.highlighter)
-	for {
-		text, err := reader.ReadString('\n')
-		if err != nil {
-			break
-		}
-		content.addLineFromFile(text, b.highlighter)
-		Cur.Y++
+// reload reads the file again as one undoable edit over the buffer's text,
+// keeping its settings and history. Nothing changes if the file cannot be
+// read.
+func (b *Buffer) reload(cursor position) error {
+	data, err := os.ReadFile(b.path)
+	if err != nil {
+		return err
 	}
-	return content
+	format, text := detectFileFormat(data)
+	b.beginEdit(0, b.length()-1, cursor)
+	b.format = format
+	b.content = b.contentFromText(text)
+	b.endEdit(RELOAD, position{line: min(cursor.line, b.length()-1)})
+	b.recordDiskState(data)
+	b.history.markSaved()
+	b.modified = false
+	return nil
 }
 
-func (b *Buffer) writeToFile() {
-	file, err := os.Create(b.path)
+func (b *Buffer) contentFromText(text string) *LineArray {
+	return lineArrayFromStrings(b.format.splitLines(text), b.highlighter)
+}
+
+func (b *Buffer) ReopenWithEncoding(name string) error {
+	enc, err := lookupEncoding(name)
 	if err != nil {
-		log.Fatalln("Could not create file: ", err)
+		return err
 	}
-	defer file.Close()
+	data, err := os.ReadFile(b.path)
+	if err != nil {
+		return err
+	}
+	b.recordDiskState(data)
+	format, text := decodeFileFormat(data, enc)
+	b.format = format
+	b.content = b.contentFromText(text)
+	b.history = NewHistory()
+	b.modified = false
+	return nil
+}
 
-	newContent := ""
-	for _, line := range b.content.lines {
-		newContent += line.convertRunesForWrite()
+func (b *Buffer) writeToFile() error {
+	if b.path == "" {
+		return errors.New("no file name")
 	}
-	_, err = file.WriteString(newContent)
+	data, err := b.writeTo(b.path)
+	if err != nil {
+		return err
+	}
+	b.markWritten(data)
+	return nil
+}
+
+// markWritten records that data, the buffer's text, is now its file.
+func (b *Buffer) markWritten(data []byte) {
+	b.recordDiskState(data)
+	b.history.markSaved()
+	b.modified = false
+}
+
+// writeTo writes the buffer's text to path, which need not be its own file,
+// and returns what was written.
+func (b *Buffer) writeTo(path string) ([]byte, error) {
+	data, err := b.encodeContent()
 	if err != nil {
-		log.Fatalln("could not write to file")
+		return nil, err
 	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return nil, err
+	}
+	return data, nil
 }
 
-/*
-func (b *Buffer) addRune(r rune) {
-	line := b.getLine(bufPos.Y)
-	line.runes = append(line.runes, ' ')
-	copy(line.runes[bufPos.X+1:], line.runes[bufPos.X:])
-	line.runes[bufPos.X] = r
-}*/
+func (b *Buffer) encodeContent() ([]byte, error) {
+	var text strings.Builder
+	lines := b.content.allLines()
+	if len(lines) == 1 && lines[0].length() == 0 && b.format.empty {
+		lines = nil
+	}
+	for i, line := range lines {
+		text.WriteString(line.convertRunesForWrite())
+		if i < len(lines)-1 || b.format.finalNewline {
+			text.WriteString(b.format.lineEnding)
+		}
+	}
+	data, err := b.format.encoding.encode(text.String())
+	if err != nil {
+		return nil, err
+	}
+	if b.format.bom {
+		data = append(append([]byte(nil), b.format.encoding.bom...), data...)
+	}
+	return data, nil
+}
 
-func (b *Buffer) removeRune() {
-	line := b.getLine(bufPos.Y)
-	r := line.runes[bufPos.X]
-	ogRunes := line.Runes()
+// removeRune deletes the grapheme cluster at pos and returns the index the cursor ends
+// up on, which is before pos when a whole indent step is removed.
+func (b *Buffer) removeRune(pos position) int {
+	line := b.getLine(pos.line)
+	x := pos.col
+	r := line.runes[x]
 	switch {
-	case r == '\t':
-		line.removeTabRunes()
-	case bufPos.X < line.length()-1 && isAutoClosable(r) && isClosingRune(line.runes[bufPos.X+1]):
-		line.runes = append(line.runes[:bufPos.X], line.runes[bufPos.X+2:]...)
+	case r == ' ' && line.indentStart(x, b.settings) < x:
+		start := line.indentStart(x, b.settings)
+		line.runes = append(line.runes[:start], line.runes[x+1:]...)
+		return start
+	case x < line.length()-1 && isAutoClosable(r) && isClosingRune(line.runes[x+1]):
+		line.runes = append(line.runes[:x], line.runes[x+2:]...)
 	default:
-		line.runes = append(line.runes[:bufPos.X], line.runes[bufPos.X+1:]...)
+		line.runes = append(line.runes[:x], line.runes[line.nextCluster(x):]...)
+	}
+	return x
+}
+
+// beginEdit starts an undoable transaction for a command that may change
+// lines first through last, or insert lines right after them.
+func (b *Buffer) beginEdit(first, last int, cursor position) {
+	b.history.begin(b.content, first, last, cursor)
+}
+
+func (b *Buffer) endEdit(action Action, cursor position) {
+	if b.history.commit(b.content, action, cursor) {
+		b.modified = true
+		b.edits++
 	}
-	b.history.AddEvent(REMOVE, ogRunes, line)
+}
+
+func (b *Buffer) undo() (position, bool) {
+	return b.history.undo(b.content, b.highlighter)
+}
+
+func (b *Buffer) redo() (position, bool) {
+	return b.history.redo(b.content, b.highlighter)
+}
+
+func (b *Buffer) markChanged() {
+	b.history.markUnrecordedEdit()
+	b.modified = true
+	b.edits++
+}
+
+func (b *Buffer) updateModified() {
+	b.modified = !b.history.atSavedState()
+	b.edits++
+}
+
+func (b *Buffer) Modified() bool {
+	return b.modified
 }
 
 func (b *Buffer) length() int {
-	return len(b.content.lines)
+	return b.content.length()
 }
 
 func (b *Buffer) appendLine(line *Line) {
-	b.content.lines = append(b.content.lines, line)
+	b.content.appendLine(line)
 }
 
-func (b *Buffer) addClosingRuneLine() {
-	tabCount := b.currLine().tabCountForNewLine()
-	closingRunes := b.currLine().extractRestOfLine()
+func (b *Buffer) addClosingRuneLine(pos position) {
+	line := b.getLine(pos.line)
+	indent := line.indentForNewLine(b.settings)
+	closingRunes := line.extractRestOfLine(pos.col)
 	newLine := newLine(b.highlighter)
-	newLine.autoIndent(tabCount)
+	newLine.autoIndent(indent, b.settings)
 	newLine.runes = append(newLine.runes, closingRunes...)
-	currContext := b.content.currLine().Context()
-	newLine.highlight(currContext)
-	b.content.insertNewLine(newLine)
+	newLine.highlight(line.Context())
+	b.content.insertLine(pos.line+1, newLine)
 }
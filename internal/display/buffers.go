@@ -0,0 +1,175 @@
+package display
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// AddBuffer adds buf to the open buffers. The first buffer added becomes the
+// active one.
+func (d *Display) AddBuffer(buf *Buffer) {
+	d.buffers = append(d.buffers, buf)
+	if d.ActiveBuf == nil {
+		d.ActiveBuf = buf
+	}
+	if d.bufWindow != nil {
+		d.layoutWindows()
+	}
+}
+
+func (d *Display) Buffers() []*Buffer {
+	return d.buffers
+}
+
+// Name is the name the buffer is listed under.
+func (b *Buffer) Name() string {
+	if b.path == "" {
+		return "[No Name]"
+	}
+	return filepath.Base(b.path)
+}
+
+// OpenFile switches to the buffer holding name, reading it into a new buffer
+// if it is not open yet.
+func (d *Display) OpenFile(name string) error {
+	path, err := filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+	for _, buf := range d.buffers {
+		if buf.path == path {
+			d.switchToBuffer(buf)
+			return nil
+		}
+	}
+	buf := NewBuffer(d.Highlighter)
+	if err := buf.ReadFile(path); err != nil {
+		return err
+	}
+	d.AddBuffer(buf)
+	d.switchToBuffer(buf)
+	return nil
+}
+
+func (d *Display) switchToBuffer(buf *Buffer) {
+	if buf == d.ActiveBuf {
+		return
+	}
+	d.ActiveBuf.cursor = d.cursorPos()
+	d.ActiveBuf = buf
+	d.bufWindow.buf = buf
+	d.bufWindow.bufIdx = buf.windowStart
+	d.Screen.Clear()
+	d.moveToBufPos(buf.cursor)
+	d.SetBufWindow()
+	if !buf.swapChecked {
+		d.CheckSwapFile()
+	}
+	if d.Mode != Prompt {
+		d.checkActiveBufOnDisk()
+	}
+}
+
+// cycleBuffer switches to the buffer step places after the active one in the
+// buffer list, wrapping around at either end.
+func (d *Display) cycleBuffer(step int) {
+	if len(d.buffers) < 2 {
+		return
+	}
+	idx := slices.Index(d.buffers, d.ActiveBuf)
+	n := len(d.buffers)
+	d.switchToBuffer(d.buffers[((idx+step)%n+n)%n])
+}
+
+func (d *Display) closeBuffer(confirmed bool) {
+	buf := d.ActiveBuf
+	if buf.modified && !confirmed {
+		d.ask("No write since last change. Close anyway?",
+			choice{'y', "es", func() { d.closeBuffer(true) }},
+			choice{'n', "o", func() {}},
+		)
+		return
+	}
+	buf.removeSwap()
+	idx := slices.Index(d.buffers, buf)
+	d.buffers = slices.Delete(d.buffers, idx, idx+1)
+	if len(d.buffers) == 0 {
+		d.buffers = append(d.buffers, NewBuffer(d.Highlighter))
+	}
+	d.layoutWindows()
+	next := d.buffers[min(idx, len(d.buffers)-1)]
+	for _, bw := range d.windows() {
+		if bw.buf == buf && bw != d.bufWindow {
+			bw.buf = next
+			bw.bufIdx = next.windowStart
+			bw.pos = cell{X: next.cursor.col, Y: next.cursor.line}
+		}
+	}
+	d.switchToBuffer(next)
+	d.showMessage(fmt.Sprintf("closed \"%s\"", buf.Name()))
+}
+
+func (d *Display) listBuffers() {
+	entries := []string{}
+	for i, buf := range d.buffers {
+		active := ""
+		if buf == d.ActiveBuf {
+			active = "%"
+		}
+		modified := ""
+		if buf.modified {
+			modified = " [+]"
+		}
+		name := buf.path
+		if name == "" {
+			name = buf.Name()
+		}
+		entries = append(entries, fmt.Sprintf("%d%s \"%s\"%s", i+1, active, name, modified))
+	}
+	d.showMessage(strings.Join(entries, "  "))
+}
+
+func (d *Display) modifiedBuffers() []*Buffer {
+	modified := []*Buffer{}
+	for _, buf := range d.buffers {
+		if buf.modified {
+			modified = append(modified, buf)
+		}
+	}
+	return modified
+}
+
+// textTop is the first screen row of the text; the tab line takes the row
+// above it while more than one buffer is open.
+func (d *Display) textTop() int {
+	if len(d.buffers) > 1 {
+		return 1
+	}
+	return 0
+}
+
+func (d *Display) drawTabLine() {
+	if d.textTop() == 0 {
+		return
+	}
+	x := 0
+	for i, buf := range d.buffers {
+		style := d.LineNoStyle
+		if buf == d.ActiveBuf {
+			style = d.StatusBarStyle
+		}
+		label := fmt.Sprintf(" %d %s ", i+1, buf.Name())
+		if buf.modified {
+			label = fmt.Sprintf(" %d %s [+] ", i+1, buf.Name())
+		}
+		for _, r := range label {
+			d.Screen.SetContent(x, 0, r, nil, style)
+			x++
+		}
+	}
+	for ; x < d.width; x++ {
+		d.Screen.SetContent(x, 0, ' ', nil, d.LineNoStyle)
+	}
+}
@@ -9,7 +9,17 @@ type BufWindow struct {
 	buf         *Buffer
 	lines       []*Line
 	bufIdx      int
+	leftCol     int
+	left        int
+	top         int
+	width       int
 	size        int
+	capacity    int
+	gutter      int
+	wrap        bool
+	cur         cell
+	pos         cell
+	node        *splitNode
 	highlighter *highlighter.Highlighter
 }
 
@@ -18,6 +28,9 @@ func newBufWindow(size int) *BufWindow {
 		lines:       []*Line{},
 		highlighter: highlighter.New(lexer.New()),
 		size:        size,
+		capacity:    size,
+		gutter:      LeftMarginSize,
+		cur:         cell{X: LeftMarginSize},
 	}
 	for i := 0; i < bw.size; i++ {
 		bw.lines = append(bw.lines, newLine(bw.highlighter))
@@ -25,31 +38,174 @@ func newBufWindow(size int) *BufWindow {
 	return bw
 }
 
+// bufPos returns the buffer position the window's cursor is on.
+func (bw *BufWindow) bufPos() position {
+	return position{line: bw.pos.Y, col: bw.pos.X}
+}
+
 func (bw *BufWindow) length() int {
 	return len(bw.lines)
 }
 
+// update fills the window with the lines from idx on. capacity is set to the
+// number of lines the window has room for, counting the rows left over past
+// the end of the buffer as one line each.
 func (bw *BufWindow) update(idx int) {
+	if bw.wraps() {
+		bw.updateWrapped(idx)
+		return
+	}
+	bw.capacity = bw.size
 	switch {
 	case bw.buf.length() < bw.size:
 		bw.bufIdx = 0
 		bw.buf.windowStart = 0
-		bw.lines = append([]*Line(nil), bw.buf.content.lines...)
+		bw.lines = bw.buf.content.allLines()
 	case idx > bw.buf.length()-bw.size:
 		bw.bufIdx = bw.buf.length() - bw.size
 		bw.buf.windowStart = bw.bufIdx
-		bw.lines = append([]*Line(nil), bw.buf.content.lines[bw.bufIdx:bw.bufIdx+bw.size]...)
+		bw.lines = bw.buf.content.slice(bw.bufIdx, bw.bufIdx+bw.size)
 	default:
 		bw.bufIdx = idx
 		bw.buf.windowStart = idx
-		bw.lines = append([]*Line(nil), bw.buf.content.lines[bw.bufIdx:bw.bufIdx+bw.size]...)
+		bw.lines = bw.buf.content.slice(bw.bufIdx, bw.bufIdx+bw.size)
+	}
+}
+
+// updateWrapped fills the window from line idx with as many whole lines as
+// fit when long lines take up several rows, scrolling back if that would
+// leave rows unused at the end of the buffer.
+func (bw *BufWindow) updateWrapped(idx int) {
+	content := bw.buf.content
+	start, rows := content.length(), 0
+	for start > 0 && rows+bw.lineRows(content.line(start-1)) <= bw.size {
+		start--
+		rows += bw.lineRows(content.line(start))
+	}
+	idx = max(min(idx, start, content.length()-1), 0)
+	end, rows := idx, 0
+	for end < content.length() && (end == idx || rows+bw.lineRows(content.line(end)) <= bw.size) {
+		rows += bw.lineRows(content.line(end))
+		end++
+	}
+	bw.bufIdx = idx
+	bw.buf.windowStart = idx
+	bw.lines = content.slice(idx, end)
+	bw.capacity = end - idx
+	if end == content.length() {
+		bw.capacity += max(bw.size-rows, 0)
+	}
+}
+
+func (bw *BufWindow) wraps() bool {
+	return bw.wrap
+}
+
+func (bw *BufWindow) textWidth() int {
+	return max(bw.width-bw.gutter, 1)
+}
+
+// lineRows is the number of rows line takes up in the window. A wrapped line
+// keeps room after its last rune for the cursor.
+func (bw *BufWindow) lineRows(line *Line) int {
+	if !bw.wraps() {
+		return 1
+	}
+	return bw.wrapCell(line, line.displayWidth(bw.buf.settings.TabWidth))/bw.textWidth() + 1
+}
+
+// padCell moves cell, where c would start, on to the next row when c is a
+// wide cluster that does not fit on what is left of the row.
+func (bw *BufWindow) padCell(cell int, c cluster, line *Line) int {
+	width := bw.textWidth()
+	if line.runes[c.start] != '\t' && c.width <= width && cell%width+c.width > width {
+		return cell + width - cell%width
+	}
+	return cell
+}
+
+// wrapCell returns the cell that column col of line is drawn in, counting the
+// cells of the rows of a wrapped line from the start of the first row.
+func (bw *BufWindow) wrapCell(line *Line, col int) int {
+	cell, end := 0, 0
+	for _, c := range line.clusters(bw.buf.settings.TabWidth) {
+		cell = bw.padCell(cell, c, line)
+		if c.col >= col {
+			return cell
+		}
+		cell += c.width
+		end = c.col + c.width
+	}
+	return cell + col - end
+}
+
+// wrapCol is the reverse of wrapCell: it returns the column of the cluster
+// drawn in cell, or of the cluster that a blank cell at the end of a row is
+// left for.
+func (bw *BufWindow) wrapCol(line *Line, target int) int {
+	cell, end := 0, 0
+	for _, c := range line.clusters(bw.buf.settings.TabWidth) {
+		cell = bw.padCell(cell, c, line)
+		if target < cell+c.width {
+			return c.col
+		}
+		cell += c.width
+		end = c.col + c.width
+	}
+	return end + target - cell
+}
+
+// rowOf returns the first row of the window line at idx.
+func (bw *BufWindow) rowOf(idx int) int {
+	row := 0
+	for i := 0; i < idx; i++ {
+		if i < len(bw.lines) {
+			row += bw.lineRows(bw.lines[i])
+		} else {
+			row++
+		}
+	}
+	return row
+}
+
+// screenCursor returns the cell the cursor is shown in, which is on a later
+// row of its line when the line wraps.
+func (bw *BufWindow) screenCursor() (int, int) {
+	if !bw.wraps() {
+		return bw.cur.X - bw.leftCol, bw.cur.Y
+	}
+	cell := bw.cur.X - bw.gutter
+	if bw.cur.Y < len(bw.lines) {
+		cell = bw.wrapCell(bw.lines[bw.cur.Y], cell)
+	}
+	return bw.gutter + cell%bw.textWidth(), bw.rowOf(bw.cur.Y) + cell/bw.textWidth()
+}
+
+// scrollToCursorColumn moves leftCol, the first text column shown, so that
+// the cursor stays sidescrolloff columns clear of either edge of the window.
+// It reports whether the window scrolled.
+func (bw *BufWindow) scrollToCursorColumn() bool {
+	leftCol := bw.leftCol
+	if bw.wraps() {
+		bw.leftCol = 0
+		return bw.leftCol != leftCol
+	}
+	width := bw.textWidth()
+	margin := min(bw.buf.settings.SideScrollOff, (width-1)/2)
+	col := bw.cur.X - bw.gutter
+	if col < bw.leftCol+margin {
+		bw.leftCol = max(col-margin, 0)
+	}
+	if col >= bw.leftCol+width-margin {
+		bw.leftCol = col - width + margin + 1
 	}
+	return bw.leftCol != leftCol
 }
 
 func (bw *BufWindow) resetLines() {
 	start := bw.bufIdx
 	end := bw.bufIdx + bw.length()
-	bw.lines = append([]*Line(nil), bw.buf.content.lines[start:end]...)
+	bw.lines = bw.buf.content.slice(start, end)
 }
 
 func (bw *BufWindow) line(idx int) *Line {
@@ -57,5 +213,5 @@ func (bw *BufWindow) line(idx int) *Line {
 }
 
 func (bw *BufWindow) lastLine() *Line {
-	return bw.lines[bw.size-1]
+	return bw.lines[len(bw.lines)-1]
 }
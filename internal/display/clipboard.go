@@ -0,0 +1,214 @@
+package display
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// clipboard is the system clipboard behind the "+ and "* registers. Text is
+// copied to it with an OSC 52 escape sequence written to the terminal, which
+// reaches the clipboard of the machine the terminal runs on, through SSH and
+// tmux. A local clipboard tool, wl-copy or xclip, is used as well when one is
+// found, and reads the clipboard back. Without one, reading gives what was
+// last copied or pasted into the terminal, as tcell does not pass on the
+// terminal's replies to OSC 52 queries.
+//
+// mode is one of
+//
+//	auto   the terminal and a local tool, whichever are there
+//	osc52  the terminal only
+//	tool   a local tool only
+//	off    nothing outside the editor
+type clipboard struct {
+	mode     string
+	last     []rune
+	detected bool
+	copyCmd  []string
+	pasteCmd []string
+}
+
+var clipboardModes = []string{"auto", "osc52", "tool", "off"}
+
+func isClipboardRegister(name rune) bool {
+	return name == '+' || name == '*'
+}
+
+func (c *clipboard) setMode(mode string) error {
+	if !slices.Contains(clipboardModes, mode) {
+		return fmt.Errorf("clipboard must be one of %s", strings.Join(clipboardModes, ", "))
+	}
+	c.mode = mode
+	c.detected = false
+	return nil
+}
+
+func (c *clipboard) currentMode() string {
+	if c.mode == "" {
+		return "auto"
+	}
+	return c.mode
+}
+
+// detect looks for a clipboard tool for the session the editor runs in.
+func (c *clipboard) detect() {
+	if c.detected {
+		return
+	}
+	c.detected = true
+	c.copyCmd, c.pasteCmd = nil, nil
+	if c.currentMode() != "auto" && c.currentMode() != "tool" {
+		return
+	}
+	switch {
+	case os.Getenv("WAYLAND_DISPLAY") != "" && hasCommand("wl-copy", "wl-paste"):
+		c.copyCmd = []string{"wl-copy"}
+		c.pasteCmd = []string{"wl-paste", "--no-newline"}
+	case os.Getenv("DISPLAY") != "" && hasCommand("xclip"):
+		c.copyCmd = []string{"xclip", "-selection", "clipboard"}
+		c.pasteCmd = []string{"xclip", "-selection", "clipboard", "-o"}
+	}
+}
+
+func hasCommand(names ...string) bool {
+	for _, name := range names {
+		if _, err := exec.LookPath(name); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func run(cmd []string, stdin []byte) ([]byte, error) {
+	command := exec.Command(cmd[0], cmd[1:]...)
+	command.Stdin = bytes.NewReader(stdin)
+	if stdin != nil {
+		// the tool may stay around to serve the selection, holding on to
+		// any output pipe, so only its exit is waited for
+		return nil, command.Run()
+	}
+	return command.Output()
+}
+
+// osc52 returns the escape sequence that sets the terminal's clipboard.
+func osc52(text []rune) []byte {
+	return []byte("\x1b]52;c;" + base64.StdEncoding.EncodeToString([]byte(string(text))) + "\a")
+}
+
+// terminal returns where escape sequences for the terminal are written: tty
+// when it is set, otherwise the screen's terminal, if it has one.
+func (d *Display) terminal() io.Writer {
+	if d.tty != nil {
+		return d.tty
+	}
+	tty, ok := d.Screen.Tty()
+	if !ok || tty == nil {
+		return nil
+	}
+	return tty
+}
+
+// copy puts text on the clipboard, writing to the terminal through tty, which
+// is nil when there is no terminal.
+func (c *clipboard) copy(tty io.Writer, text []rune) error {
+	c.last = slices.Clone(text)
+	c.detect()
+	mode := c.currentMode()
+	copied := false
+	if (mode == "auto" || mode == "osc52") && tty != nil {
+		if _, err := tty.Write(osc52(text)); err != nil {
+			return err
+		}
+		copied = true
+	}
+	if c.copyCmd != nil {
+		if _, err := run(c.copyCmd, []byte(string(text))); err != nil {
+			return fmt.Errorf("%s: %v", c.copyCmd[0], err)
+		}
+		copied = true
+	}
+	if !copied && mode != "off" {
+		return errors.New("no clipboard: not in a terminal and no clipboard tool found")
+	}
+	return nil
+}
+
+// paste returns the text on the clipboard.
+func (c *clipboard) paste() ([]rune, error) {
+	c.detect()
+	if c.pasteCmd != nil {
+		out, err := run(c.pasteCmd, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", c.pasteCmd[0], err)
+		}
+		return []rune(string(out)), nil
+	}
+	if len(c.last) == 0 {
+		return nil, errors.New("clipboard is empty; paste with the terminal instead")
+	}
+	return slices.Clone(c.last), nil
+}
+
+// clipboardRegister returns the clipboard as a register, made of whole lines
+// when it ends with a line break.
+func (d *Display) clipboardRegister() (register, error) {
+	text, err := d.clipboard.paste()
+	if err != nil {
+		return register{}, err
+	}
+	if len(text) > 0 && text[len(text)-1] == '\n' {
+		return register{visualLine, text}, nil
+	}
+	return register{visualChar, text}, nil
+}
+
+// startPaste starts collecting the keys of a bracketed paste, which are put
+// in as text once it ends instead of being run as commands.
+func (d *Display) startPaste() {
+	d.pasted = []rune{}
+}
+
+func (d *Display) collectPaste(ev *tcell.EventKey) {
+	switch ev.Key() {
+	case tcell.KeyRune:
+		d.pasted = append(d.pasted, ev.Rune())
+	case tcell.KeyEnter:
+		d.pasted = append(d.pasted, '\r')
+	case tcell.KeyLF:
+		d.pasted = append(d.pasted, '\n')
+	case tcell.KeyTab:
+		d.pasted = append(d.pasted, '\t')
+	}
+}
+
+// finishPaste puts the pasted text in at the cursor. It also becomes what
+// the clipboard register reads when there is no clipboard tool to ask.
+func (d *Display) finishPaste() {
+	text := []rune(strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(string(d.pasted)))
+	d.pasted = nil
+	if len(text) == 0 {
+		return
+	}
+	d.clipboard.last = text
+	switch d.Mode {
+	case Command:
+		line, _, _ := strings.Cut(string(text), "\n")
+		cl := d.cmdline
+		cl.text = slices.Insert(cl.text, cl.cursor, []rune(line)...)
+		cl.cursor += len([]rune(line))
+	case Normal, Insert:
+		pos := d.bufWindow.bufPos()
+		d.put(register{visualChar, text}, true)
+		if d.Mode == Insert {
+			d.moveToBufPos(advance(pos, text))
+		}
+	}
+}
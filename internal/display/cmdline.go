@@ -0,0 +1,191 @@
+package display
+
+import (
+	"cmp"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// commandLine is the ":" prompt being edited on the status row.
+type commandLine struct {
+	text   []rune
+	cursor int
+	// histIdx is the history entry shown, or len(history) for the line
+	// being typed, which is kept in draft while going through the history.
+	histIdx int
+	draft   []rune
+	// matches are the completions of the word at matchStart that Tab cycles
+	// through, and match the one shown.
+	matches    []string
+	match      int
+	matchStart int
+	suffix     []rune
+}
+
+func (d *Display) startCommandLine(text string) {
+	d.cmdline = &commandLine{
+		text:    []rune(text),
+		cursor:  len([]rune(text)),
+		histIdx: len(d.cmdHistory),
+	}
+	d.Mode = Command
+}
+
+func (d *Display) runCommandMode(ev tcell.Event) {
+	key, ok := ev.(*tcell.EventKey)
+	if !ok {
+		return
+	}
+	cl := d.cmdline
+	if key.Key() != tcell.KeyTab {
+		cl.matches = nil
+	}
+	switch key.Key() {
+	case tcell.KeyEscape, tcell.KeyCtrlC:
+		d.cmdline = nil
+		d.Mode = Normal
+	case tcell.KeyEnter:
+		line := string(cl.text)
+		d.cmdline = nil
+		d.Mode = Normal
+		if strings.TrimSpace(line) == "" {
+			return
+		}
+		d.addCommandHistory(line)
+		if err := d.runCommandLine(line); err != nil {
+			d.ShowError(err)
+		}
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		if len(cl.text) == 0 {
+			d.cmdline = nil
+			d.Mode = Normal
+			return
+		}
+		if cl.cursor > 0 {
+			cl.text = slices.Delete(cl.text, cl.cursor-1, cl.cursor)
+			cl.cursor--
+		}
+	case tcell.KeyDelete:
+		if cl.cursor < len(cl.text) {
+			cl.text = slices.Delete(cl.text, cl.cursor, cl.cursor+1)
+		}
+	case tcell.KeyCtrlU:
+		cl.text = cl.text[cl.cursor:]
+		cl.cursor = 0
+	case tcell.KeyLeft:
+		cl.cursor = max(cl.cursor-1, 0)
+	case tcell.KeyRight:
+		cl.cursor = min(cl.cursor+1, len(cl.text))
+	case tcell.KeyHome, tcell.KeyCtrlA:
+		cl.cursor = 0
+	case tcell.KeyEnd, tcell.KeyCtrlE:
+		cl.cursor = len(cl.text)
+	case tcell.KeyUp:
+		d.showCommandHistory(cl.histIdx - 1)
+	case tcell.KeyDown:
+		d.showCommandHistory(cl.histIdx + 1)
+	case tcell.KeyTab:
+		d.completeCommandLine()
+	case tcell.KeyRune:
+		cl.text = slices.Insert(cl.text, cl.cursor, key.Rune())
+		cl.cursor++
+	}
+}
+
+func (d *Display) addCommandHistory(line string) {
+	if n := len(d.cmdHistory); n > 0 && d.cmdHistory[n-1] == line {
+		return
+	}
+	d.cmdHistory = append(d.cmdHistory, line)
+}
+
+// showCommandHistory puts history entry i on the command line. Going past the
+// newest entry brings back what was being typed.
+func (d *Display) showCommandHistory(i int) {
+	cl := d.cmdline
+	if i < 0 || i > len(d.cmdHistory) {
+		return
+	}
+	if cl.histIdx == len(d.cmdHistory) {
+		cl.draft = slices.Clone(cl.text)
+	}
+	cl.histIdx = i
+	if i == len(d.cmdHistory) {
+		cl.text = slices.Clone(cl.draft)
+	} else {
+		cl.text = []rune(d.cmdHistory[i])
+	}
+	cl.cursor = len(cl.text)
+}
+
+// completeCommandLine completes the word before the cursor, a command name or
+// the file name argument of a command that takes one. Pressing Tab again
+// moves on to the next completion.
+func (d *Display) completeCommandLine() {
+	cl := d.cmdline
+	if cl.matches == nil {
+		start, matches := completions(string(cl.text[:cl.cursor]))
+		if len(matches) == 0 {
+			return
+		}
+		cl.matches, cl.match = matches, -1
+		cl.matchStart = len([]rune(string(cl.text[:cl.cursor])[:start]))
+		cl.suffix = slices.Clone(cl.text[cl.cursor:])
+	}
+	cl.match = (cl.match + 1) % len(cl.matches)
+	text := append(slices.Clone(cl.text[:cl.matchStart]), []rune(cl.matches[cl.match])...)
+	cl.cursor = len(text)
+	cl.text = append(text, cl.suffix...)
+}
+
+// completions returns where the word to complete starts in text and what it
+// can be completed to.
+func completions(text string) (int, []string) {
+	name := strings.TrimLeft(text, ": ")
+	start := len(text) - len(name)
+	end := strings.IndexFunc(name, func(r rune) bool { return r == ' ' || r == '!' })
+	if end == -1 {
+		return start, commandNames(name)
+	}
+	cmd, ok := lookupCommand(name[:end])
+	if !ok || cmd.args != fileArg {
+		return 0, nil
+	}
+	word := strings.LastIndexAny(text, " ") + 1
+	return word, fileNames(text[word:])
+}
+
+// fileNames lists the files whose path starts with prefix, directories with a
+// trailing slash. Hidden files are only listed for a prefix naming them.
+func fileNames(prefix string) []string {
+	dir, base := filepath.Split(prefix)
+	entries, err := os.ReadDir(expandPath(cmp.Or(dir, ".")))
+	if err != nil {
+		return nil
+	}
+	names := []string{}
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, base) || strings.HasPrefix(name, ".") && !strings.HasPrefix(base, ".") {
+			continue
+		}
+		if e.IsDir() {
+			name += "/"
+		}
+		names = append(names, dir+name)
+	}
+	return names
+}
+
+func (d *Display) drawCommandLine() {
+	d.drawStatusBar(append([]rune{':'}, d.cmdline.text...), d.StatusBarStyle)
+}
+
+func (d *Display) commandLineCursor() int {
+	cl := d.cmdline
+	return 1 + (&Line{runes: cl.text}).colAt(cl.cursor, 1)
+}
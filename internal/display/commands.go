@@ -0,0 +1,449 @@
+package display
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type argKind int
+
+const (
+	noArgs argKind = iota
+	// fileArg is an optional file name.
+	fileArg
+	// wordArgs is any number of words.
+	wordArgs
+)
+
+// command is a command run from the command line. The first of names is its
+// full name and the rest are abbreviations of it.
+type command struct {
+	names []string
+	args  argKind
+	run   func(d *Display, c commandCall) error
+}
+
+// commandCall is a parsed command line: the command name as typed, whether it
+// was followed by a "!", and its arguments.
+type commandCall struct {
+	name string
+	bang bool
+	args []string
+}
+
+var commands = []command{
+	{[]string{"write", "w"}, fileArg, (*Display).writeCommand},
+	{[]string{"quit", "q"}, noArgs, (*Display).quitCommand},
+	{[]string{"wq"}, fileArg, (*Display).writeQuitCommand},
+	{[]string{"xit", "x"}, fileArg, (*Display).exitCommand},
+	{[]string{"edit", "e"}, fileArg, (*Display).editCommand},
+	{[]string{"saveas", "sav"}, fileArg, (*Display).saveAsCommand},
+	{[]string{"set", "se"}, wordArgs, (*Display).setCommand},
+	{[]string{"fileformat", "ff"}, wordArgs, (*Display).fileFormatCommand},
+	{[]string{"encoding", "enc"}, wordArgs, (*Display).encodingCommand},
+	{[]string{"earlier", "ea"}, wordArgs, (*Display).earlierCommand},
+	{[]string{"later", "lat"}, wordArgs, (*Display).laterCommand},
+	{[]string{"undotree"}, noArgs, (*Display).undoTreeCommand},
+	{[]string{"clearundo"}, noArgs, (*Display).clearUndoCommand},
+	{[]string{"bnext", "bn"}, noArgs, (*Display).bufferNextCommand},
+	{[]string{"bprevious", "bp"}, noArgs, (*Display).bufferPrevCommand},
+	{[]string{"bdelete", "bd"}, noArgs, (*Display).bufferDeleteCommand},
+	{[]string{"buffers", "ls"}, noArgs, (*Display).buffersCommand},
+	{[]string{"split", "sp"}, fileArg, (*Display).splitCommand},
+	{[]string{"vsplit", "vs"}, fileArg, (*Display).vsplitCommand},
+	{[]string{"close", "clo"}, noArgs, (*Display).closeCommand},
+}
+
+func lookupCommand(name string) (*command, bool) {
+	for i, c := range commands {
+		if slices.Contains(c.names, name) {
+			return &commands[i], true
+		}
+	}
+	return nil, false
+}
+
+// commandNames lists the names that complete prefix, full names first.
+func commandNames(prefix string) []string {
+	names := []string{}
+	for _, c := range commands {
+		if strings.HasPrefix(c.names[0], prefix) {
+			names = append(names, c.names[0])
+		}
+	}
+	for _, c := range commands {
+		for _, name := range c.names[1:] {
+			if strings.HasPrefix(name, prefix) && !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// parseCommandLine splits a command line into the command and its call. A
+// line number on its own, or "$" for the last line, moves the cursor there.
+func parseCommandLine(line string) (*command, commandCall, error) {
+	line = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), ":"))
+	if line == "$" || isDigits(line) {
+		return &gotoLineCommand, commandCall{name: line, args: []string{line}}, nil
+	}
+	end := strings.IndexFunc(line, func(r rune) bool { return !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z') })
+	if end == -1 {
+		end = len(line)
+	}
+	call := commandCall{name: line[:end]}
+	if call.name == "" {
+		return nil, call, fmt.Errorf("not a command: %s", line)
+	}
+	rest := line[end:]
+	if strings.HasPrefix(rest, "!") {
+		call.bang = true
+		rest = rest[1:]
+	}
+	if rest != "" && rest[0] != ' ' && rest[0] != '\t' {
+		return nil, call, fmt.Errorf("trailing characters: %s", rest)
+	}
+	cmd, ok := lookupCommand(call.name)
+	if !ok {
+		return nil, call, fmt.Errorf("not a command: %s", call.name)
+	}
+	args, err := splitArgs(rest)
+	if err != nil {
+		return nil, call, err
+	}
+	call.args = args
+	switch {
+	case cmd.args == noArgs && len(args) > 0:
+		return nil, call, fmt.Errorf("%s takes no arguments", cmd.names[0])
+	case cmd.args == fileArg && len(args) > 1:
+		return nil, call, fmt.Errorf("%s takes one file name", cmd.names[0])
+	}
+	return cmd, call, nil
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// splitArgs splits s into words on spaces. Double quotes or a backslash keep
+// spaces in a word.
+func splitArgs(s string) ([]string, error) {
+	args := []string{}
+	word := []rune{}
+	inWord, quoted, escaped := false, false, false
+	for _, r := range s {
+		switch {
+		case escaped:
+			word = append(word, r)
+			escaped = false
+		case r == '\\':
+			inWord, escaped = true, true
+		case r == '"':
+			inWord, quoted = true, !quoted
+		case (r == ' ' || r == '\t') && !quoted:
+			if inWord {
+				args = append(args, string(word))
+			}
+			word, inWord = word[:0], false
+		default:
+			word = append(word, r)
+			inWord = true
+		}
+	}
+	if quoted {
+		return nil, errors.New("missing closing quote")
+	}
+	if inWord {
+		args = append(args, string(word))
+	}
+	return args, nil
+}
+
+// expandPath expands a leading ~ to the home directory.
+func expandPath(name string) string {
+	if name != "~" && !strings.HasPrefix(name, "~/") {
+		return name
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return name
+	}
+	return filepath.Join(home, name[1:])
+}
+
+// runCommandLine parses and runs a command line.
+func (d *Display) runCommandLine(line string) error {
+	cmd, call, err := parseCommandLine(line)
+	if err != nil {
+		return err
+	}
+	return cmd.run(d, call)
+}
+
+var errNotSaved = errors.New("No write since last change (add ! to override)")
+
+var gotoLineCommand = command{nil, wordArgs, (*Display).gotoLineCommand}
+
+func (d *Display) gotoLineCommand(c commandCall) error {
+	line := d.ActiveBuf.length()
+	if c.args[0] != "$" {
+		n, err := strconv.Atoi(c.args[0])
+		if err != nil {
+			return err
+		}
+		line = n
+	}
+	d.moveToBufPos(position{line: max(min(line, d.ActiveBuf.length())-1, 0)})
+	d.SetBufWindow()
+	return nil
+}
+
+// saveActiveBuf writes the active buffer. Unless force is set it will not
+// overwrite changes made to the file since it was read.
+func (d *Display) saveActiveBuf(force bool) error {
+	buf := d.ActiveBuf
+	if _, changed, err := buf.diskChanged(buf.disk); !force && err == nil && changed {
+		return errors.New("file changed on disk since it was read (add ! to override)")
+	}
+	return d.writeBuffer(buf)
+}
+
+func (d *Display) writeCommand(c commandCall) error {
+	if len(c.args) == 0 {
+		return d.saveActiveBuf(c.bang)
+	}
+	if d.ActiveBuf.path == "" {
+		return d.saveAsCommand(c)
+	}
+	path, err := filepath.Abs(expandPath(c.args[0]))
+	if err != nil {
+		return err
+	}
+	if path == d.ActiveBuf.path {
+		return d.saveActiveBuf(c.bang)
+	}
+	if err := checkWriteTarget(c.args[0], path, c.bang); err != nil {
+		return err
+	}
+	if _, err := d.ActiveBuf.writeTo(path); err != nil {
+		return err
+	}
+	d.showMessage(fmt.Sprintf("\"%s\" written, %d lines", path, d.ActiveBuf.length()))
+	return nil
+}
+
+// checkWriteTarget reports why the buffer should not be written to path,
+// named arg on the command line: it is a directory, or it exists and the
+// command was not forced.
+func checkWriteTarget(arg, path string, force bool) error {
+	if strings.HasSuffix(arg, string(filepath.Separator)) {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	info, err := os.Stat(path)
+	switch {
+	case err == nil && info.IsDir():
+		return fmt.Errorf("%s is a directory", path)
+	case err == nil && !force:
+		return fmt.Errorf("\"%s\" exists (add ! to override)", path)
+	case err != nil && !errors.Is(err, fs.ErrNotExist):
+		return err
+	}
+	return nil
+}
+
+// saveAsCommand writes the buffer to the given file and renames it to that
+// file once the write has worked.
+func (d *Display) saveAsCommand(c commandCall) error {
+	if len(c.args) == 0 {
+		return errors.New("no file name")
+	}
+	path, err := filepath.Abs(expandPath(c.args[0]))
+	if err != nil {
+		return err
+	}
+	if err := checkWriteTarget(c.args[0], path, c.bang); err != nil {
+		return err
+	}
+	buf := d.ActiveBuf
+	data, err := buf.writeTo(path)
+	if err != nil {
+		return err
+	}
+	buf.removeSwap()
+	buf.path = path
+	buf.settings = settingsForPath(path)
+	buf.markWritten(data)
+	d.saveUndoFile(buf)
+	return nil
+}
+
+func (d *Display) quitCommand(c commandCall) error {
+	if len(d.windows()) > 1 {
+		return d.closeWindow()
+	}
+	modified := d.modifiedBuffers()
+	if !c.bang && len(modified) > 0 {
+		d.switchToBuffer(modified[0])
+		return errNotSaved
+	}
+	d.Mode = Exit
+	return nil
+}
+
+func (d *Display) writeQuitCommand(c commandCall) error {
+	if err := d.writeCommand(c); err != nil {
+		return err
+	}
+	return d.quitCommand(commandCall{name: "quit"})
+}
+
+// exitCommand is :wq that only writes when the buffer has changed.
+func (d *Display) exitCommand(c commandCall) error {
+	if d.ActiveBuf.modified {
+		if err := d.writeCommand(c); err != nil {
+			return err
+		}
+	}
+	return d.quitCommand(commandCall{name: "quit"})
+}
+
+func (d *Display) editCommand(c commandCall) error {
+	if len(c.args) == 1 {
+		return d.OpenFile(expandPath(c.args[0]))
+	}
+	buf := d.ActiveBuf
+	if buf.path == "" {
+		return errors.New("no file name")
+	}
+	if buf.modified && !c.bang {
+		return errNotSaved
+	}
+	d.reloadActiveBuf()
+	return nil
+}
+
+func (d *Display) setCommand(c commandCall) error {
+	if len(c.args) == 0 {
+		s := d.ActiveBuf.settings
+		d.showMessage(fmt.Sprintf("tabwidth=%d shiftwidth=%d expandtab=%t wrap=%t sidescrolloff=%d clipboard=%s",
+			s.TabWidth, s.ShiftWidth, s.ExpandTab, d.bufWindow.wrap, s.SideScrollOff, d.clipboard.currentMode()))
+		return nil
+	}
+	for _, arg := range c.args {
+		name, value, _ := strings.Cut(arg, "=")
+		switch name {
+		case "clipboard":
+			if err := d.clipboard.setMode(value); err != nil {
+				return err
+			}
+			continue
+		case "wrap", "nowrap":
+			// wrapping belongs to the window, not the buffer
+			d.bufWindow.wrap = name == "wrap"
+			continue
+		}
+		if err := d.ActiveBuf.SetOption(name, value); err != nil {
+			return err
+		}
+	}
+	d.layoutWindows()
+	return nil
+}
+
+func (d *Display) fileFormatCommand(c commandCall) error {
+	switch len(c.args) {
+	case 0:
+		d.showMessage("fileformat=" + d.ActiveBuf.format.String())
+		return nil
+	case 1:
+		return d.ActiveBuf.SetFileFormat(c.args[0])
+	}
+	return errors.New("fileformat takes one format")
+}
+
+func (d *Display) encodingCommand(c commandCall) error {
+	switch len(c.args) {
+	case 0:
+		d.showMessage("encoding=" + d.ActiveBuf.format.encoding.name)
+		return nil
+	case 1:
+		return d.ActiveBuf.SetEncoding(c.args[0])
+	}
+	return errors.New("encoding takes one name")
+}
+
+func (d *Display) earlierCommand(c commandCall) error {
+	return d.Earlier(strings.Join(c.args, ""))
+}
+
+func (d *Display) laterCommand(c commandCall) error {
+	return d.Later(strings.Join(c.args, ""))
+}
+
+func (d *Display) undoTreeCommand(c commandCall) error {
+	d.showUndoTree()
+	return nil
+}
+
+func (d *Display) clearUndoCommand(c commandCall) error {
+	d.clearUndoHistory()
+	return nil
+}
+
+func (d *Display) bufferNextCommand(c commandCall) error {
+	d.cycleBuffer(1)
+	return nil
+}
+
+func (d *Display) bufferPrevCommand(c commandCall) error {
+	d.cycleBuffer(-1)
+	return nil
+}
+
+func (d *Display) bufferDeleteCommand(c commandCall) error {
+	if d.ActiveBuf.modified && !c.bang {
+		return errNotSaved
+	}
+	d.closeBuffer(true)
+	return nil
+}
+
+func (d *Display) buffersCommand(c commandCall) error {
+	d.listBuffers()
+	return nil
+}
+
+func (d *Display) splitCommand(c commandCall) error {
+	return d.splitWithFile(false, c)
+}
+
+func (d *Display) vsplitCommand(c commandCall) error {
+	return d.splitWithFile(true, c)
+}
+
+func (d *Display) splitWithFile(vertical bool, c commandCall) error {
+	d.splitWindow(vertical)
+	if len(c.args) == 1 {
+		return d.OpenFile(expandPath(c.args[0]))
+	}
+	return nil
+}
+
+func (d *Display) closeCommand(c commandCall) error {
+	return d.closeWindow()
+}
@@ -0,0 +1,252 @@
+package display
+
+import (
+	"fmt"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+const diffContext = 3
+
+type diffOp struct {
+	kind byte
+	text string
+}
+
+// diffLines returns the shortest edit script that turns a into b using
+// Myers' O(ND) algorithm, in its linear space form: the middle snake of an
+// edit path splits it in two, and each half is diffed on its own.
+func diffLines(a, b []string) []diffOp {
+	return appendDiff(make([]diffOp, 0, max(len(a), len(b))), a, b)
+}
+
+func appendDiff(ops []diffOp, a, b []string) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	ops = appendOps(ops, ' ', a[:prefix])
+	a, b = a[prefix:], b[prefix:]
+	suffix := 0
+	for suffix < len(a) && suffix < len(b) && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	common := a[len(a)-suffix:]
+	a, b = a[:len(a)-suffix], b[:len(b)-suffix]
+
+	switch x, y := middleSnake(a, b); {
+	case len(a) == 0 || len(b) == 0 || x < 0:
+		ops = appendOps(ops, '-', a)
+		ops = appendOps(ops, '+', b)
+	default:
+		ops = appendDiff(ops, a[:x], b[:y])
+		ops = appendDiff(ops, a[x:], b[y:])
+	}
+	return appendOps(ops, ' ', common)
+}
+
+func appendOps(ops []diffOp, kind byte, lines []string) []diffOp {
+	for _, line := range lines {
+		ops = append(ops, diffOp{kind, line})
+	}
+	return ops
+}
+
+// middleSnake searches for the shortest edit path from both ends of a and b
+// at once and returns where the two searches meet, which is on the path. It
+// returns -1, -1 when a or b is empty.
+func middleSnake(a, b []string) (int, int) {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return -1, -1
+	}
+	maxD := (n + m + 1) / 2
+	offset := maxD
+	forward := make([]int, 2*maxD+2)
+	backward := make([]int, 2*maxD+2)
+	for i := range forward {
+		forward[i], backward[i] = -1, -1
+	}
+	forward[offset+1], backward[offset+1] = 0, 0
+	delta := n - m
+	// the searches can only meet on a forward step when delta is odd
+	odd := delta%2 != 0
+	// diagonals that have run off the end or the bottom are not searched
+	// again
+	fStart, fEnd, bStart, bEnd := 0, 0, 0, 0
+	for d := range maxD {
+		for k := -d + fStart; k <= d-fEnd; k += 2 {
+			i := offset + k
+			x := 0
+			if k == -d || k != d && forward[i-1] < forward[i+1] {
+				x = forward[i+1]
+			} else {
+				x = forward[i-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			forward[i] = x
+			switch {
+			case x > n:
+				fEnd += 2
+			case y > m:
+				fStart += 2
+			case odd:
+				j := offset + delta - k
+				if j >= 0 && j < len(backward) && backward[j] != -1 && x >= n-backward[j] {
+					return x, y
+				}
+			}
+		}
+		for k := -d + bStart; k <= d-bEnd; k += 2 {
+			i := offset + k
+			x := 0
+			if k == -d || k != d && backward[i-1] < backward[i+1] {
+				x = backward[i+1]
+			} else {
+				x = backward[i-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[n-x-1] == b[m-y-1] {
+				x++
+				y++
+			}
+			backward[i] = x
+			switch {
+			case x > n:
+				bEnd += 2
+			case y > m:
+				bStart += 2
+			case !odd:
+				j := offset + delta - k
+				if j >= 0 && j < len(forward) && forward[j] != -1 && forward[j] >= n-x {
+					fx := forward[j]
+					return fx, fx - (j - offset)
+				}
+			}
+		}
+	}
+	return -1, -1
+}
+
+func unifiedDiff(aName, bName string, a, b []string) []string {
+	ops := diffLines(a, b)
+	aPos := make([]int, len(ops)+1)
+	bPos := make([]int, len(ops)+1)
+	changes := []int{}
+	for i, op := range ops {
+		aPos[i+1], bPos[i+1] = aPos[i], bPos[i]
+		if op.kind != '+' {
+			aPos[i+1]++
+		}
+		if op.kind != '-' {
+			bPos[i+1]++
+		}
+		if op.kind != ' ' {
+			changes = append(changes, i)
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+
+	out := []string{"--- " + aName, "+++ " + bName}
+	for i := 0; i < len(changes); {
+		start := max(changes[i]-diffContext, 0)
+		last := changes[i]
+		for i+1 < len(changes) && changes[i+1]-last <= 2*diffContext {
+			i++
+			last = changes[i]
+		}
+		end := min(last+diffContext, len(ops)-1)
+		out = append(out, fmt.Sprintf("@@ -%s +%s @@",
+			hunkRange(aPos[start], aPos[end+1]-aPos[start]),
+			hunkRange(bPos[start], bPos[end+1]-bPos[start]),
+		))
+		for _, op := range ops[start : end+1] {
+			out = append(out, string(op.kind)+op.text)
+		}
+		i++
+	}
+	return out
+}
+
+func hunkRange(start, length int) string {
+	if length == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	return fmt.Sprintf("%d,%d", start+1, length)
+}
+
+func (b *Buffer) lineStrings() []string {
+	return b.content.lineStrings()
+}
+
+func (la *LineArray) lineStrings() []string {
+	lines := []string{}
+	for _, line := range la.allLines() {
+		lines = append(lines, string(line.runes))
+	}
+	return lines
+}
+
+func (d *Display) showDiff(title string, lines []string, returnMode int) {
+	if len(lines) == 0 {
+		lines = []string{"no differences"}
+	}
+	d.diffTitle = title
+	d.diffLines = lines
+	d.diffTop = 0
+	d.diffReturnMode = returnMode
+	d.Mode = Diff
+	d.Screen.HideCursor()
+}
+
+func (d *Display) drawDiff() {
+	style := map[byte]tcell.Style{
+		'+': d.BufStyle.Foreground(tcell.ColorPaleGreen),
+		'-': d.BufStyle.Foreground(tcell.ColorIndianRed),
+		'@': d.BufStyle.Foreground(tcell.ColorTurquoise),
+	}
+	for y := 0; y < d.height-1; y++ {
+		text := []rune{}
+		lineStyle := d.BufStyle
+		if idx := d.diffTop + y; idx < len(d.diffLines) {
+			text = []rune(d.diffLines[idx])
+			if s, ok := style[d.diffLines[idx][0]]; ok {
+				lineStyle = s
+			}
+		}
+		for x := 0; x < d.width; x++ {
+			r := ' '
+			if x < len(text) {
+				r = text[x]
+			}
+			d.Screen.SetContent(x, y, r, nil, lineStyle)
+		}
+	}
+	d.drawStatusBar([]rune(d.diffTitle+" (j/k to scroll, q to go back)"), d.StatusBarStyle)
+}
+
+func (d *Display) runDiffMode(ev tcell.Event) {
+	switch ev := ev.(type) {
+	case *tcell.EventKey:
+		switch {
+		case ev.Rune() == 'j':
+			if d.diffTop < len(d.diffLines)-1 {
+				d.diffTop++
+			}
+		case ev.Rune() == 'k':
+			if d.diffTop > 0 {
+				d.diffTop--
+			}
+		case ev.Rune() == 'q' || ev.Key() == tcell.KeyEscape:
+			d.Mode = d.diffReturnMode
+			d.Screen.Clear()
+			d.SetBufWindow()
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package display
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"slices"
 	"unicode"
 
 	"github.com/cyamas/rizz/internal/highlighter"
@@ -15,24 +18,37 @@ const (
 	Normal = iota
 	Insert
 	Exit
-	Open
+	Command
 	Write
-	Delete
 	New
 	Event
+	Prompt
+	Diff
+	UndoTree
+	Window
+	Visual
+	Register
 )
 
 const LeftMarginSize = 8
 
+// wrapMarker is shown in the gutter on the rows a wrapped line continues onto.
+const wrapMarker = '↪'
+
 var modes = map[int]string{
-	Normal: "Normal",
-	Insert: "Insert",
-	Exit:   "Exit",
-	Open:   "Open",
-	Write:  "Write",
-	Delete: "Delete",
-	New:    "New",
-	Event:  "Event",
+	Normal:   "Normal",
+	Insert:   "Insert",
+	Exit:     "Exit",
+	Command:  "Command",
+	Write:    "Write",
+	New:      "New",
+	Event:    "Event",
+	Prompt:   "Prompt",
+	Diff:     "Diff",
+	UndoTree: "UndoTree",
+	Window:   "Window",
+	Visual:   "Visual",
+	Register: "Register",
 }
 
 type cell struct {
@@ -41,63 +57,94 @@ type cell struct {
 	Style tcell.Style
 }
 
-var Cur cell
-var bufPos cell
-
 func (d *Display) SetBufWindow() {
 	window := d.bufWindow
 	for y, line := range window.lines {
 		if line == nil {
 			continue
 		}
-		for j, r := range line.runes {
-			x := LeftMarginSize + j
-			d.Screen.SetContent(x, y, r, nil, line.getRuneStyle(j))
-		}
+		d.drawLine(y, line)
 	}
 }
 
 func (d *Display) windowAtBottom() bool {
-	if d.ActiveBuf.length() < d.bufWindow.size {
+	if d.ActiveBuf.length() < d.bufWindow.capacity {
 		return true
 	}
 	return d.bufWindow.lastLine() == d.ActiveBuf.lastLine()
 }
 
 func (d *Display) InitBufWindow() {
-	bw := newBufWindow(d.height - 1)
+	if !slices.Contains(d.buffers, d.ActiveBuf) {
+		d.buffers = append(d.buffers, d.ActiveBuf)
+	}
+	bw := newBufWindow(d.height - 1 - d.textTop())
 	d.bufWindow = bw
 	bw.buf = d.ActiveBuf
-	for i, line := range d.ActiveBuf.content.lines {
-		if i >= d.bufWindow.size {
-			break
-		}
+	bw.wrap = false
+	d.layoutRoot = &splitNode{window: bw}
+	bw.node = d.layoutRoot
+	d.layoutRoot.layout(0, d.textTop(), d.width, d.height-1-d.textTop())
+	count := min(d.ActiveBuf.length(), d.bufWindow.size)
+	for i, line := range d.ActiveBuf.content.slice(0, count) {
 		d.bufWindow.lines[i] = line
 	}
 }
 
 type Display struct {
-	Screen         tcell.Screen
-	width          int
-	height         int
-	bufWindow      *BufWindow
-	ActiveBuf      *Buffer
-	Highlighter    *highlighter.Highlighter
-	Mode           int
-	StatusBar      []rune
-	BufStyle       tcell.Style
-	LineNoStyle    tcell.Style
-	StatusBarStyle tcell.Style
+	Screen             tcell.Screen
+	width              int
+	height             int
+	bufWindow          *BufWindow
+	layoutRoot         *splitNode
+	buffers            []*Buffer
+	ActiveBuf          *Buffer
+	Highlighter        *highlighter.Highlighter
+	Mode               int
+	StatusBar          []rune
+	cmdline            *commandLine
+	cmdHistory         []string
+	visual             visualKind
+	visualStart        position
+	blockInsert        *blockInsert
+	registers          registers
+	register           rune
+	registerReturnMode int
+	pending            pendingCommand
+	clipboard          clipboard
+	tty                io.Writer
+	pasted             []rune
+	message            string
+	messageIsError     bool
+	quitPending        bool
+	keepSwaps          bool
+	prompt             *prompt
+	diffTitle          string
+	diffLines          []string
+	diffTop            int
+	diffReturnMode     int
+	undoTreeRows       []undoTreeRow
+	undoTreeSel        int
+	undoTreeTop        int
+	BufStyle           tcell.Style
+	LineNoStyle        tcell.Style
+	StatusBarStyle     tcell.Style
+	ErrorStyle         tcell.Style
+	SelectionStyle     tcell.Style
 }
 
 func NewDisplay() *Display {
 	bufStyle := tcell.StyleDefault.Foreground(tcell.ColorWhite).Background(tcell.ColorBlack)
 	lineNoStyle := tcell.StyleDefault.Foreground(tcell.ColorSilver).Background(tcell.ColorBlack)
 	statusBarStyle := tcell.StyleDefault.Foreground(tcell.ColorWhiteSmoke).Background(tcell.ColorDarkSlateGray)
+	errorStyle := tcell.StyleDefault.Foreground(tcell.ColorWhite).Background(tcell.ColorDarkRed)
+	selectionStyle := tcell.StyleDefault.Background(tcell.ColorDarkSlateBlue)
 	return &Display{
 		BufStyle:       bufStyle,
 		LineNoStyle:    lineNoStyle,
 		StatusBarStyle: statusBarStyle,
+		ErrorStyle:     errorStyle,
+		SelectionStyle: selectionStyle,
 		Highlighter:    highlighter.New(lexer.New()),
 	}
 }
@@ -107,10 +154,11 @@ func (d *Display) Init() {
 	if err != nil {
 		log.Fatalf("%v", err)
 	}
-	d.Screen = screen
 	if err := screen.Init(); err != nil {
 		log.Fatalf("%v", err)
 	}
+	screen.EnablePaste()
+	d.Screen = newFrame(screen)
 	d.Screen.SetStyle(d.BufStyle)
 	d.width, d.height = d.Screen.Size()
 	d.Screen.Clear()
@@ -118,20 +166,45 @@ func (d *Display) Init() {
 }
 
 func (d *Display) Run() {
+	stop := make(chan struct{})
+	defer close(stop)
+	go d.watchFiles(stop)
+	go d.watchSignals(stop)
 	for {
 		if d.Mode == Exit {
+			if !d.keepSwaps {
+				d.removeSwapFiles()
+			}
 			return
 		}
 		if d.Mode == Write {
-			d.ActiveBuf.writeToFile()
 			d.Mode = Normal
+			d.writeActiveBuf()
 		}
-		d.setBufPos()
-		d.setStatusBar()
-		d.setLineNumbers()
-		d.Screen.ShowCursor(Cur.X, Cur.Y)
+		d.draw()
 		d.Screen.Show()
 		ev := d.Screen.PollEvent()
+		switch ev := ev.(type) {
+		case *tcell.EventPaste:
+			if ev.Start() {
+				d.startPaste()
+			} else {
+				d.finishPaste()
+			}
+			continue
+		case *tcell.EventKey:
+			if d.pasted != nil {
+				d.collectPaste(ev)
+				continue
+			}
+			d.clearMessage()
+		case *tcell.EventInterrupt:
+			d.handleInterrupt(ev)
+			continue
+		case *tcell.EventResize:
+			d.resize()
+			continue
+		}
 		switch {
 		case d.Mode == Normal:
 			d.runNormalMode(ev)
@@ -139,15 +212,92 @@ func (d *Display) Run() {
 			d.runInsertMode(ev)
 		case d.Mode == New:
 			d.runNewMode(ev)
-		case d.Mode == Delete:
-			d.runDeleteMode(ev)
 		case d.Mode == Event:
 			d.runEventMode(ev)
+		case d.Mode == Prompt:
+			d.runPromptMode(ev)
+		case d.Mode == Diff:
+			d.runDiffMode(ev)
+		case d.Mode == UndoTree:
+			d.runUndoTreeMode(ev)
+		case d.Mode == Command:
+			d.runCommandMode(ev)
+		case d.Mode == Window:
+			d.runWindowMode(ev)
+		case d.Mode == Visual:
+			d.runVisualMode(ev)
+		case d.Mode == Register:
+			d.runRegisterMode(ev)
 		}
 	}
 
 }
 
+// resize lays the screen out again for the new size of the terminal, in
+// whatever mode the editor is in.
+func (d *Display) resize() {
+	d.width, d.height = d.Screen.Size()
+	d.layoutWindows()
+	if d.undoTreeSel >= d.undoTreeTop+d.height-1 {
+		d.undoTreeTop = max(d.undoTreeSel-d.height+2, 0)
+	}
+	d.Screen.Sync()
+}
+
+// draw brings the whole screen up to date for the current mode. Only the
+// cells that changed reach the terminal when the frame is shown.
+func (d *Display) draw() {
+	switch d.Mode {
+	case Diff:
+		d.drawDiff()
+	case UndoTree:
+		d.drawUndoTree()
+	default:
+		d.setBufPos()
+		d.keepCursorInView()
+		d.setStatusBar()
+		d.setLineNumbers()
+		d.drawTabLine()
+		d.drawWindows()
+		d.showCursor()
+	}
+}
+
+func (d *Display) writeActiveBuf() {
+	if _, changed, err := d.ActiveBuf.diskChanged(d.ActiveBuf.disk); err == nil && changed {
+		d.askAboutDiskChange("File changed on disk since it was read. Write anyway?")
+		return
+	}
+	d.forceWriteActiveBuf()
+}
+
+func (d *Display) forceWriteActiveBuf() {
+	if err := d.writeBuffer(d.ActiveBuf); err != nil {
+		d.ShowError(err)
+	}
+}
+
+// writeBuffer saves buf and stores its undo history. The history is a
+// convenience, so failing to store it is reported without failing the save.
+func (d *Display) writeBuffer(buf *Buffer) error {
+	if err := buf.writeToFile(); err != nil {
+		return err
+	}
+	d.saveUndoFile(buf)
+	return nil
+}
+
+// saveUndoFile writes the undo history of buf once buf has been written, and
+// says that it was.
+func (d *Display) saveUndoFile(buf *Buffer) {
+	written := fmt.Sprintf("\"%s\" written, %d lines", buf.path, buf.length())
+	if err := buf.writeUndoFile(); err != nil {
+		d.ShowError(fmt.Errorf("%s, but the undo history was not saved: %w", written, err))
+		return
+	}
+	d.showMessage(written)
+}
+
 func (d *Display) runEventMode(ev tcell.Event) {
 	switch ev := ev.(type) {
 	case *tcell.EventKey:
@@ -156,6 +306,21 @@ func (d *Display) runEventMode(ev tcell.Event) {
 			d.undoLastEvent()
 		case ev.Rune() == 'r':
 			d.redoLastEvent()
+		case ev.Rune() == 'f':
+			d.ActiveBuf.toggleFileFormat()
+		case ev.Rune() == 'E':
+			d.ActiveBuf.cycleEncoding()
+		case ev.Rune() == 'C':
+			d.clearUndoHistory()
+		case ev.Rune() == '-':
+			d.Earlier("1")
+		case ev.Rune() == '+':
+			d.Later("1")
+		case ev.Rune() == 't':
+			d.showUndoTree()
+			return
+		case ev.Rune() == 'w':
+			d.toggleWrap()
 		}
 	}
 	d.Mode = Normal
@@ -163,65 +328,62 @@ func (d *Display) runEventMode(ev tcell.Event) {
 
 func (d *Display) undoLastEvent() {
 	d.clearBufWindow()
-	d.ActiveBuf.history.AddEvent(UNDO, nil, nil)
+	if pos, ok := d.ActiveBuf.undo(); ok {
+		d.moveToBufPos(pos)
+	}
+	d.ActiveBuf.updateModified()
 	d.SetBufWindow()
 }
 
 func (d *Display) redoLastEvent() {
 	d.clearBufWindow()
-	d.ActiveBuf.history.AddEvent(REDO, nil, nil)
+	if pos, ok := d.ActiveBuf.redo(); ok {
+		d.moveToBufPos(pos)
+	}
+	d.ActiveBuf.updateModified()
 	d.SetBufWindow()
 }
 
-func (d *Display) runDeleteMode(ev tcell.Event) {
-	switch ev := ev.(type) {
-	case *tcell.EventKey:
-		switch {
-		case ev.Key() == tcell.KeyCtrlN:
-			d.Mode = Normal
-		case ev.Rune() == 'l':
-			d.deleteLine()
-			d.Mode = Normal
-		}
-	}
+func (d *Display) beginEdit(first, last int) {
+	d.ActiveBuf.beginEdit(first, last, d.bufWindow.bufPos())
 }
 
-func (d *Display) currLine() *Line {
-	return d.ActiveBuf.currLine()
+func (d *Display) endEdit(action Action) {
+	d.ActiveBuf.endEdit(action, d.cursorPos())
 }
-func (d *Display) deleteLine() {
-	d.clearBufWindow()
-	line := d.ActiveBuf.currLine()
-	d.clearCurrLine()
-	line.runes = []rune{}
-	if Cur.Y == d.bufWindow.length()-1 {
-		d.deleteLastLine()
-		d.bufWindow.update(d.bufWindow.bufIdx)
-		d.SetBufWindow()
-		return
-	}
-	if d.bufWindow.bufIdx == d.ActiveBuf.length()-d.bufWindow.size {
-		d.SetBufWindow()
-		return
-	}
-	d.shiftLinesUp()
-	d.bufWindow.update(d.bufWindow.bufIdx)
-	d.SetBufWindow()
-	Cur.X = LeftMarginSize
+
+// cursorPos returns the buffer position under the screen cursor.
+func (d *Display) cursorPos() position {
+	y := min(d.bufWindow.cur.Y+d.bufWindow.bufIdx, d.ActiveBuf.length()-1)
+	x := d.ActiveBuf.getLine(y).indexAt(d.bufWindow.cur.X-LeftMarginSize, d.tabWidth())
+	return position{line: y, col: x}
 }
 
-func (d *Display) deleteLastLine() {
-	content := d.ActiveBuf.content
-	if Cur.Y == 0 {
-		return
+// moveToBufPos puts the cursor on pos, scrolling the window if pos is not
+// in view.
+func (d *Display) moveToBufPos(pos position) {
+	pos.line = min(pos.line, d.ActiveBuf.length()-1)
+	start := d.bufWindow.bufIdx
+	if pos.line < start || pos.line >= start+d.bufWindow.capacity {
+		start = max(pos.line-d.bufWindow.capacity/2, 0)
 	}
-	content.lines = content.lines[:len(content.lines)-1]
-	if len(content.lines) > d.bufWindow.size {
-		d.scrollUp()
+	d.bufWindow.update(start)
+	d.bufWindow.cur.Y = pos.line - d.bufWindow.bufIdx
+	d.bufWindow.pos.Y = pos.line
+	d.setCursorIndex(min(pos.col, d.currLine().length()))
+	d.setLineNumbers()
+}
+
+func (d *Display) clearUndoHistory() {
+	if err := d.ActiveBuf.ClearUndoHistory(); err != nil {
+		d.ShowError(err)
 		return
 	}
-	Cur.X = LeftMarginSize
-	Cur.Y--
+	d.showMessage("undo history cleared")
+}
+
+func (d *Display) currLine() *Line {
+	return d.ActiveBuf.getLine(d.bufWindow.pos.Y)
 }
 
 func (d *Display) runNewMode(ev tcell.Event) {
@@ -238,89 +400,124 @@ func (d *Display) runNewMode(ev tcell.Event) {
 }
 
 func (d *Display) insertBlankLine() {
+	d.beginEdit(d.bufWindow.pos.Y, d.bufWindow.pos.Y)
+	defer d.endEdit(INSERT_LINE)
 	line := newLine(d.Highlighter)
-	tabCount := d.ActiveBuf.currLine().tabCountForNewLine()
-	line.autoIndent(tabCount)
+	indent := d.currLine().indentForNewLine(d.ActiveBuf.settings)
+	line.autoIndent(indent, d.ActiveBuf.settings)
 	currContext := d.currLine().Context()
 	line.highlight(currContext)
 	d.clearLinesToEOW()
-	d.ActiveBuf.content.insertNewLine(line)
+	d.ActiveBuf.content.insertLine(d.bufWindow.pos.Y+1, line)
 	if d.cursor75PercentDown() {
 		d.scrollDown()
 		d.setLineNumbers()
-		Cur.X = LeftMarginSize + line.length()
+		d.bufWindow.cur.X = LeftMarginSize + line.displayWidth(d.tabWidth())
 		return
 	}
 	d.bufWindow.update(d.bufWindow.bufIdx)
 	d.reRenderLinesToEOF()
 	d.setLineNumbers()
-	Cur.X = LeftMarginSize + line.length()
-	Cur.Y++
-}
-
-func nextTabStopOffsetFromIndex(idx int) int {
-	return 8 - (idx % 8)
+	d.bufWindow.cur.X = LeftMarginSize + line.displayWidth(d.tabWidth())
+	d.bufWindow.cur.Y++
 }
 
 func (d *Display) runNormalMode(ev tcell.Event) {
 	switch ev := ev.(type) {
-	case *tcell.EventResize:
-		d.Screen.Sync()
 	case *tcell.EventKey:
+		confirmQuit := d.quitPending
+		d.quitPending = false
+		if ev.Key() != tcell.KeyRune {
+			d.cancelPending()
+		}
+		if ev.Key() == tcell.KeyCtrlQ {
+			d.Mode = Exit
+			return
+		}
+		if ev.Key() == tcell.KeyCtrlW {
+			d.Mode = Window
+			return
+		}
+		if ev.Key() == tcell.KeyCtrlV {
+			d.startVisual(visualBlock)
+			return
+		}
+		if ev.Key() != tcell.KeyRune || d.runPendingKey(ev.Rune()) {
+			return
+		}
+		count := d.pending.total()
+		d.clearPending()
 		switch ev.Rune() {
 		case 'Q':
-			d.Mode = Exit
+			d.quit(confirmQuit)
 		case 'W':
 			d.Mode = Write
-		case 'j':
-			d.moveCursorDown()
-		case 'J':
-			d.moveCursorHalfWindowDown()
-		case 'k':
-			d.moveCursorUp()
-		case 'K':
-			d.moveCursorHalfWindowUp()
-		case 'l':
-			d.moveCursorRight()
-		case 'h':
-			d.moveCursorLeft()
-		case 'w':
-			d.moveCursorToNextWord(false)
-		case 'b':
-			d.moveCursorToPrevWord()
 		case 'I':
 			d.Mode = Insert
 		case 'n':
 			d.Mode = New
-		case 'd':
-			d.Mode = Delete
 		case 'e':
 			d.Mode = Event
+		case ':':
+			d.startCommandLine("")
+		case 'o':
+			d.startCommandLine("edit ")
+		case 'v':
+			d.startVisual(visualChar)
+		case 'V':
+			d.startVisual(visualLine)
+		case '"':
+			d.startRegister()
+		case 'p':
+			d.pasteRegister(false, count)
+		case 'P':
+			d.pasteRegister(true, count)
+		case ']':
+			d.cycleBuffer(1)
+		case '[':
+			d.cycleBuffer(-1)
+		case 'B':
+			d.listBuffers()
+		case 'X':
+			d.closeBuffer(false)
 		}
 	}
 }
 
+func (d *Display) quit(confirmed bool) {
+	modified := d.modifiedBuffers()
+	if confirmed || len(modified) == 0 {
+		d.Mode = Exit
+		return
+	}
+	if !d.ActiveBuf.modified {
+		d.switchToBuffer(modified[0])
+	}
+	d.quitPending = true
+	d.ShowError(errors.New("No write since last change (press Q again to discard changes, Ctrl-Q to force quit)"))
+}
+
 func (d *Display) moveCursorHalfWindowDown() {
 	endBuf := d.ActiveBuf.length() - 1
-	if bufPos.Y >= endBuf-(d.bufWindow.size/2) {
-		for i := bufPos.Y; i <= endBuf; i++ {
+	if d.bufWindow.pos.Y >= endBuf-(d.bufWindow.capacity/2) {
+		for i := d.bufWindow.pos.Y; i <= endBuf; i++ {
 			d.moveCursorDown()
 		}
 		return
 	}
-	for i := 0; i < d.bufWindow.size/2; i++ {
+	for i := 0; i < d.bufWindow.capacity/2; i++ {
 		d.moveCursorDown()
 	}
 }
 
 func (d *Display) moveCursorHalfWindowUp() {
-	if bufPos.Y <= d.bufWindow.size/2 {
-		for i := bufPos.Y; i >= 0; i-- {
+	if d.bufWindow.pos.Y <= d.bufWindow.capacity/2 {
+		for i := d.bufWindow.pos.Y; i >= 0; i-- {
 			d.moveCursorUp()
 		}
 		return
 	}
-	for i := 0; i < d.bufWindow.size/2; i++ {
+	for i := 0; i < d.bufWindow.capacity/2; i++ {
 		d.moveCursorUp()
 	}
 }
@@ -341,62 +538,58 @@ var nonSpaceSeparators = map[rune]bool{
 }
 
 func (d *Display) moveCursorToPrevWord() {
-	line := d.ActiveBuf.currLine()
-	if bufPos.X == 0 && Cur.Y == 0 {
+	line := d.currLine()
+	if d.bufWindow.pos.X == 0 && d.bufWindow.cur.Y == 0 {
 		return
 	}
-	if bufPos.X > 0 {
-		if pos, ok := line.prevWordPos(); ok {
-			Cur.X = pos
+	if d.bufWindow.pos.X > 0 {
+		if idx, ok := line.prevWordPos(d.bufWindow.pos.X); ok {
+			d.setCursorIndex(idx)
 			return
 		}
 	}
 	if d.canScrollUp() {
 		d.scrollUp()
-		line = d.bufWindow.line(Cur.Y)
+		line = d.bufWindow.line(d.bufWindow.cur.Y)
 		if line.length() > 0 {
-			Cur.X = LeftMarginSize + line.length() - 1
+			d.bufWindow.cur.X = LeftMarginSize + line.colAt(line.prevCluster(line.length()), d.tabWidth())
 			return
 		}
-		Cur.X = LeftMarginSize
+		d.bufWindow.cur.X = LeftMarginSize
 		return
 	}
-	Cur.Y--
+	d.bufWindow.cur.Y--
 	d.setBufPos()
-	line = d.ActiveBuf.currLine()
+	line = d.currLine()
 	if line.length() > 0 {
-		Cur.X = LeftMarginSize + line.length() - 1
+		d.setCursorIndex(line.prevCluster(line.length()))
 		return
 	}
-	Cur.X = LeftMarginSize
+	d.bufWindow.cur.X = LeftMarginSize
 }
 
-func (d *Display) moveCursorToNextWord(sepFound bool) {
-	line := d.ActiveBuf.currLine()
-	if len(line.runes) == 0 {
-		Cur.Y++
-		d.setBufPos()
-		d.moveCursorToNextWord(true)
-		return
-	}
-	if pos, ok := line.nextWordPos(sepFound); ok {
-		Cur.X = pos
-		return
-	}
-	if d.ActiveBuf.length() == bufPos.Y {
-		return
+// moveCursorToNextWord moves to the start of the next word, looking on the
+// lines below when there is none after the cursor. An empty line counts as a
+// word, as in vim. With no word left the cursor goes to the end of the last
+// line.
+func (d *Display) moveCursorToNextWord() {
+	la := d.ActiveBuf.content
+	pos := d.bufWindow.bufPos()
+	if line := la.line(pos.line); line.length() > 0 {
+		if idx, ok := line.nextWordPos(pos.col); ok {
+			d.setCursorIndex(idx)
+			return
+		}
 	}
-	Cur.X = LeftMarginSize
-	d.setBufPos()
-	if d.canScrollDown() {
-		d.scrollDown()
-		d.moveCursorToNextWord(true)
-		return
+	for y := pos.line + 1; y < la.length(); y++ {
+		next := la.line(y)
+		if idx := next.firstWordIndex(); next.length() == 0 || idx < next.length() {
+			d.moveToBufPos(position{line: y, col: idx})
+			return
+		}
 	}
-	Cur.Y++
-	d.setBufPos()
-	sepFound = true
-	d.moveCursorToNextWord(sepFound)
+	last := la.length() - 1
+	d.moveToBufPos(position{line: last, col: la.line(last).length()})
 }
 
 func isNonSpaceSeparator(r rune) bool {
@@ -404,8 +597,10 @@ func isNonSpaceSeparator(r rune) bool {
 	return result
 }
 
+// isLetterOrNumber counts combining marks as letters so that a word written
+// with them is still one word.
 func isLetterOrNumber(r rune) bool {
-	return unicode.IsLetter(r) || unicode.IsNumber(r)
+	return unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.IsMark(r)
 }
 
 func isApostrophe(runes []rune, idx int) bool {
@@ -419,30 +614,29 @@ func isApostrophe(runes []rune, idx int) bool {
 	return false
 }
 
-func nextTabStopFromIndex(x int) int {
-	return x + 8 - (x % 8)
-}
-
 func (d *Display) moveCursorDown() {
-	if Cur.Y == d.ActiveBuf.length()-1 {
+	if d.bufWindow.cur.Y+d.bufWindow.bufIdx >= d.ActiveBuf.length()-1 {
 		return
 	}
 	if d.canScrollDown() {
 		d.scrollDown()
 		return
 	}
-	if Cur.Y == d.bufWindow.size-1 {
+	if d.bufWindow.cur.Y >= d.bufWindow.capacity-1 {
+		if d.bufWindow.lastLine() != d.ActiveBuf.lastLine() {
+			d.scrollDown()
+		}
 		return
 	}
-	nextLineLength := d.bufWindow.line(Cur.Y+1).length() + LeftMarginSize
-	if nextLineLength < Cur.X {
-		Cur.X = nextLineLength
+	nextLineLength := d.bufWindow.line(d.bufWindow.cur.Y+1).displayWidth(d.tabWidth()) + LeftMarginSize
+	if nextLineLength < d.bufWindow.cur.X {
+		d.bufWindow.cur.X = nextLineLength
 	}
-	Cur.Y++
+	d.bufWindow.cur.Y++
 }
 
 func (d *Display) cursor75PercentDown() bool {
-	return Cur.Y > (d.height-1)*3/4
+	return d.bufWindow.cur.Y > d.bufWindow.capacity*3/4
 }
 
 func (d *Display) scrollDown() {
@@ -452,7 +646,7 @@ func (d *Display) scrollDown() {
 }
 
 func (d *Display) canScrollDown() bool {
-	if d.ActiveBuf.length() < d.bufWindow.size {
+	if d.ActiveBuf.length() < d.bufWindow.capacity {
 		return false
 	}
 	return d.bufWindow.lastLine() != d.ActiveBuf.lastLine() && d.cursor75PercentDown()
@@ -465,26 +659,29 @@ func (d *Display) clearBufWindow() {
 }
 
 func (d *Display) moveCursorUp() {
-	if Cur.Y == 0 {
+	if d.bufWindow.cur.Y == 0 {
+		if d.bufWindow.bufIdx > 0 {
+			d.scrollUp()
+		}
 		return
 	}
 	if d.canScrollUp() {
 		d.scrollUp()
 		return
 	}
-	prevLineLength := d.bufWindow.line(Cur.Y-1).length() + LeftMarginSize
-	if prevLineLength < Cur.X {
-		Cur.X = prevLineLength
+	prevLineLength := d.bufWindow.line(d.bufWindow.cur.Y-1).displayWidth(d.tabWidth()) + LeftMarginSize
+	if prevLineLength < d.bufWindow.cur.X {
+		d.bufWindow.cur.X = prevLineLength
 	}
-	Cur.Y--
+	d.bufWindow.cur.Y--
 }
 
 func (d *Display) cursor25PercentUp() bool {
-	return Cur.Y < (d.height-1)/4
+	return d.bufWindow.cur.Y < d.bufWindow.capacity/4
 }
 
 func (d *Display) canScrollUp() bool {
-	return d.bufWindow.lines[0] != d.ActiveBuf.content.lines[0] && d.cursor25PercentUp()
+	return d.bufWindow.lines[0] != d.ActiveBuf.getLine(0) && d.cursor25PercentUp()
 }
 
 func (d *Display) scrollUp() {
@@ -494,17 +691,17 @@ func (d *Display) scrollUp() {
 }
 
 func (d *Display) moveCursorRight() {
-	if Cur.X == d.ActiveBuf.currLine().length()+LeftMarginSize {
+	if d.bufWindow.pos.X >= d.currLine().length() {
 		return
 	}
-	Cur.X++
+	d.setCursorIndex(d.currLine().nextCluster(d.bufWindow.pos.X))
 }
 
 func (d *Display) moveCursorLeft() {
-	if Cur.X == LeftMarginSize {
+	if d.bufWindow.pos.X == 0 {
 		return
 	}
-	Cur.X--
+	d.setCursorIndex(d.currLine().prevCluster(d.bufWindow.pos.X))
 }
 
 func (d *Display) runInsertMode(ev tcell.Event) {
@@ -513,6 +710,7 @@ func (d *Display) runInsertMode(ev tcell.Event) {
 		switch {
 		case ev.Key() == tcell.KeyCtrlN:
 			d.Mode = Normal
+			d.finishBlockInsert()
 		case ev.Key() == tcell.KeyEnter:
 			d.handleKeyEnter()
 		case ev.Key() == tcell.KeyBackspace2:
@@ -526,191 +724,173 @@ func (d *Display) runInsertMode(ev tcell.Event) {
 }
 
 func (d *Display) handleKeyEnter() {
+	d.beginEdit(d.bufWindow.pos.Y, d.bufWindow.pos.Y)
+	defer d.endEdit(SPLIT_LINE)
 	d.clearBufWindow()
 	buf := d.ActiveBuf
 	content := buf.content
-	if buf.currLine().length() > 0 && isClosingRune(buf.currLine().curRune()) {
-		buf.addClosingRuneLine()
+	if d.currLine().length() > 0 && isClosingRune(d.currRune()) {
+		buf.addClosingRuneLine(d.bufWindow.bufPos())
 		if d.cursor75PercentDown() {
 			d.scrollDown()
-			Cur.Y--
+			d.bufWindow.cur.Y--
 		}
 	}
-	newLine := content.newLineFromKeyEnter(d.Highlighter)
-	content.insertNewLine(newLine)
+	newLine := content.newLineFromKeyEnter(d.bufWindow.bufPos(), d.Highlighter, d.ActiveBuf.settings)
+	content.insertLine(d.bufWindow.pos.Y+1, newLine)
 	if d.cursor75PercentDown() {
 		d.scrollDown()
-		Cur.X = LeftMarginSize + newLine.firstWordIndex()
+		d.bufWindow.cur.X = LeftMarginSize + newLine.colAt(newLine.firstWordIndex(), d.tabWidth())
 		return
 	}
 	d.bufWindow.update(d.bufWindow.bufIdx)
 	d.SetBufWindow()
-	Cur.X = LeftMarginSize + newLine.firstWordIndex()
-	Cur.Y++
+	d.bufWindow.cur.X = LeftMarginSize + newLine.colAt(newLine.firstWordIndex(), d.tabWidth())
+	d.bufWindow.cur.Y++
 }
 
 func (d *Display) shiftLinesDown() {
 	content := d.ActiveBuf.content
 	d.clearLinesToEOW()
-	newLine := content.newLineFromKeyEnter(d.Highlighter)
-	content.insertNewLine(newLine)
+	newLine := content.newLineFromKeyEnter(d.bufWindow.bufPos(), d.Highlighter, d.ActiveBuf.settings)
+	content.insertLine(d.bufWindow.pos.Y+1, newLine)
 	d.reRenderLinesToEOF()
 	d.setLineNumbers()
 	d.bufWindow.resetLines()
 }
 
 func (d *Display) clearLinesToEOW() {
-	for i := Cur.Y; i < len(d.bufWindow.lines); i++ {
+	for i := d.bufWindow.cur.Y; i < len(d.bufWindow.lines); i++ {
 		d.clearLineByIndex(i)
 	}
 }
 
 func (d *Display) clearLineByIndex(idx int) {
-	line := d.bufWindow.lines[idx]
-	displayLineLength := line.length() + LeftMarginSize
-	for i := LeftMarginSize; i <= displayLineLength; i++ {
-		d.Screen.SetContent(i, idx, ' ', nil, d.BufStyle)
+	bw := d.bufWindow
+	line := bw.lines[idx]
+	displayLineLength := line.displayWidth(d.tabWidth()) - bw.leftCol + bw.gutter
+	for i := bw.gutter; i <= displayLineLength; i++ {
+		d.setWindowContent(bw, i, idx, ' ', d.BufStyle)
 	}
 }
 
 func (d *Display) reRenderLinesToEOF() {
-	for i := Cur.Y; i < d.bufWindow.length(); i++ {
+	for i := d.bufWindow.cur.Y; i < d.bufWindow.length(); i++ {
 		d.reRenderLine(i)
 	}
 }
 
 func (d *Display) reRenderLine(y int) {
-	line := d.bufWindow.line(y)
-	for i, r := range line.runes {
-		x := i + LeftMarginSize
-		d.Screen.SetContent(x, y, r, nil, line.getRuneStyle(i))
-	}
+	d.drawLine(y, d.bufWindow.line(y))
 }
 func (d *Display) handleKeyBackspace() {
 	switch {
-	case bufPos.X == 0 && bufPos.Y == 0:
+	case d.bufWindow.pos.X == 0 && d.bufWindow.pos.Y == 0:
 		return
-	case bufPos.X == 0:
+	case d.bufWindow.pos.X == 0:
 		d.backspaceToPrevLine()
 	default:
-		Cur.X--
-		d.setBufPos()
+		d.bufWindow.pos.X = d.currLine().prevCluster(d.bufWindow.pos.X)
 		d.backspaceChar()
 	}
 }
 
 func (d *Display) backspaceToPrevLine() {
+	d.beginEdit(d.bufWindow.pos.Y-1, d.bufWindow.pos.Y)
+	defer d.endEdit(JOIN_LINES)
 	d.clearBufWindow()
-	prevLineLength := d.shiftLinesUp()
+	prevLineWidth := d.shiftLinesUp()
 	d.bufWindow.update(d.bufWindow.bufIdx)
 	d.SetBufWindow()
 	d.setLineNumbers()
-	Cur.X = prevLineLength + LeftMarginSize
+	d.bufWindow.cur.X = prevLineWidth + LeftMarginSize
 	if d.windowAtBottom() {
-		Cur.Y--
+		d.bufWindow.cur.Y--
 		return
 	}
 	if d.canScrollUp() {
 		d.scrollUp()
 		return
 	}
-	Cur.Y--
+	d.bufWindow.cur.Y--
 }
 
 func (d *Display) shiftLinesUp() int {
-	if Cur.Y == 0 {
-		d.ActiveBuf.content.lines = d.ActiveBuf.content.lines[1:]
+	buf := d.ActiveBuf
+	idx := d.bufWindow.pos.Y
+	if idx == 0 {
+		buf.content.removeLine(0)
 		return 0
 	}
-	Cur.Y--
-	d.setBufPos()
-	buf := d.ActiveBuf
-	lines := buf.content.lines
-	line := d.ActiveBuf.currLine()
-	idx := bufPos.Y
-	ogLineLength := line.length()
-	line.runes = append(line.runes, lines[idx+1].runes...)
-	buf.content.lines = append(lines[:idx+1], lines[idx+2:]...)
-	Cur.Y++
-	return ogLineLength
+	line := buf.getLine(idx - 1)
+	ogLineWidth := line.displayWidth(d.tabWidth())
+	line.runes = append(line.runes, buf.getLine(idx).runes...)
+	buf.content.removeLine(idx)
+	return ogLineWidth
 }
 
 func (d *Display) backspaceChar() {
+	d.beginEdit(d.bufWindow.pos.Y, d.bufWindow.pos.Y)
 	d.clearCurrLine()
-	d.ActiveBuf.removeRune()
-	d.reRenderLine(Cur.Y)
+	idx := d.ActiveBuf.removeRune(d.bufWindow.bufPos())
+	d.reRenderLine(d.bufWindow.cur.Y)
+	d.setCursorIndex(idx)
+	d.endEdit(REMOVE)
 }
 
 func (d *Display) clearCurrLine() {
-	d.clearLineByIndex(Cur.Y)
+	d.clearLineByIndex(d.bufWindow.cur.Y)
 }
 
 func (d *Display) handleKeyTab() {
-	d.ActiveBuf.currLine().addKeyTab()
+	d.beginEdit(d.bufWindow.pos.Y, d.bufWindow.pos.Y)
 	d.clearCurrLine()
-	d.reRenderLine(Cur.Y)
-	Cur.X += nextTabStopOffset()
-}
-
-func createTabRunes() []rune {
-	tab := []rune{}
-	tab = append(tab, '\t')
-	offset := nextTabStopOffset()
-	if offset == 1 {
-		return tab
-	}
-
-	for i := 1; i < offset-1; i++ {
-		tab = append(tab, ' ')
-	}
-	tab = append(tab, '\t')
-	return tab
-}
-
-func nextTabStopOffset() int {
-	return 8 - (bufPos.X % 8)
+	line := d.currLine()
+	added := line.addKeyTab(d.bufWindow.pos.X, d.ActiveBuf.settings)
+	d.reRenderLine(d.bufWindow.cur.Y)
+	d.setCursorIndex(d.bufWindow.pos.X + added)
+	d.endEdit(ADD)
 }
 
 func (d *Display) setRune(r rune) {
 	if isClosingRune(r) && r == d.currRune() {
-		Cur.X++
+		d.setCursorIndex(d.bufWindow.pos.X + 1)
 		return
 	}
 
+	d.beginEdit(d.bufWindow.pos.Y, d.bufWindow.pos.Y)
 	d.clearCurrLine()
-	ogRunes := d.currLine().Runes()
-	d.currLine().addRune(r)
+	d.currLine().addRune(d.bufWindow.pos.X, r)
 	prevLine, ok := d.prevLine()
 	if !ok {
 		d.currLine().highlight([]token.TokenType{token.TYPE_NONE})
 	} else {
 		d.currLine().highlight(prevLine.Context())
 	}
-	d.reRenderLine(Cur.Y)
-	Cur.X++
+	d.reRenderLine(d.bufWindow.cur.Y)
+	d.setCursorIndex(d.bufWindow.pos.X + 1)
 	if isAutoClosable(r) {
-		d.setBufPos()
 		d.clearCurrLine()
-		d.currLine().autoClose(r)
+		d.currLine().autoClose(d.bufWindow.pos.X, r)
 		if prevLine == nil {
 			d.currLine().highlight(d.currLine().Context())
 		} else {
 			d.currLine().highlight(prevLine.Context())
 		}
-		d.reRenderLine(Cur.Y)
+		d.reRenderLine(d.bufWindow.cur.Y)
 	}
-	d.ActiveBuf.history.AddEvent(ADD, ogRunes, d.currLine())
+	d.endEdit(ADD)
 }
 
 func (d *Display) prevLine() (*Line, bool) {
-	if Cur.Y == 0 {
+	if d.bufWindow.cur.Y == 0 {
 		return nil, false
 	}
-	return d.ActiveBuf.getLine(Cur.Y - 1), true
+	return d.ActiveBuf.getLine(d.bufWindow.cur.Y - 1), true
 }
 
 func (d *Display) currRune() rune {
-	return d.ActiveBuf.currLine().curRune()
+	return d.currLine().curRune(d.bufWindow.pos.X)
 }
 
 func isClosingRune(r rune) bool {
@@ -722,77 +902,162 @@ func isAutoClosable(r rune) bool {
 }
 
 func (d *Display) setLineNumbers() {
-	d.clearLineNumbers()
-	start := d.bufWindow.bufIdx
-	for i := 0; i < d.height-1; i++ {
-		lineNum := i + start + 1
-		digits := splitDigits(lineNum)
-	inner:
-		for j, digit := range digits {
-			switch {
-			case lineNum < 10 && j < 4:
-				continue inner
-			case lineNum < 100 && j < 3:
-				continue inner
-			case lineNum < 1000 && j < 2:
-				continue inner
-			case lineNum < 10000 && j < 1:
-				continue inner
-			}
-			d.Screen.SetContent(j, i, 48+digit, nil, d.LineNoStyle)
+	d.drawLineNumbers(d.bufWindow)
+}
+
+// drawLineNumbers numbers the first row of each line and marks the rows a
+// wrapped line continues onto.
+func (d *Display) drawLineNumbers(bw *BufWindow) {
+	d.clearLineNumbers(bw)
+	start := bw.bufIdx
+	row := 0
+	for i := 0; row < bw.size; i++ {
+		d.drawLineNumber(bw, row, i+start+1)
+		rows := 1
+		if i < len(bw.lines) {
+			rows = bw.lineRows(bw.lines[i])
 		}
+		for j := 1; j < rows; j++ {
+			d.setWindowContent(bw, 4, row+j, wrapMarker, d.LineNoStyle)
+		}
+		row += rows
 	}
 }
 
-func (d *Display) clearLineNumbers() {
-	for i := range d.height - 2 {
-		for j := range LeftMarginSize {
-			d.Screen.SetContent(j, i, ' ', nil, d.LineNoStyle)
+func (d *Display) drawLineNumber(bw *BufWindow, y, lineNum int) {
+	digits := splitDigits(lineNum)
+	for j, digit := range digits {
+		switch {
+		case lineNum < 10 && j < 4:
+			continue
+		case lineNum < 100 && j < 3:
+			continue
+		case lineNum < 1000 && j < 2:
+			continue
+		case lineNum < 10000 && j < 1:
+			continue
+		}
+		d.setWindowContent(bw, j, y, 48+digit, d.LineNoStyle)
+	}
+}
+
+func (d *Display) clearLineNumbers(bw *BufWindow) {
+	for i := range bw.size {
+		for j := range bw.gutter {
+			d.setWindowContent(bw, j, i, ' ', d.LineNoStyle)
 		}
 	}
 }
 
 func (d *Display) setStatusBar() {
 	d.clearStatusBar()
-	line := d.bufWindow.line(Cur.Y)
-	currLineNo := bufPos.Y + 1
-	lineCount := d.ActiveBuf.length()
-	char := ""
-	if bufPos.X < len(line.runes) {
-		char = string(line.runes[bufPos.X])
+	if d.Mode == Prompt && d.prompt != nil {
+		d.drawStatusBar([]rune(d.prompt.text()), d.ErrorStyle)
+		return
+	}
+	if d.Mode == Command {
+		d.drawCommandLine()
+		return
+	}
+	if d.message != "" {
+		d.drawStatusBar([]rune(d.message), d.messageStyle())
+		return
 	}
-	status := []rune(fmt.Sprintf("%s Mode\t\t\tLine: %d\t\tCol: %d\t\tLineCount: %d\t\tChar: %s",
-		modes[d.Mode],
+	line := d.bufWindow.line(d.bufWindow.cur.Y)
+	currLineNo := d.bufWindow.pos.Y + 1
+	lineCount := d.ActiveBuf.length()
+	char := line.clusterText(d.bufWindow.pos.X)
+	modified := ""
+	if d.ActiveBuf.modified {
+		modified = " [+]"
+	}
+	status := []rune(fmt.Sprintf("%s Mode%s\t\t\tLine: %d\t\tCol: %s\t\tLineCount: %d\t\tChar: %s\t\t%s",
+		d.modeName(),
+		modified,
 		currLineNo,
-		bufPos.X+1,
+		d.statusColumn(line),
 		lineCount,
 		char,
+		d.ActiveBuf.format,
 	))
-	for i, r := range status {
-		d.Screen.SetContent(i, d.height-1, r, nil, d.StatusBarStyle)
+	if keys := d.pendingKeys(); keys != "" {
+		status = append(status, []rune("\t\t"+keys)...)
 	}
-	for i := len(status); i < d.width; i++ {
-		d.Screen.SetContent(i, d.height-1, ' ', nil, d.StatusBarStyle)
+	d.drawStatusBar(status, d.StatusBarStyle)
+}
+
+func (d *Display) modeName() string {
+	if d.Mode == Visual {
+		return visualNames[d.visual]
 	}
-	d.StatusBar = status
+	return modes[d.Mode]
 }
 
-func (d *Display) clearStatusBar() {
-	for i := range d.StatusBar {
-		d.Screen.SetContent(i, d.height-1, ' ', nil, d.LineNoStyle)
+func (d *Display) showCursor() {
+	if d.Mode == Command {
+		d.Screen.ShowCursor(d.commandLineCursor(), d.height-1)
+		return
 	}
+	x, y := d.bufWindow.screenCursor()
+	d.Screen.ShowCursor(d.bufWindow.left+x, d.bufWindow.top+y)
 }
 
-func convertRunesToText(runes []rune) string {
-	str := ""
-	for _, r := range runes {
-		if r == '\t' {
-			str += "/t"
-			continue
+// statusColumn numbers the cursor column by grapheme cluster, followed by the
+// screen column when the two differ, as in "3-5".
+func (d *Display) statusColumn(line *Line) string {
+	idx := d.bufWindow.pos.X
+	n := 1
+	for _, c := range line.clusters(d.tabWidth()) {
+		if c.start < idx {
+			n++
 		}
-		str += string(r)
 	}
-	return str
+	col := line.colAt(idx, d.tabWidth()) + 1
+	if col == n {
+		return fmt.Sprint(n)
+	}
+	return fmt.Sprintf("%d-%d", n, col)
+}
+
+func (d *Display) drawStatusBar(status []rune, style tcell.Style) {
+	end := 0
+	for _, c := range (&Line{runes: status}).clusters(1) {
+		runes := status[c.start:c.end]
+		d.Screen.SetContent(c.col, d.height-1, runes[0], runes[1:], style)
+		end = c.col + c.width
+	}
+	for i := end; i < d.width; i++ {
+		d.Screen.SetContent(i, d.height-1, ' ', nil, style)
+	}
+	d.StatusBar = status
+}
+
+func (d *Display) showMessage(msg string) {
+	d.message = msg
+	d.messageIsError = false
+}
+
+func (d *Display) ShowError(err error) {
+	d.message = err.Error()
+	d.messageIsError = true
+}
+
+func (d *Display) clearMessage() {
+	d.message = ""
+	d.messageIsError = false
+}
+
+func (d *Display) messageStyle() tcell.Style {
+	if d.messageIsError {
+		return d.ErrorStyle
+	}
+	return d.StatusBarStyle
+}
+
+func (d *Display) clearStatusBar() {
+	for i := range d.StatusBar {
+		d.Screen.SetContent(i, d.height-1, ' ', nil, d.LineNoStyle)
+	}
 }
 
 func splitDigits(count int) []rune {
@@ -807,6 +1072,12 @@ func splitDigits(count int) []rune {
 }
 
 func (d *Display) setBufPos() {
-	bufPos.X = Cur.X - LeftMarginSize
-	bufPos.Y = Cur.Y + d.bufWindow.bufIdx
+	d.bufWindow.pos.Y = d.bufWindow.cur.Y + d.bufWindow.bufIdx
+	if d.bufWindow.pos.Y >= d.ActiveBuf.length() {
+		d.bufWindow.pos.X = d.bufWindow.cur.X - LeftMarginSize
+		return
+	}
+	line := d.currLine()
+	d.bufWindow.pos.X = line.indexAt(d.bufWindow.cur.X-LeftMarginSize, d.tabWidth())
+	d.bufWindow.cur.X = LeftMarginSize + line.colAt(d.bufWindow.pos.X, d.tabWidth())
 }
@@ -1,9 +1,19 @@
 package display
 
 import (
+	"bytes"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/cyamas/rizz/internal/highlighter"
 	"github.com/cyamas/rizz/internal/highlighter/lexer"
@@ -20,12 +30,12 @@ func TestAutoIndentFromAutoClose(t *testing.T) {
 	initTestDisplay(d1)
 	line1 := "{}"
 	d1Content := d1.ActiveBuf.content
-	d1Content.lines[0].runes = []rune(line1)
-	d1Content.lines[0].highlight([]token.TokenType{token.TYPE_NONE})
+	d1Content.line(0).runes = []rune(line1)
+	d1Content.line(0).highlight([]token.TokenType{token.TYPE_NONE})
 
 	expBuf1 := []string{
 		"{",
-		"/t      /t",
+		"\t",
 		"}",
 	}
 
@@ -42,8 +52,8 @@ func TestAutoIndentFromAutoClose(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		Cur.X = tt.x
-		Cur.Y = tt.y
+		tt.display.bufWindow.cur.X = tt.x
+		tt.display.bufWindow.cur.Y = tt.y
 		tt.display.setBufPos()
 		tt.display.handleKeyEnter()
 
@@ -58,20 +68,20 @@ func TestAutoIndent(t *testing.T) {
 	d1 := NewDisplay()
 	initTestDisplay(d1)
 	d1.ActiveBuf.addTestLines(createTestLines(1), d1.Highlighter)
-	d1.ActiveBuf.currLine().addKeyTab()
-	x1 := LeftMarginSize + d1.ActiveBuf.currLine().length()
+	d1.ActiveBuf.getLine(0).addKeyTab(0, d1.ActiveBuf.settings)
+	x1 := LeftMarginSize + d1.ActiveBuf.getLine(0).displayWidth(8)
 	exp1 := createTestLines(1)
-	exp1[0] = "/t      /t" + exp1[0]
-	exp1 = append(exp1, "/t      /t")
+	exp1[0] = "\t" + exp1[0]
+	exp1 = append(exp1, "\t")
 
 	d2 := NewDisplay()
 	initTestDisplay(d2)
 	d2.ActiveBuf.addTestLines(createTestLines(1), d2.Highlighter)
-	d2.ActiveBuf.content.lines[0].runes = append(d2.ActiveBuf.content.lines[0].runes, '{')
-	x2 := LeftMarginSize + d2.ActiveBuf.content.lines[0].length()
+	d2.ActiveBuf.getLine(0).runes = append(d2.ActiveBuf.getLine(0).runes, '{')
+	x2 := LeftMarginSize + d2.ActiveBuf.getLine(0).length()
 	exp2 := createTestLines(1)
 	exp2[0] += "{"
-	exp2 = append(exp2, "/t      /t")
+	exp2 = append(exp2, "\t")
 
 	tests := []struct {
 		display   *Display
@@ -98,8 +108,8 @@ func TestAutoIndent(t *testing.T) {
 	count := 0
 	for _, tt := range tests {
 		count++
-		Cur.X = tt.x
-		Cur.Y = tt.y
+		tt.display.bufWindow.cur.X = tt.x
+		tt.display.bufWindow.cur.Y = tt.y
 		tt.display.setBufPos()
 		tt.display.handleKeyEnter()
 
@@ -108,14 +118,14 @@ func TestAutoIndent(t *testing.T) {
 		}
 
 		for i := range tt.expBuf {
-			res := convertRunesToText(tt.display.ActiveBuf.getLine(i).runes)
+			res := string(tt.display.ActiveBuf.getLine(i).runes)
 			if res != tt.expBuf[i] {
-				t.Fatalf("Line should be %s. Got %s", tt.expBuf[i], res)
+				t.Fatalf("Line should be %q. Got %q", tt.expBuf[i], res)
 			}
 		}
 
-		if Cur.X != tt.expCurX {
-			t.Fatalf("Cur.X should be %d. Got %d", tt.expCurX, Cur.X)
+		if tt.display.bufWindow.cur.X != tt.expCurX {
+			t.Fatalf("cursor X should be %d. Got %d", tt.expCurX, tt.display.bufWindow.cur.X)
 		}
 
 	}
@@ -222,8 +232,8 @@ func TestHandleKeyEnter(t *testing.T) {
 	for _, tt := range tests {
 		count++
 		tt.display.bufWindow.update(tt.y)
-		Cur.Y = tt.y - tt.display.bufWindow.bufIdx
-		Cur.X = tt.x
+		tt.display.bufWindow.cur.Y = tt.y - tt.display.bufWindow.bufIdx
+		tt.display.bufWindow.cur.X = tt.x
 		tt.display.setBufPos()
 
 		tt.display.handleKeyEnter()
@@ -233,7 +243,7 @@ func TestHandleKeyEnter(t *testing.T) {
 
 		for i := range tt.expBuf {
 			exp := tt.expBuf[i]
-			res := string(tt.display.ActiveBuf.content.lines[i].runes)
+			res := string(tt.display.ActiveBuf.getLine(i).runes)
 			if exp != res {
 				t.Fatalf("FAIL expBuf: line should be: '%s'. Got'%s'", exp, res)
 			}
@@ -322,15 +332,15 @@ func TestInsertBlankLine(t *testing.T) {
 	for _, tt := range tests {
 		count++
 		//fmt.Println("TEST ", count)
-		Cur.X = LeftMarginSize
+		tt.display.bufWindow.cur.X = LeftMarginSize
 		tt.display.bufWindow.update(tt.idx)
-		Cur.Y = tt.idx - tt.display.bufWindow.bufIdx
+		tt.display.bufWindow.cur.Y = tt.idx - tt.display.bufWindow.bufIdx
 		tt.display.setBufPos()
 
 		tt.display.insertBlankLine()
 
 		bufRes := []string{}
-		for _, line := range tt.display.ActiveBuf.content.lines {
+		for _, line := range tt.display.ActiveBuf.content.allLines() {
 			bufRes = append(bufRes, string(line.runes))
 		}
 		if len(bufRes) != len(tt.expBufLines) {
@@ -383,8 +393,8 @@ func TestDeleteLine(t *testing.T) {
 	// tests deletion of line where the bufWindow cannot be scrolled down anymore
 	d3 := NewDisplay()
 	initTestDisplay(d3)
-	d3Expected := createTestLines(100)
-	d3Expected[82] = ""
+	d3Lines := createTestLines(100)
+	d3Expected := append(d3Lines[:82], d3Lines[83:]...)
 	d3.ActiveBuf.addTestLines(createTestLines(100), d3.Highlighter)
 	d3.bufWindow.update(0)
 
@@ -416,18 +426,20 @@ func TestDeleteLine(t *testing.T) {
 			d3,
 			82,
 			d3Expected,
-			d3Expected[51:],
+			d3Expected[50:],
 		},
 	}
 	for i, tt := range tests {
-		Cur.X = LeftMarginSize
+		tt.display.bufWindow.cur.X = LeftMarginSize
 		tt.display.bufWindow.update(tt.idx)
-		Cur.Y = tt.idx - tt.display.bufWindow.bufIdx
+		tt.display.bufWindow.cur.Y = tt.idx - tt.display.bufWindow.bufIdx
 		tt.display.setBufPos()
-		tt.display.deleteLine()
+		for _, r := range "dd" {
+			tt.display.runNormalMode(tcell.NewEventKey(tcell.KeyRune, r, tcell.ModNone))
+		}
 
 		bufRes := []string{}
-		for _, line := range tt.display.ActiveBuf.content.lines {
+		for _, line := range tt.display.ActiveBuf.content.allLines() {
 			bufRes = append(bufRes, string(line.runes))
 		}
 		if len(bufRes) != len(tt.expBufLines) {
@@ -484,9 +496,9 @@ func (b *Buffer) addTestLines(lines []string, h *highlighter.Highlighter) {
 	for _, l := range lines {
 		line := newLine(h)
 		line.runes = []rune(l)
-		if b.length() == 1 && b.content.lines[0].length() == 0 {
+		if b.length() == 1 && b.getLine(0).length() == 0 {
 			line.highlight([]token.TokenType{token.TYPE_NONE})
-			b.content.lines[0] = line
+			b.content.setLine(0, line)
 			prevLine = line
 			continue
 		}
@@ -526,8 +538,6 @@ func TestSplitDigits(t *testing.T) {
 }
 
 func initTestDisplay(d *Display) {
-	Cur.X = 0
-	Cur.Y = 0
 	screen, err := tcell.NewScreen()
 	if err != nil {
 		log.Fatalf("%v", err)
@@ -548,52 +558,2793 @@ func initTestDisplay(d *Display) {
 func TestAddKeyTab(t *testing.T) {
 	d := NewDisplay()
 	initTestDisplay(d)
-	Cur.X = LeftMarginSize
-	Cur.Y = 0
+	d.bufWindow.cur.X = LeftMarginSize
+	d.bufWindow.cur.Y = 0
 	d.setBufPos()
 	buf := d.ActiveBuf
 	line := buf.getLine(0)
 	line.runes = []rune("hello")
-	line.addKeyTab()
-	if len(buf.content.lines[0].runes) != 13 {
-		t.Fatalf("Length should  be %d. Got %d", 13, len(buf.content.lines[0].runes))
+	line.addKeyTab(0, buf.settings)
+	expected := "\thello"
+	if string(buf.getLine(0).runes) != expected {
+		t.Fatalf("line should be %q. Got %q", expected, string(buf.getLine(0).runes))
+	}
+}
+
+func TestTabColumns(t *testing.T) {
+	h := highlighter.New(lexer.New())
+	tests := []struct {
+		text     string
+		idx      int
+		expCol   int
+		expWidth int
+	}{
+		{"\thello", 1, 8, 13},
+		{"ab\tc", 2, 2, 9},
+		{"ab\tc", 3, 8, 9},
+		{"\t\tx", 2, 16, 17},
+		{"1234567\tx", 8, 8, 9},
+		{"12345678\tx", 9, 16, 17},
+	}
+
+	for _, tt := range tests {
+		line := testLine(tt.text, h)
+		if col := line.colAt(tt.idx, 8); col != tt.expCol {
+			t.Fatalf("%q: col of index %d should be %d. Got %d", tt.text, tt.idx, tt.expCol, col)
+		}
+		if idx := line.indexAt(tt.expCol, 8); idx != tt.idx {
+			t.Fatalf("%q: index at col %d should be %d. Got %d", tt.text, tt.expCol, tt.idx, idx)
+		}
+		if width := line.displayWidth(8); width != tt.expWidth {
+			t.Fatalf("%q: width should be %d. Got %d", tt.text, tt.expWidth, width)
+		}
+	}
+
+	line := testLine("ab\tc", h)
+	for col := 2; col < 8; col++ {
+		if idx := line.indexAt(col, 8); idx != 2 {
+			t.Fatalf("col %d inside tab should map to index 2. Got %d", col, idx)
+		}
+	}
+}
+
+func TestTabRoundTrip(t *testing.T) {
+	d := NewDisplay()
+	initTestDisplay(d)
+	content := lineArrayFromStrings([]string{"\tif x {", "\t\treturn"}, d.Highlighter)
+	d.ActiveBuf.content = content
+	expected := []string{"\tif x {", "\t\treturn"}
+	for i, exp := range expected {
+		res := content.line(i).convertRunesForWrite()
+		if res != exp {
+			t.Fatalf("line %d should be %q. Got %q", i, exp, res)
+		}
+	}
+
+	d.bufWindow.cur.X = LeftMarginSize
+	d.bufWindow.cur.Y = 1
+	d.setBufPos()
+	d.moveCursorRight()
+	if d.bufWindow.pos.X != 1 || d.bufWindow.cur.X != LeftMarginSize+8 {
+		t.Fatalf("cursor should be at index 1, col %d. Got index %d, col %d", LeftMarginSize+8, d.bufWindow.pos.X, d.bufWindow.cur.X)
+	}
+	d.moveCursorRight()
+	if d.bufWindow.pos.X != 2 || d.bufWindow.cur.X != LeftMarginSize+16 {
+		t.Fatalf("cursor should be at index 2, col %d. Got index %d, col %d", LeftMarginSize+16, d.bufWindow.pos.X, d.bufWindow.cur.X)
+	}
+}
+
+func TestExpandTab(t *testing.T) {
+	d := NewDisplay()
+	initTestDisplay(d)
+	buf := d.ActiveBuf
+	buf.settings = Settings{TabWidth: 4, ShiftWidth: 4, ExpandTab: true}
+	buf.getLine(0).runes = []rune("if x:")
+	d.bufWindow.cur.X = LeftMarginSize + 5
+	d.bufWindow.cur.Y = 0
+	d.setBufPos()
+
+	d.handleKeyEnter()
+	d.setBufPos()
+	if res := string(buf.getLine(1).runes); res != "    " {
+		t.Fatalf("new line should be indented by 4 spaces. Got %q", res)
+	}
+	d.handleKeyTab()
+	d.setBufPos()
+	if res := string(buf.getLine(1).runes); res != "        " {
+		t.Fatalf("tab should insert 4 spaces. Got %q", res)
+	}
+	if d.bufWindow.cur.X != LeftMarginSize+8 {
+		t.Fatalf("cursor X should be %d. Got %d", LeftMarginSize+8, d.bufWindow.cur.X)
+	}
+	d.handleKeyBackspace()
+	d.setBufPos()
+	if res := string(buf.getLine(1).runes); res != "    " {
+		t.Fatalf("backspace should remove a shiftwidth of spaces. Got %q", res)
+	}
+	if d.bufWindow.cur.X != LeftMarginSize+4 {
+		t.Fatalf("cursor X should be %d. Got %d", LeftMarginSize+4, d.bufWindow.cur.X)
 	}
-	expected := []rune{'\t', ' ', ' ', ' ', ' ', ' ', ' ', '\t', 'h', 'e', 'l', 'l', 'o'}
-	for i := range buf.content.lines[0].runes {
-		if buf.content.lines[0].runes[i] != expected[i] {
-			t.Fatalf("rune should be %s. Got %s", string(expected[i]), string(buf.content.lines[0].runes[i]))
+}
+
+func TestIndentRunes(t *testing.T) {
+	tests := []struct {
+		settings Settings
+		col      int
+		expected string
+	}{
+		{Settings{TabWidth: 8, ShiftWidth: 8}, 16, "\t\t"},
+		{Settings{TabWidth: 8, ShiftWidth: 4}, 12, "\t    "},
+		{Settings{TabWidth: 2, ShiftWidth: 2, ExpandTab: true}, 4, "    "},
+	}
+	for _, tt := range tests {
+		if res := string(tt.settings.indentRunes(tt.col)); res != tt.expected {
+			t.Fatalf("indent for col %d should be %q. Got %q", tt.col, tt.expected, res)
 		}
 	}
+
+	b := NewBuffer(highlighter.New(lexer.New()))
+	if err := b.SetOption("sw", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetOption("et", ""); err != nil {
+		t.Fatal(err)
+	}
+	if b.settings.ShiftWidth != 2 || !b.settings.ExpandTab {
+		t.Fatalf("settings not applied: %+v", b.settings)
+	}
+	if err := b.SetOption("tabwidth", "0"); err == nil {
+		t.Fatal("tabwidth 0 should be rejected")
+	}
 }
 
-func TestCreateTabRunes(t *testing.T) {
-	Cur.X = 0
-	Cur.Y = 0
-	test1 := createTabRunes()
-	test2 := createTabRunes()
-	test2 = append(test2, createTabRunes()...)
+func TestFileFormatRoundTrip(t *testing.T) {
 	tests := []struct {
-		result   []rune
-		expected []rune
+		name      string
+		data      string
+		expLines  []string
+		expFormat string
 	}{
-		{
-			test1,
-			[]rune{'\t', ' ', ' ', ' ', ' ', ' ', ' ', '\t'},
-		},
-		{
-			test2,
-			[]rune{'\t', ' ', ' ', ' ', ' ', ' ', ' ', '\t', '\t', ' ', ' ', ' ', ' ', ' ', ' ', '\t'},
-		},
+		{"lf", "a\nb\n", []string{"a", "b"}, "utf-8 unix"},
+		{"noeol", "a\nb", []string{"a", "b"}, "utf-8 unix [noeol]"},
+		{"crlf", "a\r\nb\r\n", []string{"a", "b"}, "utf-8 dos"},
+		{"crlf noeol", "a\r\n\r\nb", []string{"a", "", "b"}, "utf-8 dos [noeol]"},
+		{"mixed", "a\r\nb\n", []string{"a\r", "b"}, "utf-8 unix"},
+		{"bom", "\xEF\xBB\xBFa\n", []string{"a"}, "utf-8 unix [bom]"},
+		{"empty", "", []string{""}, "utf-8 unix"},
+		{"blank line", "\n", []string{""}, "utf-8 unix"},
+		{"crlf blank line", "\r\n", []string{""}, "utf-8 dos"},
+		{"leading blank lines", "\n\nfoo\n", []string{"", "", "foo"}, "utf-8 unix"},
+		{"crlf leading blank lines", "\r\n\r\nx\r\n", []string{"", "", "x"}, "utf-8 dos"},
+		{"only blank lines", "\n\n", []string{"", ""}, "utf-8 unix"},
 	}
 
-	for _, tt := range tests {
-		if len(tt.result) != len(tt.expected) {
-			t.Fatalf("len should be %d. Got %d", len(tt.expected), len(tt.result))
+	dir := t.TempDir()
+	for i, tt := range tests {
+		path := fmt.Sprintf("%s/file%d.txt", dir, i)
+		if err := os.WriteFile(path, []byte(tt.data), 0644); err != nil {
+			t.Fatal(err)
 		}
-		for i := range tt.expected {
-			if tt.result[i] != tt.expected[i] {
-				t.Fatalf("expected %v\n Got %v", tt.expected, tt.result)
+		b := NewBuffer(highlighter.New(lexer.New()))
+		if err := b.ReadFile(path); err != nil {
+			t.Fatal(err)
+		}
+		if b.length() != len(tt.expLines) {
+			t.Fatalf("%s: length should be %d. Got %d", tt.name, len(tt.expLines), b.length())
+		}
+		for j, exp := range tt.expLines {
+			if res := string(b.getLine(j).runes); res != exp {
+				t.Fatalf("%s: line %d should be %q. Got %q", tt.name, j, exp, res)
+			}
+		}
+		if res := b.format.String(); res != tt.expFormat {
+			t.Fatalf("%s: format should be %q. Got %q", tt.name, tt.expFormat, res)
+		}
+		if err := b.writeToFile(); err != nil {
+			t.Fatal(err)
+		}
+		written, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(written) != tt.data {
+			t.Fatalf("%s: file should be written back as %q. Got %q", tt.name, tt.data, string(written))
+		}
+	}
+}
+
+func TestToggleFileFormat(t *testing.T) {
+	path := t.TempDir() + "/dos.txt"
+	if err := os.WriteFile(path, []byte("a\r\nb\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b := NewBuffer(highlighter.New(lexer.New()))
+	if err := b.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	b.toggleFileFormat()
+	if err := b.writeToFile(); err != nil {
+		t.Fatal(err)
+	}
+	written, _ := os.ReadFile(path)
+	if string(written) != "a\nb\n" {
+		t.Fatalf("file should be converted to unix line endings. Got %q", string(written))
+	}
+	if err := b.SetFileFormat("mac"); err == nil {
+		t.Fatal("unknown fileformat should be rejected")
+	}
+}
+
+func TestEncodingRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		expLines []string
+		expEnc   string
+		expBOM   bool
+	}{
+		{"latin1", []byte("caf\xe9\nna\xefve\n"), []string{"café", "naïve"}, "latin1", false},
+		{"utf-16le bom", []byte("\xff\xfeh\x00i\x00\n\x00"), []string{"hi"}, "utf-16le", true},
+		{"utf-16be bom", []byte("\xfe\xff\x00h\x00i\x00\n"), []string{"hi"}, "utf-16be", true},
+		{"utf-16le", []byte("a\x00b\x00\r\x00\n\x00c\x00\r\x00\n\x00"), []string{"ab", "c"}, "utf-16le", false},
+		{"utf-16be", []byte("\x00a\x00b\x00\n\x00\xe9\x00\n"), []string{"ab", "é"}, "utf-16be", false},
+		{"utf-8", []byte("héllo wörld\n"), []string{"héllo wörld"}, "utf-8", false},
+	}
+
+	dir := t.TempDir()
+	for i, tt := range tests {
+		path := fmt.Sprintf("%s/enc%d.txt", dir, i)
+		if err := os.WriteFile(path, tt.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		b := NewBuffer(highlighter.New(lexer.New()))
+		if err := b.ReadFile(path); err != nil {
+			t.Fatal(err)
+		}
+		if b.format.encoding.name != tt.expEnc || b.format.bom != tt.expBOM {
+			t.Fatalf("%s: encoding should be %s (bom %t). Got %s (bom %t)", tt.name, tt.expEnc, tt.expBOM, b.format.encoding.name, b.format.bom)
+		}
+		if b.length() != len(tt.expLines) {
+			t.Fatalf("%s: length should be %d. Got %d", tt.name, len(tt.expLines), b.length())
+		}
+		for j, exp := range tt.expLines {
+			if res := string(b.getLine(j).runes); res != exp {
+				t.Fatalf("%s: line %d should be %q. Got %q", tt.name, j, exp, res)
+			}
+		}
+		if err := b.writeToFile(); err != nil {
+			t.Fatal(err)
+		}
+		written, _ := os.ReadFile(path)
+		if string(written) != string(tt.data) {
+			t.Fatalf("%s: file should be written back as %q. Got %q", tt.name, tt.data, written)
+		}
+	}
+}
+
+func TestReopenWithEncoding(t *testing.T) {
+	path := t.TempDir() + "/latin1.txt"
+	if err := os.WriteFile(path, []byte("\xe9t\xe9\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b := NewBuffer(highlighter.New(lexer.New()))
+	if err := b.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.ReopenWithEncoding("cp1252"); err != nil {
+		t.Fatal(err)
+	}
+	if b.format.encoding.name != "windows-1252" || string(b.getLine(0).runes) != "été" {
+		t.Fatalf("buffer should be decoded as windows-1252. Got %s %q", b.format.encoding.name, string(b.getLine(0).runes))
+	}
+	if err := b.ReopenWithEncoding("klingon"); err == nil {
+		t.Fatal("unknown encoding should be rejected")
+	}
+
+	if err := b.SetEncoding("utf-8"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.writeToFile(); err != nil {
+		t.Fatal(err)
+	}
+	written, _ := os.ReadFile(path)
+	if string(written) != "été\n" {
+		t.Fatalf("file should be saved as utf-8. Got %q", written)
+	}
+
+	b.SetEncoding("latin1")
+	if _, err := b.format.encoding.encode("日本"); err == nil {
+		t.Fatal("latin1 should not encode CJK text")
+	}
+}
+
+func TestWriteToFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := dir + "/script.sh"
+	if err := os.WriteFile(path, []byte("echo hi\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	link := dir + "/link.sh"
+	if err := os.Symlink(path, link); err != nil {
+		t.Fatal(err)
+	}
+
+	b := NewBuffer(highlighter.New(lexer.New()))
+	if err := b.ReadFile(link); err != nil {
+		t.Fatal(err)
+	}
+	b.getLine(0).runes = []rune("echo bye")
+	if err := b.writeToFile(); err != nil {
+		t.Fatal(err)
+	}
+	written, _ := os.ReadFile(path)
+	if string(written) != "echo bye\n" {
+		t.Fatalf("symlink target should be updated. Got %q", written)
+	}
+	info, err := os.Lstat(link)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Fatal("symlink should be preserved")
+	}
+	info, _ = os.Stat(path)
+	if info.Mode().Perm() != 0755 {
+		t.Fatalf("mode should be preserved as 0755. Got %o", info.Mode().Perm())
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Fatalf("temporary files should be cleaned up. Got %d entries", len(entries))
+	}
+}
+
+func TestWriteKeepsSpecialModeBits(t *testing.T) {
+	path := t.TempDir() + "/tool"
+	if err := os.WriteFile(path, []byte("a\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	mode := fs.FileMode(0755) | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+	if err := os.Chmod(path, mode); err != nil {
+		t.Fatal(err)
+	}
+	b := NewBuffer(highlighter.New(lexer.New()))
+	if err := b.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	b.getLine(0).runes = []rune("b")
+	if err := b.writeToFile(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := info.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky); got != mode {
+		t.Fatalf("mode should be kept as %v. Got %v", mode, got)
+	}
+}
+
+func TestWriteErrors(t *testing.T) {
+	dir := t.TempDir()
+	readOnly := dir + "/readonly.txt"
+	if err := os.WriteFile(readOnly, []byte("keep\n"), 0444); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDisplay()
+	initTestDisplay(d)
+	if err := d.ActiveBuf.ReadFile(readOnly); err != nil {
+		t.Fatal(err)
+	}
+	d.ActiveBuf.getLine(0).runes = []rune("changed")
+	// root may write the file whatever its mode
+	if os.Geteuid() != 0 {
+		d.writeActiveBuf()
+		if !d.messageIsError || d.message == "" {
+			t.Fatal("writing a read-only file should show an error")
+		}
+		written, _ := os.ReadFile(readOnly)
+		if string(written) != "keep\n" {
+			t.Fatalf("read-only file should not change. Got %q", written)
+		}
+		if string(d.ActiveBuf.getLine(0).runes) != "changed" {
+			t.Fatal("buffer should keep its edits after a failed write")
+		}
+	}
+
+	b := NewBuffer(highlighter.New(lexer.New()))
+	if err := b.ReadFile(dir + "/missing/new.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.writeToFile(); err == nil {
+		t.Fatal("writing into a missing directory should fail")
+	}
+
+	d.clearMessage()
+	d.ActiveBuf = NewBuffer(d.Highlighter)
+	d.writeActiveBuf()
+	if !d.messageIsError {
+		t.Fatal("writing a buffer without a file name should fail")
+	}
+}
+
+func TestWriteToOtherFile(t *testing.T) {
+	dir := t.TempDir()
+	path := dir + "/main.txt"
+	if err := os.WriteFile(path, []byte("abc\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDisplay()
+	initTestDisplay(d)
+	if err := d.ActiveBuf.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	d.InitBufWindow()
+
+	copyPath := dir + "/copy.txt"
+	if err := d.runCommandLine("w " + copyPath); err != nil {
+		t.Fatal(err)
+	}
+	if written, _ := os.ReadFile(copyPath); string(written) != "abc\n" {
+		t.Fatalf(":w with a file name should write there. Got %q", written)
+	}
+	if d.ActiveBuf.path != path {
+		t.Fatalf(":w with a file name should not rename the buffer. Got %s", d.ActiveBuf.path)
+	}
+
+	if err := os.Mkdir(dir+"/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, arg := range []string{dir + "/sub", dir + "/sub/", dir + "/new/"} {
+		err := d.runCommandLine("w! " + arg)
+		if err == nil || !strings.Contains(err.Error(), "is a directory") {
+			t.Fatalf(":w! %s should say it is a directory. Got %v", arg, err)
+		}
+	}
+	if _, err := os.Stat(dir + "/new"); err == nil {
+		t.Fatal(":w to a name ending in / should not create a file")
+	}
+
+	err := d.runCommandLine("w " + dir + "/missing/new.txt")
+	if err == nil || !strings.Contains(err.Error(), "cannot write to") {
+		t.Fatalf("writing into a missing directory should fail as a save would. Got %v", err)
+	}
+}
+
+func TestModifiedFlag(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	path := t.TempDir() + "/dirty.txt"
+	if err := os.WriteFile(path, []byte("abc\ndef\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDisplay()
+	initTestDisplay(d)
+	if err := d.ActiveBuf.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	d.InitBufWindow()
+	buf := d.ActiveBuf
+	d.bufWindow.cur.X, d.bufWindow.cur.Y = LeftMarginSize+3, 0
+	d.setBufPos()
+
+	if buf.Modified() {
+		t.Fatal("freshly read buffer should not be modified")
+	}
+	d.setRune('x')
+	if !buf.Modified() {
+		t.Fatal("setRune should mark the buffer modified")
+	}
+	d.undoLastEvent()
+	if buf.Modified() {
+		t.Fatal("undoing back to the saved state should clear the modified flag")
+	}
+	d.redoLastEvent()
+	if !buf.Modified() {
+		t.Fatal("redo should mark the buffer modified")
+	}
+	if err := buf.writeToFile(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Modified() {
+		t.Fatal("writing should clear the modified flag")
+	}
+
+	d.setBufPos()
+	d.setRune('y')
+	d.setBufPos()
+	d.bufWindow.pos.X--
+	d.backspaceChar()
+	if !buf.Modified() {
+		t.Fatal("removeRune should mark the buffer modified")
+	}
+	d.undoLastEvent()
+	d.undoLastEvent()
+	if buf.Modified() {
+		t.Fatal("undoing both edits should return to the saved state")
+	}
+
+	d.setBufPos()
+	d.handleKeyEnter()
+	d.undoLastEvent()
+	if buf.Modified() {
+		t.Fatal("undoing a line split should return to the saved state")
+	}
+	d.ActiveBuf.toggleFileFormat()
+	d.undoLastEvent()
+	if !buf.Modified() {
+		t.Fatal("a change that cannot be undone should keep the buffer modified")
+	}
+}
+
+func TestQuitConfirmation(t *testing.T) {
+	d := NewDisplay()
+	initTestDisplay(d)
+	d.Mode = Normal
+	d.setRune('x')
+	d.Mode = Normal
+
+	quit := tcell.NewEventKey(tcell.KeyRune, 'Q', tcell.ModNone)
+	d.runNormalMode(quit)
+	if d.Mode == Exit || !d.messageIsError {
+		t.Fatal("Q with unsaved changes should ask for confirmation")
+	}
+	d.runNormalMode(tcell.NewEventKey(tcell.KeyRune, 'j', tcell.ModNone))
+	d.runNormalMode(quit)
+	if d.Mode == Exit {
+		t.Fatal("confirmation should be cancelled by another key")
+	}
+	d.runNormalMode(quit)
+	if d.Mode != Exit {
+		t.Fatal("pressing Q twice should quit")
+	}
+
+	d.Mode = Normal
+	d.runNormalMode(tcell.NewEventKey(tcell.KeyCtrlQ, 0, tcell.ModCtrl))
+	if d.Mode != Exit {
+		t.Fatal("Ctrl-Q should force quit")
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	a := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k"}
+	b := []string{"a", "B", "c", "d", "e", "f", "g", "h", "i", "j", "k", "l"}
+	expected := []string{
+		"--- old",
+		"+++ new",
+		"@@ -1,5 +1,5 @@",
+		" a",
+		"-b",
+		"+B",
+		" c",
+		" d",
+		" e",
+		"@@ -9,3 +9,4 @@",
+		" i",
+		" j",
+		" k",
+		"+l",
+	}
+	res := unifiedDiff("old", "new", a, b)
+	if len(res) != len(expected) {
+		printLines(expected, res)
+		t.Fatalf("diff should have %d lines. Got %d", len(expected), len(res))
+	}
+	for i := range expected {
+		if res[i] != expected[i] {
+			t.Fatalf("diff line %d should be %q. Got %q", i, expected[i], res[i])
+		}
+	}
+	if unifiedDiff("old", "new", a, a) != nil {
+		t.Fatal("identical input should produce no diff")
+	}
+}
+
+func TestDiffLinesIsShortest(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randomLines := func() []string {
+		lines := make([]string, rng.Intn(12))
+		for i := range lines {
+			lines[i] = string(rune('a' + rng.Intn(3)))
+		}
+		return lines
+	}
+	// editDistance counts the inserts and deletes of the shortest script
+	editDistance := func(a, b []string) int {
+		dist := make([][]int, len(a)+1)
+		for i := range dist {
+			dist[i] = make([]int, len(b)+1)
+			for j := range dist[i] {
+				switch {
+				case i == 0 || j == 0:
+					dist[i][j] = i + j
+				case a[i-1] == b[j-1]:
+					dist[i][j] = dist[i-1][j-1]
+				default:
+					dist[i][j] = min(dist[i-1][j], dist[i][j-1]) + 1
+				}
+			}
+		}
+		return dist[len(a)][len(b)]
+	}
+	for range 2000 {
+		a, b := randomLines(), randomLines()
+		ops := diffLines(a, b)
+		gotA, gotB, edits := []string{}, []string{}, 0
+		for _, op := range ops {
+			if op.kind != '+' {
+				gotA = append(gotA, op.text)
+			}
+			if op.kind != '-' {
+				gotB = append(gotB, op.text)
+			}
+			if op.kind != ' ' {
+				edits++
+			}
+		}
+		if !slices.Equal(gotA, a) || !slices.Equal(gotB, b) {
+			t.Fatalf("diff of %q and %q should give back both. Got %q and %q", a, b, gotA, gotB)
+		}
+		if want := editDistance(a, b); edits != want {
+			t.Fatalf("diff of %q and %q should make %d edits. Got %d", a, b, want, edits)
+		}
+	}
+}
+
+// BenchmarkDiffLines diffs a file against a copy with one line in ten
+// changed, as after a formatter rewrites it.
+func BenchmarkDiffLines(b *testing.B) {
+	for _, size := range []int{10000, 100000} {
+		before := make([]string, size)
+		after := make([]string, size)
+		for i := range size {
+			before[i] = fmt.Sprintf("line %d", i)
+			after[i] = before[i]
+			if i%10 == 0 {
+				after[i] = fmt.Sprintf("changed %d", i)
 			}
 		}
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				diffLines(before, after)
+			}
+		})
+	}
+}
+
+func touchLater(t *testing.T, path, content string) {
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExternalChangeReload(t *testing.T) {
+	path := t.TempDir() + "/watched.txt"
+	if err := os.WriteFile(path, []byte(strings.Repeat("line\n", 20)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDisplay()
+	initTestDisplay(d)
+	if err := d.ActiveBuf.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	d.InitBufWindow()
+	d.Mode = Normal
+	d.bufWindow.cur.X, d.bufWindow.cur.Y = LeftMarginSize+2, 5
+	d.setBufPos()
+
+	d.checkActiveBufOnDisk()
+	if d.message != "" {
+		t.Fatal("an unchanged file should not be reloaded")
+	}
+
+	touchLater(t, path, strings.Repeat("changed\n", 20))
+	d.checkActiveBufOnDisk()
+	if string(d.ActiveBuf.getLine(0).runes) != "changed" {
+		t.Fatal("a clean buffer should be reloaded automatically")
+	}
+	if d.bufWindow.cur.Y != 5 || d.bufWindow.pos.X != 2 {
+		t.Fatalf("cursor should stay at line 5, index 2. Got %d, %d", d.bufWindow.cur.Y, d.bufWindow.pos.X)
+	}
+}
+
+func TestReloadKeepsBufferState(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	dir := t.TempDir()
+	path := dir + "/watched.txt"
+	long := strings.Repeat("x", 400)
+	if err := os.WriteFile(path, []byte(strings.Repeat(long+"\n", 20)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDisplay()
+	initTestDisplay(d)
+	if err := d.ActiveBuf.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	d.InitBufWindow()
+	d.Mode = Normal
+	buf := d.ActiveBuf
+	if err := d.runCommandLine("set tabwidth=3"); err != nil {
+		t.Fatal(err)
+	}
+	d.moveToBufPos(position{line: 6, col: 0})
+	d.setRune('a')
+	d.writeActiveBuf()
+	d.moveToBufPos(position{line: 6, col: 300})
+	d.keepCursorInView()
+	leftCol := d.bufWindow.leftCol
+	if leftCol == 0 {
+		t.Fatal("the window should have scrolled sideways")
+	}
+
+	touchLater(t, path, strings.Repeat(strings.Repeat("y", 400)+"\n", 20))
+	d.checkActiveBufOnDisk()
+	if string(buf.getLine(6).runes) != strings.Repeat("y", 400) {
+		t.Fatal("a clean buffer should be reloaded")
+	}
+	if buf.path != path || buf.settings.TabWidth != 3 || buf.modified {
+		t.Fatalf("reload should keep the path and settings. Got %q, tabwidth %d, modified %t", buf.path, buf.settings.TabWidth, buf.modified)
+	}
+	if pos := d.cursorPos(); pos != (position{line: 6, col: 300}) || d.bufWindow.leftCol != leftCol {
+		t.Fatalf("reload should keep the cursor and view. Got %v, leftCol %d", pos, d.bufWindow.leftCol)
+	}
+	d.undoLastEvent()
+	if string(buf.getLine(6).runes) != "a"+long || !buf.modified {
+		t.Fatal("the reload should be undone as one edit")
+	}
+	d.undoLastEvent()
+	if string(buf.getLine(6).runes) != long {
+		t.Fatal("edits before the reload should stay in the history")
+	}
+	d.redoLastEvent()
+	d.redoLastEvent()
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	d.reloadActiveBuf()
+	if !d.messageIsError {
+		t.Fatal("a failed reload should show an error")
+	}
+	if buf.path != path || buf.length() != 20 || string(buf.getLine(0).runes) != strings.Repeat("y", 400) {
+		t.Fatal("a failed reload should leave the buffer as it was")
+	}
+}
+
+func TestDiskCheckOnSwitch(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	dir := t.TempDir()
+	first, second := dir+"/first.txt", dir+"/second.txt"
+	for _, path := range []string{first, second} {
+		if err := os.WriteFile(path, []byte("old\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := NewDisplay()
+	initTestDisplay(d)
+	if err := d.ActiveBuf.ReadFile(first); err != nil {
+		t.Fatal(err)
+	}
+	d.InitBufWindow()
+	d.Mode = Normal
+	firstBuf := d.ActiveBuf
+	if err := d.OpenFile(second); err != nil {
+		t.Fatal(err)
+	}
+
+	touchLater(t, first, "new\n")
+	if err := d.runCommandLine("bp"); err != nil {
+		t.Fatal(err)
+	}
+	if d.ActiveBuf != firstBuf || string(firstBuf.getLine(0).runes) != "new" {
+		t.Fatal(":bp should check the buffer it switches to on disk")
+	}
+
+	d.splitWindow(true)
+	if err := d.OpenFile(second); err != nil {
+		t.Fatal(err)
+	}
+	touchLater(t, first, "newer\n")
+	d.focusNextWindow()
+	if d.ActiveBuf != firstBuf || string(firstBuf.getLine(0).runes) != "newer" {
+		t.Fatal("focusing a window should check its buffer on disk")
+	}
+}
+
+func TestExternalChangePrompt(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	path := t.TempDir() + "/watched.txt"
+	if err := os.WriteFile(path, []byte("one\ntwo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDisplay()
+	initTestDisplay(d)
+	if err := d.ActiveBuf.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	d.InitBufWindow()
+	d.Mode = Normal
+	d.bufWindow.cur.X, d.bufWindow.cur.Y = LeftMarginSize, 0
+	d.setBufPos()
+	d.setRune('x')
+
+	touchLater(t, path, "one\nTWO\n")
+	d.checkActiveBufOnDisk()
+	if d.Mode != Prompt {
+		t.Fatal("a modified buffer should prompt when the file changes on disk")
+	}
+	d.runPromptMode(tcell.NewEventKey(tcell.KeyRune, 'c', tcell.ModNone))
+	if d.Mode != Normal || string(d.ActiveBuf.getLine(0).runes) != "xone" {
+		t.Fatal("cancel should keep the buffer")
+	}
+	d.checkActiveBufOnDisk()
+	if d.Mode == Prompt {
+		t.Fatal("the same change should not be reported twice")
+	}
+
+	d.writeActiveBuf()
+	if d.Mode != Prompt {
+		t.Fatal("writing over a changed file should ask first")
+	}
+	d.runPromptMode(tcell.NewEventKey(tcell.KeyRune, 'd', tcell.ModNone))
+	if d.Mode != Diff || d.prompt == nil {
+		t.Fatal("diff should open the diff view and keep the prompt")
+	}
+	d.runDiffMode(tcell.NewEventKey(tcell.KeyRune, 'q', tcell.ModNone))
+	if d.Mode != Prompt {
+		t.Fatal("leaving the diff view should return to the prompt")
+	}
+	d.runPromptMode(tcell.NewEventKey(tcell.KeyRune, 'o', tcell.ModNone))
+	written, _ := os.ReadFile(path)
+	if string(written) != "xone\ntwo\n" || d.ActiveBuf.Modified() {
+		t.Fatalf("overwrite should write the buffer. Got %q", written)
+	}
+}
+
+func TestSwapFile(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	path := t.TempDir() + "/swapped.txt"
+	if err := os.WriteFile(path, []byte("one\ntwo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDisplay()
+	initTestDisplay(d)
+	if err := d.ActiveBuf.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	d.InitBufWindow()
+	d.Mode = Normal
+	d.bufWindow.cur.X, d.bufWindow.cur.Y = LeftMarginSize, 0
+	d.setBufPos()
+
+	swapPath, _ := d.ActiveBuf.swapPath()
+	d.flushSwapFiles()
+	if _, err := os.Stat(swapPath); err == nil {
+		t.Fatal("a clean buffer should not have a swap file")
+	}
+	d.setRune('x')
+	d.flushSwapFiles()
+	swap, err := d.ActiveBuf.readSwap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if swap.PID != os.Getpid() || swap.Path != path || strings.Join(swap.Lines, "\n") != "xone\ntwo" {
+		t.Fatalf("unexpected swap contents: %+v", swap)
+	}
+	if swap.ownerAlive() {
+		t.Fatal("our own swap file should not count as another instance")
+	}
+	d.forceWriteActiveBuf()
+	d.flushSwapFiles()
+	if _, err := os.Stat(swapPath); err == nil {
+		t.Fatal("saving should remove the swap file")
+	}
+}
+
+func TestSwapRecovery(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	path := t.TempDir() + "/crashed.txt"
+	if err := os.WriteFile(path, []byte("one\ntwo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDisplay()
+	initTestDisplay(d)
+	crashed := d.ActiveBuf
+	if err := crashed.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	crashed.content.line(1).runes = []rune("TWO")
+	crashed.markChanged()
+	d.WriteSwapFiles()
+
+	tests := []struct {
+		key       rune
+		expLine   string
+		expSwap   bool
+		expModify bool
+	}{
+		{'i', "two", true, false},
+		{'r', "TWO", true, true},
+		{'x', "two", false, false},
+	}
+	for _, tt := range tests {
+		d := NewDisplay()
+		initTestDisplay(d)
+		if err := d.ActiveBuf.ReadFile(path); err != nil {
+			t.Fatal(err)
+		}
+		d.InitBufWindow()
+		d.Mode = Normal
+		d.CheckSwapFile()
+		if d.Mode != Prompt {
+			t.Fatal("opening a file with a swap file should prompt")
+		}
+		d.runPromptMode(tcell.NewEventKey(tcell.KeyRune, tt.key, tcell.ModNone))
+		if got := string(d.ActiveBuf.getLine(1).runes); got != tt.expLine {
+			t.Fatalf("[%c] line 1: expected %q, got %q", tt.key, tt.expLine, got)
+		}
+		_, err := d.ActiveBuf.readSwap()
+		if (err == nil) != tt.expSwap || d.ActiveBuf.Modified() != tt.expModify {
+			t.Fatalf("[%c] swap kept: %v, modified: %v", tt.key, err == nil, d.ActiveBuf.Modified())
+		}
+	}
+}
+
+func TestUndoFileError(t *testing.T) {
+	// a file where the state directory should be makes the undo file fail
+	state := t.TempDir() + "/state"
+	if err := os.WriteFile(state, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("XDG_STATE_HOME", state)
+	path := t.TempDir() + "/undo.txt"
+	if err := os.WriteFile(path, []byte("one\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDisplay()
+	initTestDisplay(d)
+	if err := d.ActiveBuf.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	d.InitBufWindow()
+	d.Mode = Normal
+	d.setBufPos()
+	d.setRune('x')
+	d.forceWriteActiveBuf()
+	if written, _ := os.ReadFile(path); string(written) != "xone\n" {
+		t.Fatalf("the file should be saved without its undo history. Got %q", written)
+	}
+	if !d.messageIsError || !strings.Contains(d.message, "undo history was not saved") {
+		t.Fatalf("failing to save the undo history should be reported. Got %q", d.message)
+	}
+	if d.ActiveBuf.Modified() {
+		t.Fatal("the buffer should count as saved")
+	}
+}
+
+func TestSwapRecoveryCRLF(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	path := t.TempDir() + "/dos.txt"
+	if err := os.WriteFile(path, []byte("one\r\ntwo\r\nthree\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDisplay()
+	initTestDisplay(d)
+	crashed := d.ActiveBuf
+	if err := crashed.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	crashed.content.line(1).runes = []rune("TWO")
+	crashed.markChanged()
+	d.WriteSwapFiles()
+
+	d = NewDisplay()
+	initTestDisplay(d)
+	if err := d.ActiveBuf.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	d.InitBufWindow()
+	d.Mode = Normal
+	d.CheckSwapFile()
+	d.runPromptMode(tcell.NewEventKey(tcell.KeyRune, 'r', tcell.ModNone))
+	if got := strings.Join(d.ActiveBuf.lineStrings(), "|"); got != "one|TWO|three" {
+		t.Fatalf("a recovered dos buffer should keep its lines. Got %q", got)
+	}
+	if err := d.ActiveBuf.writeToFile(); err != nil {
+		t.Fatal(err)
+	}
+	written, _ := os.ReadFile(path)
+	if string(written) != "one\r\nTWO\r\nthree\r\n" {
+		t.Fatalf("a recovered dos buffer should be saved with dos line endings. Got %q", written)
+	}
+}
+
+func TestPersistentUndo(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	path := t.TempDir() + "/undo.txt"
+	if err := os.WriteFile(path, []byte("one\ntwo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	open := func() *Display {
+		d := NewDisplay()
+		initTestDisplay(d)
+		if err := d.ActiveBuf.ReadFile(path); err != nil {
+			t.Fatal(err)
+		}
+		d.InitBufWindow()
+		d.Mode = Normal
+		d.bufWindow.cur.X, d.bufWindow.cur.Y = LeftMarginSize, 1
+		d.setBufPos()
+		return d
+	}
+
+	d := open()
+	d.setRune('x')
+	d.forceWriteActiveBuf()
+
+	d = open()
+	d.undoLastEvent()
+	if got := string(d.ActiveBuf.getLine(1).runes); got != "two" {
+		t.Fatalf("undo after reopening should restore %q, got %q", "two", got)
+	}
+	if !d.ActiveBuf.Modified() {
+		t.Fatal("undoing past the saved state should mark the buffer modified")
+	}
+	d.redoLastEvent()
+	if got := string(d.ActiveBuf.getLine(1).runes); got != "xtwo" || d.ActiveBuf.Modified() {
+		t.Fatalf("redo should return to the saved state, got %q", got)
+	}
+
+	touchLater(t, path, "one\nxtwo\nthree\n")
+	d = open()
+	if len(d.ActiveBuf.history.nodes) != 1 {
+		t.Fatal("history should not be restored when the file changed")
+	}
+
+	d.setRune('y')
+	d.forceWriteActiveBuf()
+	if err := d.ActiveBuf.ClearUndoHistory(); err != nil {
+		t.Fatal(err)
+	}
+	d = open()
+	if len(d.ActiveBuf.history.nodes) != 1 {
+		t.Fatal("cleared history should not come back")
+	}
+}
+
+func TestCapUndoTree(t *testing.T) {
+	// 0 - 1 - 2 - 3 with a branch 1 - 4 and the current state at 3
+	node := func(seq, parent int) nodeOnDisk {
+		n := nodeOnDisk{Seq: seq, Parent: parent, Redo: -1}
+		if parent != -1 {
+			n.Record = &recordOnDisk{Action: ADD, Edits: []editOnDisk{{New: strings.Repeat("x", 100)}}}
+		}
+		return n
+	}
+	nodes := []nodeOnDisk{node(0, -1), node(1, 0), node(2, 1), node(3, 2), node(4, 1)}
+	seqs := func(nodes []nodeOnDisk) string {
+		res := []string{}
+		for _, n := range nodes {
+			res = append(res, fmt.Sprintf("%d<%d", n.Seq, n.Parent))
+		}
+		return strings.Join(res, " ")
+	}
+	tests := []struct {
+		limit    int
+		expNodes string
+	}{
+		{100000, "0<-1 1<0 2<1 3<2 4<1"},
+		{1000, "1<-1 2<1 3<2 4<1"},
+		{900, "1<-1 2<1 3<2"},
+		{600, "2<-1 3<2"},
+		{1, "3<-1"},
+	}
+	for _, tt := range tests {
+		got := seqs(capTree(append([]nodeOnDisk(nil), nodes...), 3, tt.limit))
+		if got != tt.expNodes {
+			t.Fatalf("limit %d: expected %s, got %s", tt.limit, tt.expNodes, got)
+		}
+	}
+}
+
+func TestUndoTree(t *testing.T) {
+	d := NewDisplay()
+	initTestDisplay(d)
+	d.ActiveBuf.addTestLines([]string{"abc"}, d.Highlighter)
+	d.bufWindow.update(0)
+	line := func() string {
+		return string(d.ActiveBuf.getLine(0).runes)
+	}
+	type2 := func(x int, r rune) {
+		d.bufWindow.cur.X, d.bufWindow.cur.Y = LeftMarginSize+x, 0
+		d.setBufPos()
+		d.setRune(r)
+	}
+	h := d.ActiveBuf.history
+
+	type2(0, 'x')
+	d.undoLastEvent()
+	type2(3, 'y')
+	if line() != "abcy" || len(h.root.children) != 2 {
+		t.Fatalf("an edit after undo should start a new branch. Got %q", line())
+	}
+	d.redoLastEvent()
+	if line() != "abcy" {
+		t.Fatalf("redo at the newest state should do nothing. Got %q", line())
+	}
+	d.restoreUndoState(h.nodeBySeq(1))
+	if line() != "xabc" {
+		t.Fatalf("the abandoned branch should be reachable. Got %q", line())
+	}
+
+	tests := []struct {
+		move    func() error
+		expLine string
+		expSeq  int
+	}{
+		{func() error { return d.Later("1") }, "abcy", 2},
+		{func() error { return d.Earlier("2") }, "abc", 0},
+		{func() error { return d.Later("5") }, "abcy", 2},
+		{func() error { return d.Earlier("1") }, "xabc", 1},
+	}
+	for i, tt := range tests {
+		if err := tt.move(); err != nil {
+			t.Fatal(err)
+		}
+		if line() != tt.expLine || h.curr.seq != tt.expSeq {
+			t.Fatalf("move %d: expected %q at state %d. Got %q at %d", i, tt.expLine, tt.expSeq, line(), h.curr.seq)
+		}
+	}
+
+	h.root.time = time.Now().Add(-time.Hour)
+	h.nodeBySeq(1).time = time.Now().Add(-10 * time.Minute)
+	h.nodeBySeq(2).time = time.Now()
+	d.Later("2")
+	if err := d.Earlier("5m"); err != nil {
+		t.Fatal(err)
+	}
+	if h.curr.seq != 1 {
+		t.Fatalf("earlier 5m should go to state 1. Got %d", h.curr.seq)
+	}
+	d.Earlier("30m")
+	if h.curr.seq != 0 {
+		t.Fatalf("earlier 30m should go to the original state. Got %d", h.curr.seq)
+	}
+	if err := d.Later("1x"); err == nil {
+		t.Fatal("an invalid argument should be an error")
+	}
+
+	d.showUndoTree()
+	if d.Mode != UndoTree || len(d.undoTreeRows) != 3 || d.undoTreeRows[d.undoTreeSel].node != h.curr {
+		t.Fatal("the undo tree should list every state with the current one selected")
+	}
+	if d.undoTreeRows[1].depth != 1 || d.undoTreeRows[2].depth != 0 {
+		t.Fatal("older branches should be indented under the newest one")
+	}
+	d.runUndoTreeMode(tcell.NewEventKey(tcell.KeyRune, 'j', tcell.ModNone))
+	shown := d.ActiveBuf.getLine(0)
+	d.runUndoTreeMode(tcell.NewEventKey(tcell.KeyRune, 'p', tcell.ModNone))
+	if d.Mode != Diff || line() != "abc" {
+		t.Fatal("preview should show a diff and leave the buffer alone")
+	}
+	if d.ActiveBuf.getLine(0) != shown {
+		t.Fatal("preview should not replace the lines other windows show")
+	}
+	if !slices.Contains(d.diffLines, "+xabc") {
+		t.Fatalf("preview should diff against the selected state. Got %q", d.diffLines)
+	}
+	d.runDiffMode(tcell.NewEventKey(tcell.KeyRune, 'q', tcell.ModNone))
+	d.runUndoTreeMode(tcell.NewEventKey(tcell.KeyEnter, 0, tcell.ModNone))
+	if d.Mode != Normal || line() != "xabc" {
+		t.Fatalf("enter should restore the selected state. Got %q", line())
+	}
+}
+
+func TestMultiLineUndo(t *testing.T) {
+	d := NewDisplay()
+	initTestDisplay(d)
+	d.ActiveBuf.addTestLines([]string{"func main() {", "\treturn", "}"}, d.Highlighter)
+	d.bufWindow.update(0)
+	snapshot := func() string {
+		return strings.Join(d.ActiveBuf.lineStrings(), "\n")
+	}
+	moveTo := func(y, x int) {
+		d.bufWindow.cur.Y = y
+		d.bufWindow.cur.X = LeftMarginSize + d.ActiveBuf.getLine(y).colAt(x, d.tabWidth())
+		d.setBufPos()
+	}
+
+	steps := []struct {
+		name string
+		edit func()
+	}{
+		{"enter", func() { moveTo(1, 1); d.handleKeyEnter() }},
+		{"type", func() { d.setBufPos(); d.setRune('x'); d.setRune('y') }},
+		{"join", func() { moveTo(2, 0); d.handleKeyBackspace() }},
+		{"delete line", func() {
+			moveTo(0, 0)
+			for _, r := range "dd" {
+				d.runNormalMode(tcell.NewEventKey(tcell.KeyRune, r, tcell.ModNone))
+			}
+		}},
+		{"blank line", func() { moveTo(0, 0); d.insertBlankLine() }},
+	}
+	states := []string{snapshot()}
+	for _, step := range steps {
+		step.edit()
+		states = append(states, snapshot())
+		if states[len(states)-1] == states[len(states)-2] {
+			t.Fatalf("%s: expected the buffer to change", step.name)
+		}
+	}
+	for i := len(steps) - 1; i >= 0; i-- {
+		d.undoLastEvent()
+		if got := snapshot(); got != states[i] {
+			t.Fatalf("undo %s: expected %q, got %q", steps[i].name, states[i], got)
+		}
+	}
+	if d.ActiveBuf.Modified() {
+		t.Fatal("undoing every step should return to the saved state")
+	}
+	if d.bufWindow.pos.Y != 1 || d.bufWindow.pos.X != 1 {
+		t.Fatalf("undo should restore the cursor to (1, 1). Got (%d, %d)", d.bufWindow.pos.Y, d.bufWindow.pos.X)
+	}
+	for i := range steps {
+		d.redoLastEvent()
+		if got := snapshot(); got != states[i+1] {
+			t.Fatalf("redo %s: expected %q, got %q", steps[i].name, states[i+1], got)
+		}
+	}
+}
+
+func TestReplaceText(t *testing.T) {
+	tests := []struct {
+		before []string
+		after  []string
+	}{
+		{[]string{"abc"}, []string{"abxc"}},
+		{[]string{"abc"}, []string{"a", "bc"}},
+		{[]string{"a", "bc"}, []string{"abc"}},
+		{[]string{"one", "two", "three"}, []string{"one", "three"}},
+		{[]string{"one", "two", "three"}, []string{"one", "two"}},
+		{[]string{"one"}, []string{""}},
+		{[]string{"one", "two"}, []string{"ONE", "", "tw"}},
+	}
+	h := highlighter.New(lexer.New())
+	for _, tt := range tests {
+		la := lineArrayFromStrings(tt.before, h)
+		before := la.regionText(0, la.length()-1)
+		after := []rune(strings.Join(tt.after, "\n") + "\n")
+		edit := diffRegion(0, before, after)
+		edit.apply(la, h)
+		if got := string(la.regionText(0, la.length()-1)); got != string(after) {
+			t.Fatalf("apply %v -> %v: got %q", tt.before, tt.after, got)
+		}
+		edit.revert(la, h)
+		if got := string(la.regionText(0, la.length()-1)); got != string(before) {
+			t.Fatalf("revert %v -> %v: got %q", tt.before, tt.after, got)
+		}
+	}
+}
+
+func TestMultipleBuffers(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.go", "a_test.go"} {
+		content := strings.Repeat(name+"\n", 100)
+		if err := os.WriteFile(dir+"/"+name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := NewDisplay()
+	initTestDisplay(d)
+	if err := d.ActiveBuf.ReadFile(dir + "/a.go"); err != nil {
+		t.Fatal(err)
+	}
+	d.InitBufWindow()
+	d.Mode = Normal
+	d.moveToBufPos(position{line: 70, col: 2})
+	first := d.ActiveBuf
+
+	if err := d.OpenFile(dir + "/a_test.go"); err != nil {
+		t.Fatal(err)
+	}
+	second := d.ActiveBuf
+	if len(d.buffers) != 2 || second == first || second.Name() != "a_test.go" {
+		t.Fatal("opening a file should add and switch to a new buffer")
+	}
+	if d.bufWindow.top != 1 || d.bufWindow.size != d.height-2 {
+		t.Fatal("the tab line should take the first row while two buffers are open")
+	}
+	if pos := d.cursorPos(); pos.line != 0 || pos.col != 0 {
+		t.Fatalf("a new buffer should start at the top. Got %+v", pos)
+	}
+	d.moveToBufPos(position{line: 5, col: 1})
+
+	d.cycleBuffer(1)
+	if d.ActiveBuf != first || d.cursorPos() != (position{line: 70, col: 2}) || d.bufWindow.bufIdx != first.windowStart {
+		t.Fatalf("switching back should restore the cursor and scroll offset. Got %+v", d.cursorPos())
+	}
+	d.cycleBuffer(-1)
+	if d.ActiveBuf != second || d.cursorPos() != (position{line: 5, col: 1}) {
+		t.Fatalf("cycling should wrap around. Got %+v", d.cursorPos())
+	}
+	if err := d.OpenFile(dir + "/a.go"); err != nil || len(d.buffers) != 2 || d.ActiveBuf != first {
+		t.Fatal("opening a file that is already open should switch to its buffer")
+	}
+
+	d.setRune('x')
+	d.quit(false)
+	d.cycleBuffer(1)
+	d.quit(false)
+	if d.Mode == Exit || d.ActiveBuf != first {
+		t.Fatal("quitting with a modified buffer should switch to it and ask for confirmation")
+	}
+
+	d.closeBuffer(false)
+	if d.Mode != Prompt {
+		t.Fatal("closing a modified buffer should ask first")
+	}
+	d.runPromptMode(tcell.NewEventKey(tcell.KeyRune, 'y', tcell.ModNone))
+	if len(d.buffers) != 1 || d.ActiveBuf != second || d.bufWindow.top != 0 {
+		t.Fatal("closing a buffer should switch to the next one and drop the tab line")
+	}
+	d.closeBuffer(false)
+	if len(d.buffers) != 1 || d.ActiveBuf.path != "" {
+		t.Fatal("closing the last buffer should leave an empty one")
+	}
+}
+
+func TestSplitWindows(t *testing.T) {
+	d := NewDisplay()
+	initTestDisplay(d)
+	d.ActiveBuf.addTestLines(createTestLines(100), d.Highlighter)
+	d.bufWindow.update(0)
+	d.Mode = Normal
+	bottom := d.bufWindow
+	d.moveToBufPos(position{line: 40, col: 0})
+
+	d.splitWindow(false)
+	top := d.bufWindow
+	if top == bottom || top.buf != bottom.buf || len(d.windows()) != 2 {
+		t.Fatal("a split should show the same buffer in a new, focused window")
+	}
+	if top.top != 0 || top.size+1+bottom.size != d.height-1 || bottom.top != top.size+1 {
+		t.Fatalf("the split should share the rows. Got %d at %d and %d at %d", top.size, top.top, bottom.size, bottom.top)
+	}
+	if d.cursorPos().line != 40 {
+		t.Fatalf("the new window should keep the cursor. Got %+v", d.cursorPos())
+	}
+
+	d.moveToBufPos(position{line: bottom.bufIdx, col: 0})
+	d.setRune('x')
+	d.drawWindows()
+	if string(bottom.lines[0].runes) != "x"+createTestLines(100)[bottom.bufIdx] {
+		t.Fatal("an edit in one window should show up in the other")
+	}
+
+	d.splitWindow(true)
+	left := d.bufWindow
+	if left.left != 0 || left.width+1+top.width != d.width || top.left != left.width+1 || left.size != top.size {
+		t.Fatal("a vertical split should share the columns of the window it splits")
+	}
+	d.focusDirection(1, 0)
+	if d.bufWindow != top {
+		t.Fatal("focusing right should move to the window on the right")
+	}
+	d.focusDirection(0, 1)
+	if d.bufWindow != bottom || d.cursorPos().line != 40 {
+		t.Fatal("focusing down should move to the window below and restore its cursor")
+	}
+	d.focusDirection(0, 1)
+	if d.bufWindow != bottom {
+		t.Fatal("focusing past the edge should do nothing")
+	}
+
+	size := bottom.size
+	d.resizeWindow(false, 3)
+	if bottom.size != size+3 || top.size+1+bottom.size != d.height-1 {
+		t.Fatal("resizing should take rows from the neighbour")
+	}
+	d.equalizeWindows()
+	if diff := bottom.size - top.size; diff < -1 || diff > 1 {
+		t.Fatalf("equalizing should even out the sizes. Got %d and %d", top.size, bottom.size)
+	}
+
+	d.focusWindow(left)
+	if err := d.closeWindow(); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.windows()) != 2 || d.bufWindow != top || top.width != d.width {
+		t.Fatal("closing a window should give its space back to its neighbour")
+	}
+	d.closeWindow()
+	if err := d.closeWindow(); err == nil || len(d.windows()) != 1 || d.bufWindow.size != d.height-1 {
+		t.Fatal("the last window should not be closed")
+	}
+}
+
+func TestConcurrentEditors(t *testing.T) {
+	for i := range 4 {
+		t.Run(fmt.Sprintf("editor %d", i), func(t *testing.T) {
+			t.Parallel()
+			d := NewDisplay()
+			initTestDisplay(d)
+			d.ActiveBuf.addTestLines(createTestLines(60), d.Highlighter)
+			d.bufWindow.update(0)
+			d.moveToBufPos(position{line: i * 10, col: 0})
+			word := []rune(fmt.Sprintf("editor%d", i))
+			for range 50 {
+				for _, r := range word {
+					d.setRune(r)
+				}
+				d.handleKeyEnter()
+				d.setBufPos()
+			}
+			if pos := d.cursorPos(); pos.line != i*10+50 || pos.col != 0 {
+				t.Fatalf("cursor should be at (%d, 0). Got %+v", i*10+50, pos)
+			}
+			if got := string(d.ActiveBuf.getLine(i*10 + 49).runes); got != string(word) {
+				t.Fatalf("line %d should be %q. Got %q", i*10+49, string(word), got)
+			}
+			for range 100 {
+				d.undoLastEvent()
+			}
+			if d.ActiveBuf.Modified() {
+				t.Fatal("undoing every edit should return to the saved state")
+			}
+		})
+	}
+}
+
+func TestSoftWrap(t *testing.T) {
+	d := NewDisplay()
+	initTestDisplay(d)
+	screen := tcell.NewSimulationScreen("")
+	if err := screen.Init(); err != nil {
+		t.Fatal(err)
+	}
+	screen.SetSize(d.width, d.height)
+	d.Screen = screen
+	long := strings.Repeat("a", 400)
+	d.ActiveBuf.addTestLines([]string{"short", long, "end"}, d.Highlighter)
+	bw := d.bufWindow
+	bw.wrap = true
+	bw.update(0)
+	if bw.lineRows(bw.line(1)) != 3 || bw.rowOf(2) != 4 || bw.capacity != 3+bw.size-5 {
+		t.Fatalf("the long line should take 3 rows. Got %d rows, capacity %d", bw.lineRows(bw.line(1)), bw.capacity)
+	}
+
+	d.moveToBufPos(position{line: 1, col: 200})
+	if x, y := bw.screenCursor(); x != LeftMarginSize+8 || y != 2 {
+		t.Fatalf("cursor should be on the second row of line 2. Got (%d, %d)", x, y)
+	}
+	d.moveCursorScreenDown()
+	if bw.bufPos() != (position{line: 1, col: 392}) {
+		t.Fatalf("gj should move to the next row of the same line. Got %+v", bw.bufPos())
+	}
+	d.moveCursorScreenDown()
+	if bw.bufPos() != (position{line: 2, col: 3}) {
+		t.Fatalf("gj on the last row should move to the next line. Got %+v", bw.bufPos())
+	}
+	d.moveCursorScreenUp()
+	if bw.bufPos() != (position{line: 1, col: 387}) {
+		t.Fatalf("gk should move to the last row of the line above. Got %+v", bw.bufPos())
+	}
+	d.moveCursorUp()
+	d.setBufPos()
+	if bw.pos.Y != 0 {
+		t.Fatalf("k should move by buffer line. Got line %d", bw.pos.Y)
+	}
+
+	d.drawWindows()
+	cellRune := func(x, y int) rune {
+		r, _, _, _ := screen.GetContent(x, y)
+		return r
+	}
+	if cellRune(LeftMarginSize, 3) != 'a' || cellRune(LeftMarginSize+15, 3) != 'a' || cellRune(LeftMarginSize+16, 3) != ' ' {
+		t.Fatal("the long line should carry on onto its third row")
+	}
+	if cellRune(4, 2) != wrapMarker || cellRune(4, 3) != wrapMarker || cellRune(4, 4) != '3' {
+		t.Fatal("continuation rows should be marked in the gutter")
+	}
+}
+
+func TestWindowLocalWrap(t *testing.T) {
+	d := NewDisplay()
+	initTestDisplay(d)
+	d.ActiveBuf.addTestLines([]string{strings.Repeat("a", 400)}, d.Highlighter)
+	d.InitBufWindow()
+	d.Mode = Normal
+	d.splitWindow(true)
+	top, other := d.bufWindow, d.windows()[1]
+	if err := d.runCommandLine("set wrap"); err != nil {
+		t.Fatal(err)
+	}
+	if !top.wraps() || other.wraps() {
+		t.Fatal(":set wrap should only wrap the focused window")
+	}
+	d.splitWindow(false)
+	if !d.bufWindow.wraps() {
+		t.Fatal("a split should start with the wrapping of the window it splits")
+	}
+	d.focusWindow(other)
+	d.toggleWrap()
+	d.runCommandLine("set nowrap")
+	if other.wraps() || !top.wraps() {
+		t.Fatal(":set nowrap should only stop the focused window wrapping")
+	}
+	d.toggleWrap()
+	if !other.wraps() {
+		t.Fatal("toggling wrap should change the focused window")
+	}
+}
+
+func TestSoftWrapScrolling(t *testing.T) {
+	d := NewDisplay()
+	initTestDisplay(d)
+	lines := []string{}
+	for i := range 30 {
+		lines = append(lines, fmt.Sprintf("%d %s", i, strings.Repeat("b", 400)))
+	}
+	d.ActiveBuf.addTestLines(lines, d.Highlighter)
+	bw := d.bufWindow
+	bw.wrap = true
+	bw.update(0)
+	if bw.length() != 16 || bw.capacity != 16 {
+		t.Fatalf("16 lines of 3 rows should fit. Got %d lines, capacity %d", bw.length(), bw.capacity)
+	}
+	for i := 1; i < 30; i++ {
+		d.moveCursorDown()
+		d.setBufPos()
+		d.keepCursorInView()
+		if bw.pos.Y != i || bw.cur.Y < 0 || bw.cur.Y >= bw.length() {
+			t.Fatalf("moving down to line %d should keep the cursor in view. Got line %d at window line %d of %d", i, bw.pos.Y, bw.cur.Y, bw.length())
+		}
+	}
+	if bw.bufIdx != 14 {
+		t.Fatalf("the window should stop scrolling at the end of the buffer. Got start %d", bw.bufIdx)
+	}
+	d.moveCursorDown()
+	d.setBufPos()
+	if bw.pos.Y != 29 {
+		t.Fatal("the cursor should not move past the last line")
+	}
+}
+
+func TestHorizontalScroll(t *testing.T) {
+	d := NewDisplay()
+	initTestDisplay(d)
+	screen := tcell.NewSimulationScreen("")
+	if err := screen.Init(); err != nil {
+		t.Fatal(err)
+	}
+	screen.SetSize(d.width, d.height)
+	d.Screen = screen
+	digits := []rune{}
+	for i := range 500 {
+		digits = append(digits, rune('0'+i%10))
+	}
+	d.ActiveBuf.addTestLines([]string{string(digits), "short"}, d.Highlighter)
+	bw := d.bufWindow
+	bw.update(0)
+	cellRune := func(x, y int) rune {
+		r, _, _, _ := screen.GetContent(x, y)
+		return r
+	}
+
+	d.moveToBufPos(position{line: 0, col: 300})
+	d.keepCursorInView()
+	if bw.leftCol != 300-bw.textWidth()+6 {
+		t.Fatalf("the window should scroll to keep 5 columns right of the cursor. Got offset %d", bw.leftCol)
+	}
+	if x, _ := bw.screenCursor(); x != bw.width-6 {
+		t.Fatalf("cursor should be drawn 5 columns from the right edge. Got %d", x)
+	}
+	if cellRune(LeftMarginSize, 0) != '<' || cellRune(bw.width-1, 0) != '>' {
+		t.Fatal("a line running off both edges should get overflow markers")
+	}
+	if want := rune('0' + (bw.leftCol+1)%10); cellRune(LeftMarginSize+1, 0) != want {
+		t.Fatalf("the text should be drawn from the offset. Got %q, want %q", cellRune(LeftMarginSize+1, 0), want)
+	}
+	if cellRune(LeftMarginSize, 1) != '<' || cellRune(LeftMarginSize+1, 1) != ' ' {
+		t.Fatal("a line scrolled out of view should only show the left marker")
+	}
+
+	d.moveCursorRight()
+	d.setBufPos()
+	d.keepCursorInView()
+	if x, _ := bw.screenCursor(); x != bw.width-6 {
+		t.Fatalf("moving right should keep the cursor off the edge. Got %d", x)
+	}
+
+	d.setCursorIndex(0)
+	d.keepCursorInView()
+	if bw.leftCol != 0 || cellRune(LeftMarginSize, 0) != '0' || cellRune(bw.width-1, 0) != '>' {
+		t.Fatal("moving back to the start should scroll back")
+	}
+
+	if err := d.ActiveBuf.SetOption("siso", "0"); err != nil {
+		t.Fatal(err)
+	}
+	d.setCursorIndex(bw.textWidth())
+	d.keepCursorInView()
+	if bw.leftCol != 1 {
+		t.Fatalf("without a margin the window should scroll by one column. Got %d", bw.leftCol)
+	}
+}
+
+func TestWideCharacters(t *testing.T) {
+	d := NewDisplay()
+	initTestDisplay(d)
+	screen := tcell.NewSimulationScreen("")
+	if err := screen.Init(); err != nil {
+		t.Fatal(err)
+	}
+	screen.SetSize(d.width, d.height)
+	d.Screen = screen
+	family := "\U0001F468‍\U0001F469‍\U0001F467"
+	d.ActiveBuf.addTestLines([]string{"a中b", "e\u0301x", family + " ok", "a" + strings.Repeat("中", 100)}, d.Highlighter)
+	bw := d.bufWindow
+	bw.update(0)
+
+	line := d.ActiveBuf.getLine(0)
+	if line.displayWidth(8) != 4 || line.colAt(2, 8) != 3 || line.indexAt(2, 8) != 1 {
+		t.Fatal("a wide rune should take up two columns")
+	}
+	d.moveToBufPos(position{line: 0, col: 0})
+	d.moveCursorRight()
+	d.moveCursorRight()
+	if bw.pos.X != 2 || bw.cur.X != LeftMarginSize+3 {
+		t.Fatalf("moving right should step over the wide rune. Got index %d, col %d", bw.pos.X, bw.cur.X)
+	}
+	if col := d.statusColumn(line); col != "3-4" {
+		t.Fatalf("the status column should show the cluster and screen column. Got %q", col)
+	}
+	d.moveCursorLeft()
+	if bw.pos.X != 1 || bw.cur.X != LeftMarginSize+1 {
+		t.Fatalf("moving left should land on the wide rune. Got index %d, col %d", bw.pos.X, bw.cur.X)
+	}
+
+	d.moveToBufPos(position{line: 1, col: 0})
+	d.moveCursorRight()
+	if bw.pos.X != 2 || bw.cur.X != LeftMarginSize+1 {
+		t.Fatalf("a combining mark should move with its base rune. Got index %d, col %d", bw.pos.X, bw.cur.X)
+	}
+	d.handleKeyBackspace()
+	if got := string(d.ActiveBuf.getLine(1).runes); got != "x" {
+		t.Fatalf("backspace should delete the whole cluster. Got %q", got)
+	}
+
+	d.moveToBufPos(position{line: 2, col: 0})
+	d.moveCursorRight()
+	if bw.pos.X != 5 || bw.cur.X != LeftMarginSize+2 {
+		t.Fatalf("an emoji sequence should be one cluster. Got index %d, col %d", bw.pos.X, bw.cur.X)
+	}
+	d.moveToBufPos(position{line: 2, col: 0})
+	d.moveCursorToNextWord()
+	if bw.pos.X != 6 {
+		t.Fatalf("the next word should start after the emoji. Got index %d", bw.pos.X)
+	}
+	d.moveCursorToPrevWord()
+	if bw.pos.X != 0 {
+		t.Fatalf("the previous word should be the emoji. Got index %d", bw.pos.X)
+	}
+
+	d.ActiveBuf.getLine(1).runes = []rune("e\u0301")
+	d.drawWindow(bw)
+	cell := func(x, y int) (rune, []rune) {
+		r, comb, _, _ := screen.GetContent(x, y)
+		return r, comb
+	}
+	if r, comb := cell(LeftMarginSize, 1); r != 'e' || string(comb) != "\u0301" {
+		t.Fatalf("a combining mark should be drawn in the cell of its base rune. Got %q %q", r, comb)
+	}
+	if r, _ := cell(LeftMarginSize+1, 0); r != '中' {
+		t.Fatalf("the wide rune should be drawn in one cell. Got %q", r)
+	}
+	if r, _ := cell(LeftMarginSize+3, 0); r != 'b' {
+		t.Fatalf("the rune after a wide rune should be drawn two columns on. Got %q", r)
+	}
+
+	bw.wrap = true
+	bw.update(0)
+	last := d.ActiveBuf.getLine(3)
+	if cellIdx := bw.wrapCell(last, last.colAt(96, 8)); cellIdx != bw.textWidth() || bw.lineRows(last) != 2 {
+		t.Fatalf("a wide rune that does not fit at the end of a row should start the next one. Got cell %d", cellIdx)
+	}
+	d.moveToBufPos(position{line: 3, col: 96})
+	if x, y := bw.screenCursor(); x != LeftMarginSize || y != bw.rowOf(3)+1 {
+		t.Fatalf("the cursor should follow the rune onto the next row. Got (%d, %d)", x, y)
+	}
+}
+
+func TestFrame(t *testing.T) {
+	screen := tcell.NewSimulationScreen("")
+	if err := screen.Init(); err != nil {
+		t.Fatal(err)
+	}
+	screen.SetSize(20, 5)
+	f := newFrame(screen)
+	f.Clear()
+	f.Show()
+	if f.written != 100 {
+		t.Fatalf("the first frame should write every cell. Got %d", f.written)
+	}
+	f.written = 0
+	f.Clear()
+	f.SetContent(3, 1, 'x', nil, tcell.StyleDefault)
+	f.Show()
+	if f.written != 1 {
+		t.Fatalf("only the changed cell should be written. Got %d", f.written)
+	}
+	if r, _, _, _ := screen.GetContent(3, 1); r != 'x' {
+		t.Fatalf("the changed cell should reach the screen. Got %q", r)
+	}
+	f.written = 0
+	f.Clear()
+	f.SetContent(3, 1, 'x', nil, tcell.StyleDefault)
+	f.Show()
+	if f.written != 0 {
+		t.Fatalf("redrawing the same cells should write nothing. Got %d", f.written)
+	}
+
+	screen.SetSize(10, 5)
+	f.Show()
+	if f.width != 10 || f.written != 50 {
+		t.Fatalf("a resize should rewrite the smaller screen. Got width %d, %d cells", f.width, f.written)
+	}
+	if r, _, _, _ := f.GetContent(3, 1); r != 'x' {
+		t.Fatal("a resize should keep what fits")
+	}
+}
+
+// countingScreen counts the cells written to the screen underneath it.
+type countingScreen struct {
+	tcell.Screen
+	written int
+}
+
+func (s *countingScreen) SetContent(x, y int, main rune, comb []rune, style tcell.Style) {
+	s.written++
+	s.Screen.SetContent(x, y, main, comb, style)
+}
+
+func BenchmarkTyping(b *testing.B) {
+	for _, name := range []string{"direct", "frame"} {
+		b.Run(name, func(b *testing.B) {
+			sim := tcell.NewSimulationScreen("")
+			if err := sim.Init(); err != nil {
+				b.Fatal(err)
+			}
+			sim.SetSize(200, 50)
+			counter := &countingScreen{Screen: sim}
+			d := NewDisplay()
+			initTestDisplay(d)
+			d.Screen = counter
+			if name == "frame" {
+				d.Screen = newFrame(counter)
+			}
+			d.ActiveBuf.addTestLines(createTestLines(200), d.Highlighter)
+			d.bufWindow.update(0)
+			d.moveToBufPos(position{line: 10, col: 0})
+			d.Mode = Insert
+			d.draw()
+			d.Screen.Show()
+			counter.written = 0
+			b.ResetTimer()
+			for i := range b.N {
+				if i%60 == 59 {
+					d.handleKeyEnter()
+				} else {
+					d.setRune('x')
+				}
+				d.draw()
+				d.Screen.Show()
+			}
+			b.ReportMetric(float64(counter.written)/float64(b.N), "cells/key")
+		})
+	}
+}
+
+func TestResize(t *testing.T) {
+	d := NewDisplay()
+	initTestDisplay(d)
+	sim := tcell.NewSimulationScreen("")
+	if err := sim.Init(); err != nil {
+		t.Fatal(err)
+	}
+	sim.SetSize(d.width, d.height)
+	d.Screen = newFrame(sim)
+	d.ActiveBuf.addTestLines(createTestLines(200), d.Highlighter)
+	d.bufWindow.update(0)
+	d.splitWindow(true)
+	d.moveToBufPos(position{line: 150, col: 3})
+	d.Mode = Insert
+
+	done := make(chan struct{})
+	go func() {
+		d.Run()
+		close(done)
+	}()
+	resize := func(w, h int) {
+		sim.SetSize(w, h)
+		sim.PostEvent(tcell.NewEventResize(w, h))
+	}
+	resize(60, 10)
+	sim.InjectKey(tcell.KeyRune, 'x', tcell.ModNone)
+	resize(100, 40)
+	sim.InjectKey(tcell.KeyCtrlN, 0, tcell.ModNone)
+	sim.InjectKey(tcell.KeyCtrlQ, 0, tcell.ModNone)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the editor should have quit")
+	}
+
+	if d.width != 100 || d.height != 40 {
+		t.Fatalf("the display should take the new size. Got %dx%d", d.width, d.height)
+	}
+	windows := d.windows()
+	if windows[0].size != 39 || windows[0].width+1+windows[1].width != 100 {
+		t.Fatalf("the windows should fill the new size. Got %dx%d and %dx%d", windows[0].width, windows[0].size, windows[1].width, windows[1].size)
+	}
+	bw := d.bufWindow
+	if pos := d.cursorPos(); pos.line != 150 || bw.cur.Y < 0 || bw.cur.Y >= bw.size {
+		t.Fatalf("the cursor should stay on its line and in view. Got %+v at row %d", pos, bw.cur.Y)
+	}
+	if got := string(d.ActiveBuf.getLine(150).runes); got != "150x: this is a test line" {
+		t.Fatalf("typing between resizes should still work. Got %q", got)
+	}
+	if r, _, _, _ := sim.GetContent(0, 39); r != 'N' {
+		t.Fatalf("the status bar should be drawn on the new last row. Got %q", r)
+	}
+}
+
+func TestParseCommandLine(t *testing.T) {
+	tests := []struct {
+		line string
+		name string
+		bang bool
+		args []string
+		err  bool
+	}{
+		{line: ":w", name: "w", args: []string{}},
+		{line: "write! out.txt", name: "write", bang: true, args: []string{"out.txt"}},
+		{line: `saveas "my file.txt"`, name: "saveas", args: []string{"my file.txt"}},
+		{line: `e my\ file.txt`, name: "e", args: []string{"my file.txt"}},
+		{line: "set ts=4 expandtab", name: "set", args: []string{"ts=4", "expandtab"}},
+		{line: "42", name: "42", args: []string{"42"}},
+		{line: "$", name: "$", args: []string{"$"}},
+		{line: "q now", err: true},
+		{line: "w a b", err: true},
+		{line: "frobnicate", err: true},
+		{line: `e "open`, err: true},
+		{line: "w?", err: true},
+	}
+	for _, tt := range tests {
+		_, call, err := parseCommandLine(tt.line)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q should not parse", tt.line)
+			}
+			continue
+		}
+		if err != nil || call.name != tt.name || call.bang != tt.bang || !slices.Equal(call.args, tt.args) {
+			t.Errorf("%q parsed as %+v, %v", tt.line, call, err)
+		}
+	}
+}
+
+func TestCommandLine(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(path, []byte(strings.Repeat("line\n", 30)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDisplay()
+	initTestDisplay(d)
+	if err := d.ActiveBuf.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	d.InitBufWindow()
+	d.Mode = Normal
+	command := func(keys string) {
+		d.runNormalMode(tcell.NewEventKey(tcell.KeyRune, ':', tcell.ModNone))
+		for _, r := range keys {
+			d.runCommandMode(tcell.NewEventKey(tcell.KeyRune, r, tcell.ModNone))
+		}
+		d.runCommandMode(tcell.NewEventKey(tcell.KeyEnter, 0, tcell.ModNone))
+	}
+
+	command("12")
+	if d.cursorPos().line != 11 || d.Mode != Normal {
+		t.Fatalf("a line number should move the cursor to it. Got %+v", d.cursorPos())
+	}
+	d.setRune('x')
+	command("e")
+	if !d.messageIsError || string(d.ActiveBuf.getLine(11).runes) != "xline" {
+		t.Fatal("editing a modified buffer again should fail on the prompt")
+	}
+	command("w")
+	if data, _ := os.ReadFile(path); !strings.Contains(string(data), "xline") || d.ActiveBuf.modified {
+		t.Fatal(":w should write the buffer")
+	}
+	copyPath := filepath.Join(dir, "b.txt")
+	command("saveas " + copyPath)
+	if d.ActiveBuf.path != copyPath || d.messageIsError {
+		t.Fatalf(":saveas should rename the buffer. Got %q, %s", d.ActiveBuf.path, d.message)
+	}
+	command("saveas " + path)
+	if !d.messageIsError || d.ActiveBuf.path != copyPath {
+		t.Fatal(":saveas should not overwrite an existing file without !")
+	}
+
+	d.runNormalMode(tcell.NewEventKey(tcell.KeyRune, ':', tcell.ModNone))
+	d.runCommandMode(tcell.NewEventKey(tcell.KeyUp, 0, tcell.ModNone))
+	if string(d.cmdline.text) != "saveas "+path {
+		t.Fatalf("up should bring back the last command. Got %q", string(d.cmdline.text))
+	}
+	d.runCommandMode(tcell.NewEventKey(tcell.KeyUp, 0, tcell.ModNone))
+	d.runCommandMode(tcell.NewEventKey(tcell.KeyDown, 0, tcell.ModNone))
+	d.runCommandMode(tcell.NewEventKey(tcell.KeyDown, 0, tcell.ModNone))
+	if string(d.cmdline.text) != "" {
+		t.Fatalf("down past the history should return to the empty line. Got %q", string(d.cmdline.text))
+	}
+	for _, r := range "sav" {
+		d.runCommandMode(tcell.NewEventKey(tcell.KeyRune, r, tcell.ModNone))
+	}
+	d.runCommandMode(tcell.NewEventKey(tcell.KeyTab, 0, tcell.ModNone))
+	if string(d.cmdline.text) != "saveas" {
+		t.Fatalf("tab should complete the command name. Got %q", string(d.cmdline.text))
+	}
+	for _, r := range " " + dir + "/a" {
+		d.runCommandMode(tcell.NewEventKey(tcell.KeyRune, r, tcell.ModNone))
+	}
+	d.runCommandMode(tcell.NewEventKey(tcell.KeyTab, 0, tcell.ModNone))
+	if string(d.cmdline.text) != "saveas "+path {
+		t.Fatalf("tab should complete the file name. Got %q", string(d.cmdline.text))
+	}
+	d.runCommandMode(tcell.NewEventKey(tcell.KeyHome, 0, tcell.ModNone))
+	d.runCommandMode(tcell.NewEventKey(tcell.KeyRight, 0, tcell.ModNone))
+	d.setStatusBar()
+	if string(d.StatusBar) != ":saveas "+path || d.commandLineCursor() != 2 {
+		t.Fatalf("the command line should be drawn on the status row. Got %q", string(d.StatusBar))
+	}
+	d.runCommandMode(tcell.NewEventKey(tcell.KeyEscape, 0, tcell.ModNone))
+	if d.Mode != Normal || d.cmdline != nil {
+		t.Fatal("escape should leave the command line")
+	}
+
+	d.setRune('y')
+	command("q")
+	if d.Mode == Exit || !d.messageIsError {
+		t.Fatal(":q should refuse to quit with unsaved changes")
+	}
+	command("wq")
+	if d.Mode != Exit || d.ActiveBuf.modified {
+		t.Fatal(":wq should write and quit")
+	}
+}
+
+func TestSaveAs(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(path, []byte("one\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDisplay()
+	initTestDisplay(d)
+	if err := d.ActiveBuf.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	d.InitBufWindow()
+	d.Mode = Normal
+	buf := d.ActiveBuf
+	d.setRune('x')
+	d.flushSwapFiles()
+	oldSwap, err := buf.swapPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(oldSwap); err != nil {
+		t.Fatal("editing should write a swap file")
+	}
+
+	if err := d.runCommandLine("saveas " + filepath.Join(dir, "missing", "b.py")); err == nil {
+		t.Fatal(":saveas into a missing directory should fail")
+	}
+	if buf.path != path || !buf.modified {
+		t.Fatalf("a failed :saveas should keep the buffer's name. Got %q", buf.path)
+	}
+	if _, err := os.Stat(oldSwap); err != nil {
+		t.Fatal("a failed :saveas should keep the swap file")
+	}
+
+	newPath := filepath.Join(dir, "b.py")
+	if err := d.runCommandLine("saveas " + newPath); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(newPath); string(data) != "xone\n" {
+		t.Fatalf(":saveas should write the new file. Got %q", data)
+	}
+	if buf.path != newPath || buf.modified || !buf.disk.exists {
+		t.Fatal(":saveas should rename the buffer to the file it wrote")
+	}
+	if buf.settings.TabWidth != 4 || !buf.settings.ExpandTab {
+		t.Fatalf(":saveas should take the settings for the new name. Got %+v", buf.settings)
+	}
+	if _, err := os.Stat(oldSwap); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatal(":saveas should remove the old swap file")
+	}
+}
+
+func TestExitWritesOnlyChanges(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	path := filepath.Join(t.TempDir(), "a.txt")
+	if err := os.WriteFile(path, []byte("one\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDisplay()
+	initTestDisplay(d)
+	if err := d.ActiveBuf.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	d.InitBufWindow()
+	d.Mode = Normal
+
+	touchLater(t, path, "changed elsewhere\n")
+	if err := d.runCommandLine("x"); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "changed elsewhere\n" || d.Mode != Exit {
+		t.Fatalf(":x should quit without writing an unchanged buffer. Got %q", data)
+	}
+
+	d.Mode = Normal
+	d.setRune('x')
+	if err := d.runCommandLine("x!"); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "xone\n" || d.Mode != Exit {
+		t.Fatalf(":x should write a changed buffer. Got %q", data)
+	}
+}
+
+func TestVisualMode(t *testing.T) {
+	d := NewDisplay()
+	initTestDisplay(d)
+	screen := tcell.NewSimulationScreen("")
+	if err := screen.Init(); err != nil {
+		t.Fatal(err)
+	}
+	screen.SetSize(d.width, d.height)
+	d.Screen = screen
+	reset := func(lines ...string) {
+		d.ActiveBuf = NewBuffer(d.Highlighter)
+		d.ActiveBuf.addTestLines(lines, d.Highlighter)
+		d.bufWindow.buf = d.ActiveBuf
+		d.InitBufWindow()
+		d.Mode = Normal
+		d.moveToBufPos(position{})
+	}
+	keys := func(s string) {
+		for _, r := range s {
+			ev := tcell.NewEventKey(tcell.KeyRune, r, tcell.ModNone)
+			if d.Mode == Visual {
+				d.runVisualMode(ev)
+			} else {
+				d.runNormalMode(ev)
+			}
+		}
+	}
+	text := func() string {
+		lines := []string{}
+		for _, line := range d.ActiveBuf.content.allLines() {
+			lines = append(lines, string(line.runes))
+		}
+		return strings.Join(lines, "|")
+	}
+
+	reset("one two", "three four", "five")
+	keys("lvjl")
+	if d.Mode != Visual || d.modeName() != "Visual" {
+		t.Fatal("v should start a charwise selection")
+	}
+	d.drawWindow(d.bufWindow)
+	top := d.bufWindow.top
+	_, _, style, _ := screen.GetContent(LeftMarginSize+3, top)
+	_, bg, _ := style.Decompose()
+	_, want, _ := d.SelectionStyle.Decompose()
+	if bg != want {
+		t.Fatal("the selection should be drawn over the selection background")
+	}
+	_, _, style, _ = screen.GetContent(LeftMarginSize, top)
+	if _, bg, _ := style.Decompose(); bg == want {
+		t.Fatal("text before the selection should not be highlighted")
+	}
+	keys("d")
+	if got := text(); got != "oee four|five" || d.Mode != Normal {
+		t.Fatalf("d should delete a charwise selection across lines. Got %q", got)
+	}
+	if string(d.registers.unnamed.text) != "ne two\nthr" || d.registers.unnamed.kind != visualChar {
+		t.Fatalf("the deleted text should be kept. Got %q", string(d.registers.unnamed.text))
+	}
+	d.undoLastEvent()
+	if got := text(); got != "one two|three four|five" {
+		t.Fatalf("a delete should undo in one step. Got %q", got)
+	}
+
+	reset("ab", "cd", "ef")
+	keys("lvjlld")
+	if got := text(); got != "aef" {
+		t.Fatalf("d should join the line after a selection that takes in a line break. Got %q", got)
+	}
+	d.undoLastEvent()
+	if got := text(); got != "ab|cd|ef" {
+		t.Fatalf("undo should bring back the joined line. Got %q", got)
+	}
+
+	reset("one", "two", "three")
+	keys("jVjy")
+	if string(d.registers.unnamed.text) != "two\nthree\n" || d.registers.unnamed.kind != visualLine || d.cursorPos().line != 1 {
+		t.Fatalf("V and y should yank whole lines. Got %q", string(d.registers.unnamed.text))
+	}
+	keys("Vk>")
+	if got := text(); got != "\tone|\ttwo|three" {
+		t.Fatalf("> should indent the selected lines. Got %q", got)
+	}
+	keys("Vj<")
+	if got := text(); got != "one|two|three" {
+		t.Fatalf("< should outdent the selected lines. Got %q", got)
+	}
+	keys("vlU")
+	if got := text(); got != "ONe|two|three" {
+		t.Fatalf("U should upper-case the selection. Got %q", got)
+	}
+	keys("Vj~")
+	if got := text(); got != "onE|TWO|three" {
+		t.Fatalf("~ should toggle case. Got %q", got)
+	}
+	keys("jVd")
+	if got := text(); got != "onE|three" {
+		t.Fatalf("d should delete whole lines. Got %q", got)
+	}
+
+	reset("abcdef", "ab", "abcdef")
+	keys("l")
+	d.runNormalMode(tcell.NewEventKey(tcell.KeyCtrlV, 0, tcell.ModNone))
+	keys("jjll")
+	if d.modeName() != "Visual Block" {
+		t.Fatal("Ctrl-V should start a block selection")
+	}
+	keys("y")
+	if string(d.registers.unnamed.text) != "bcd\nb\nbcd\n" || d.registers.unnamed.kind != visualBlock {
+		t.Fatalf("a block should be yanked row by row. Got %q", string(d.registers.unnamed.text))
+	}
+	d.runNormalMode(tcell.NewEventKey(tcell.KeyCtrlV, 0, tcell.ModNone))
+	keys("jjllc")
+	if got := text(); got != "aef|a|aef" || d.Mode != Insert {
+		t.Fatalf("c should delete the block and start insert mode. Got %q", got)
+	}
+	d.setRune('X')
+	d.runInsertMode(tcell.NewEventKey(tcell.KeyCtrlN, 0, tcell.ModNone))
+	if got := text(); got != "aXef|aX|aXef" {
+		t.Fatalf("text typed into a changed block should go on each line. Got %q", got)
+	}
+
+	reset("one", "two")
+	keys("Vjc")
+	if got := text(); got != "" || d.Mode != Insert {
+		t.Fatalf("c should replace selected lines with an empty one. Got %q", got)
+	}
+}
+
+func TestRegisters(t *testing.T) {
+	d := NewDisplay()
+	initTestDisplay(d)
+	d.ActiveBuf.addTestLines([]string{"one", "two", "three"}, d.Highlighter)
+	d.InitBufWindow()
+	d.Mode = Normal
+	d.moveToBufPos(position{})
+	keys := func(s string) {
+		for _, r := range s {
+			ev := tcell.NewEventKey(tcell.KeyRune, r, tcell.ModNone)
+			switch d.Mode {
+			case Visual:
+				d.runVisualMode(ev)
+			case Register:
+				d.runRegisterMode(ev)
+			default:
+				d.runNormalMode(ev)
+			}
+			d.setBufPos()
+		}
+	}
+	text := func() string {
+		lines := []string{}
+		for _, line := range d.ActiveBuf.content.allLines() {
+			lines = append(lines, string(line.runes))
+		}
+		return strings.Join(lines, "|")
+	}
+
+	keys(`V"ayjV"Ay`)
+	if reg, _ := d.registers.get('a'); string(reg.text) != "one\ntwo\n" || reg.kind != visualLine {
+		t.Fatalf("an upper-case name should append to the register. Got %q", string(reg.text))
+	}
+	keys(`"ap`)
+	if got := text(); got != "one|two|one|two|three" || d.cursorPos().line != 2 {
+		t.Fatalf("p should paste lines below the cursor line. Got %q", got)
+	}
+	d.undoLastEvent()
+	if got := text(); got != "one|two|three" {
+		t.Fatalf("a paste should undo in one step. Got %q", got)
+	}
+	keys("kP")
+	if got := text(); got != "one|two|one|two|three" || d.cursorPos().line != 0 {
+		t.Fatalf("P should paste lines above the cursor line. Got %q", got)
+	}
+	d.undoLastEvent()
+
+	d.moveToBufPos(position{line: 0})
+	keys("vly")
+	d.moveToBufPos(position{line: 2})
+	keys("p")
+	if got := text(); got != "one|two|tonhree" || d.cursorPos() != (position{line: 2, col: 2}) {
+		t.Fatalf("p should paste characters after the cursor. Got %q at %+v", got, d.cursorPos())
+	}
+	keys(`"1P`)
+	if got := text(); got != "one|two|one|two|tonhree" {
+		t.Fatalf("\"1 should hold the yank before the last one. Got %q", got)
+	}
+	d.undoLastEvent()
+	d.undoLastEvent()
+
+	keys(`"bp`)
+	if !d.messageIsError || text() != "one|two|three" {
+		t.Fatal("pasting an empty register should fail")
+	}
+	d.moveToBufPos(position{line: 1})
+	keys("dd")
+	if got := text(); got != "one|three" {
+		t.Fatalf("dl should delete the line. Got %q", got)
+	}
+	keys("P")
+	if got := text(); got != "one|two|three" {
+		t.Fatalf("a deleted line should be pasted back. Got %q", got)
+	}
+
+	d.moveToBufPos(position{line: 0})
+	d.runNormalMode(tcell.NewEventKey(tcell.KeyCtrlV, 0, tcell.ModNone))
+	keys("jly")
+	d.moveToBufPos(position{line: 1, col: 2})
+	keys("p")
+	if got := text(); got != "one|twoon|thrtwee" {
+		t.Fatalf("a block should be pasted into the lines below. Got %q", got)
+	}
+	d.undoLastEvent()
+	d.moveToBufPos(position{line: 2, col: 4})
+	keys("p")
+	if got := text(); got != "one|two|threeon|     tw" {
+		t.Fatalf("a block past the end should add lines padded to the column. Got %q", got)
+	}
+}
+
+// ttyScreen is a simulation screen with a terminal to write escape sequences
+// to.
+type ttyScreen struct {
+	tcell.SimulationScreen
+	tty *fakeTty
+}
+
+func (s ttyScreen) Tty() (tcell.Tty, bool) {
+	return s.tty, true
+}
+
+type fakeTty struct {
+	tcell.Tty
+	out bytes.Buffer
+}
+
+func (t *fakeTty) Write(p []byte) (int, error) {
+	return t.out.Write(p)
+}
+
+func TestClipboard(t *testing.T) {
+	t.Setenv("WAYLAND_DISPLAY", "")
+	t.Setenv("DISPLAY", "")
+	d := NewDisplay()
+	initTestDisplay(d)
+	sim := tcell.NewSimulationScreen("")
+	if err := sim.Init(); err != nil {
+		t.Fatal(err)
+	}
+	sim.SetSize(d.width, d.height)
+	tty := &fakeTty{}
+	d.Screen = newFrame(ttyScreen{sim, tty})
+	d.ActiveBuf.addTestLines([]string{"one", "two"}, d.Highlighter)
+	d.InitBufWindow()
+	d.Mode = Normal
+	d.moveToBufPos(position{})
+	keys := func(s string) {
+		for _, r := range s {
+			ev := tcell.NewEventKey(tcell.KeyRune, r, tcell.ModNone)
+			switch d.Mode {
+			case Visual:
+				d.runVisualMode(ev)
+			case Register:
+				d.runRegisterMode(ev)
+			default:
+				d.runNormalMode(ev)
+			}
+			d.setBufPos()
+		}
+	}
+	text := func() string {
+		lines := []string{}
+		for _, line := range d.ActiveBuf.content.allLines() {
+			lines = append(lines, string(line.runes))
+		}
+		return strings.Join(lines, "|")
+	}
+
+	keys(`V"+y`)
+	if got, want := tty.out.String(), "\x1b]52;c;"+base64.StdEncoding.EncodeToString([]byte("one\n"))+"\a"; got != want {
+		t.Fatalf("yanking to \"+ should write OSC 52 to the terminal. Got %q", got)
+	}
+	keys(`j"*p`)
+	if got := text(); got != "one|two|one" {
+		t.Fatalf("without a clipboard tool \"+ should read back what was copied. Got %q", got)
+	}
+
+	tty.out.Reset()
+	if err := d.runCommandLine("set clipboard=off"); err != nil {
+		t.Fatal(err)
+	}
+	keys(`V"+y`)
+	if tty.out.Len() != 0 || d.messageIsError {
+		t.Fatal("with the clipboard off nothing should reach the terminal")
+	}
+	if err := d.runCommandLine("set clipboard=primary"); err == nil {
+		t.Fatal("an unknown clipboard mode should be refused")
+	}
+
+	dir := t.TempDir()
+	clip := filepath.Join(dir, "clip")
+	scripts := map[string]string{
+		"wl-copy":  "#!/bin/sh\ncat > " + clip + "\n",
+		"wl-paste": "#!/bin/sh\nprintf 'from tool'\n",
+	}
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("WAYLAND_DISPLAY", "wayland-0")
+	if err := d.runCommandLine("set clipboard=tool"); err != nil {
+		t.Fatal(err)
+	}
+	d.moveToBufPos(position{line: 1})
+	keys(`V"+y`)
+	if data, err := os.ReadFile(clip); err != nil || string(data) != "two\n" || tty.out.Len() != 0 {
+		t.Fatalf("a clipboard tool should get the text instead of the terminal. Got %q", string(data))
+	}
+	keys(`"+P`)
+	if got := text(); got != "one|from tooltwo|one" {
+		t.Fatalf("\"+ should read from the clipboard tool. Got %q", got)
+	}
+
+	d.Screen = sim
+	if err := d.runCommandLine("set clipboard=osc52"); err != nil {
+		t.Fatal(err)
+	}
+	keys(`V"+y`)
+	if !d.messageIsError {
+		t.Fatal("copying with no terminal to write to should fail")
+	}
+}
+
+func TestClipboardOSC52Bytes(t *testing.T) {
+	t.Setenv("WAYLAND_DISPLAY", "")
+	t.Setenv("DISPLAY", "")
+	d := NewDisplay()
+	initTestDisplay(d)
+	var out bytes.Buffer
+	d.tty = &out
+	d.ActiveBuf.addTestLines([]string{"héllo 日本"}, d.Highlighter)
+	d.InitBufWindow()
+	d.Mode = Normal
+	d.moveToBufPos(position{})
+	if err := d.runCommandLine("set clipboard=osc52"); err != nil {
+		t.Fatal(err)
+	}
+	d.runNormalMode(tcell.NewEventKey(tcell.KeyRune, '"', tcell.ModNone))
+	d.runRegisterMode(tcell.NewEventKey(tcell.KeyRune, '+', tcell.ModNone))
+	for _, r := range "yy" {
+		d.runNormalMode(tcell.NewEventKey(tcell.KeyRune, r, tcell.ModNone))
+	}
+	want := "\x1b]52;c;aMOpbGxvIOaXpeacrAo=\a"
+	if got := out.String(); got != want || d.messageIsError {
+		t.Fatalf("yanking to \"+ should write OSC 52 with the text in base64. Got %q, want %q", got, want)
+	}
+}
+
+func TestBracketedPaste(t *testing.T) {
+	d := NewDisplay()
+	initTestDisplay(d)
+	d.ActiveBuf.addTestLines([]string{"ab"}, d.Highlighter)
+	d.InitBufWindow()
+	d.moveToBufPos(position{line: 0, col: 1})
+	d.Mode = Insert
+
+	d.startPaste()
+	for _, ev := range []*tcell.EventKey{
+		tcell.NewEventKey(tcell.KeyRune, 'x', tcell.ModNone),
+		tcell.NewEventKey(tcell.KeyEnter, '\r', tcell.ModNone),
+		tcell.NewEventKey(tcell.KeyRune, 'j', tcell.ModNone),
+	} {
+		d.collectPaste(ev)
+	}
+	d.finishPaste()
+	if got := string(d.ActiveBuf.getLine(0).runes) + "|" + string(d.ActiveBuf.getLine(1).runes); got != "ax|jb" {
+		t.Fatalf("pasted keys should go in as text. Got %q", got)
+	}
+	if d.cursorPos() != (position{line: 1, col: 1}) || d.Mode != Insert {
+		t.Fatalf("the cursor should end up after the pasted text. Got %+v", d.cursorPos())
+	}
+	if string(d.clipboard.last) != "x\nj" {
+		t.Fatal("pasted text should be what the clipboard register reads")
+	}
+}
+
+func TestOperators(t *testing.T) {
+	d := NewDisplay()
+	initTestDisplay(d)
+	screen := tcell.NewSimulationScreen("")
+	if err := screen.Init(); err != nil {
+		t.Fatal(err)
+	}
+	screen.SetSize(d.width, d.height)
+	d.Screen = screen
+	reset := func(lines ...string) {
+		d.ActiveBuf = NewBuffer(d.Highlighter)
+		d.ActiveBuf.addTestLines(lines, d.Highlighter)
+		d.bufWindow.buf = d.ActiveBuf
+		d.InitBufWindow()
+		d.Mode = Normal
+		d.cancelPending()
+		d.moveToBufPos(position{})
+	}
+	keys := func(s string) {
+		for _, r := range s {
+			ev := tcell.NewEventKey(tcell.KeyRune, r, tcell.ModNone)
+			if d.Mode == Register {
+				d.runRegisterMode(ev)
+			} else {
+				d.runNormalMode(ev)
+			}
+			d.setBufPos()
+		}
+	}
+	text := func() string {
+		lines := []string{}
+		for _, line := range d.ActiveBuf.content.allLines() {
+			lines = append(lines, string(line.runes))
+		}
+		return strings.Join(lines, "|")
+	}
+	unnamed := func() string {
+		return string(d.registers.unnamed.text)
+	}
+
+	reset("a", "b", "c", "d", "e", "f", "g")
+	keys("5j")
+	if d.cursorPos().line != 5 {
+		t.Fatalf("5j should move down five lines. Got line %d", d.cursorPos().line)
+	}
+	keys("2k")
+	if d.cursorPos().line != 3 {
+		t.Fatalf("2k should move up two lines. Got line %d", d.cursorPos().line)
+	}
+	keys("10j")
+	if d.cursorPos().line != 6 {
+		t.Fatalf("a count past the end should stop on the last line. Got line %d", d.cursorPos().line)
+	}
+
+	reset("one two three four")
+	keys("3w")
+	if d.cursorPos().col != 14 {
+		t.Fatalf("3w should move to the third word on. Got col %d", d.cursorPos().col)
+	}
+	keys("2b")
+	if d.cursorPos().col != 4 {
+		t.Fatalf("2b should move back two words. Got col %d", d.cursorPos().col)
+	}
+	keys("2l")
+	if d.cursorPos().col != 6 {
+		t.Fatalf("2l should move right twice. Got col %d", d.cursorPos().col)
+	}
+	keys("h")
+	if d.cursorPos().col != 5 {
+		t.Fatalf("h should move left. Got col %d", d.cursorPos().col)
+	}
+
+	reset("one two three")
+	keys("dw")
+	if got := text(); got != "two three" || unnamed() != "one " || d.registers.unnamed.kind != visualChar {
+		t.Fatalf("dw should delete to the next word. Got %q, %q", got, unnamed())
+	}
+	d.undoLastEvent()
+	if got := text(); got != "one two three" {
+		t.Fatalf("dw should undo in one step. Got %q", got)
+	}
+	keys("d2w")
+	if got := text(); got != "three" {
+		t.Fatalf("d2w should delete two words. Got %q", got)
+	}
+	reset("one two three")
+	keys("2dw")
+	if got := text(); got != "three" {
+		t.Fatalf("2dw should delete two words. Got %q", got)
+	}
+	reset("a b c d e f")
+	keys("2d2w")
+	if got := text(); got != "e f" {
+		t.Fatalf("the counts before and after the operator should multiply. Got %q", got)
+	}
+	reset("one two")
+	keys("wdw")
+	if got := text(); got != "one " {
+		t.Fatalf("dw on the last word should delete to the end of the line. Got %q", got)
+	}
+	reset("one", "two")
+	keys("dw")
+	if got := text(); got != "|two" {
+		t.Fatalf("dw at the end of a line should not join the next one. Got %q", got)
+	}
+	reset("foo", "")
+	keys("w")
+	if d.cursorPos().line != 1 {
+		t.Fatalf("w should stop on an empty line. Got line %d", d.cursorPos().line)
+	}
+	keys("w")
+	if d.cursorPos().line != 1 {
+		t.Fatalf("w on the last line should stay there. Got line %d", d.cursorPos().line)
+	}
+	reset("foo bar", "", "")
+	keys("3w")
+	if pos := d.cursorPos(); pos.line != 2 || pos.col != 0 {
+		t.Fatalf("3w should count empty lines as words. Got %v", pos)
+	}
+	reset("foo", "   ", "bar")
+	keys("w")
+	if pos := d.cursorPos(); pos.line != 2 || pos.col != 0 {
+		t.Fatalf("w should pass over a line of blanks. Got %v", pos)
+	}
+	reset("foo", "")
+	keys("dw")
+	if got := text(); got != "|" {
+		t.Fatalf("dw before an empty last line should delete the word. Got %q", got)
+	}
+	reset("foo bar", "", "")
+	keys("d3w")
+	if got := text(); got != "|" {
+		t.Fatalf("d3w should delete through the empty lines it moves over. Got %q", got)
+	}
+	reset("one", "  two")
+	keys("dw")
+	if got := text(); got != "|  two" {
+		t.Fatalf("dw on the last word of a line should not delete the line break. Got %q", got)
+	}
+	reset("one", "  two")
+	keys("cw")
+	if got := text(); got != "|  two" || d.Mode != Insert || d.cursorPos().line != 0 {
+		t.Fatalf("cw on the last word of a line should only change the word. Got %q", got)
+	}
+	reset("one two", "three", "  four")
+	keys("d3w")
+	if got := text(); got != "|  four" {
+		t.Fatalf("d3w should stop at the end of the line before the word it ends on. Got %q", got)
+	}
+	reset("abc")
+	keys("ldl")
+	if got := text(); got != "ac" {
+		t.Fatalf("dl should delete the character under the cursor. Got %q", got)
+	}
+	keys("dh")
+	if got := text(); got != "c" {
+		t.Fatalf("dh should delete the character before the cursor. Got %q", got)
+	}
+
+	reset("a", "b", "c", "d", "e")
+	keys("j3dd")
+	if got := text(); got != "a|e" || unnamed() != "b\nc\nd\n" || d.registers.unnamed.kind != visualLine {
+		t.Fatalf("3dd should delete three lines. Got %q, %q", got, unnamed())
+	}
+	keys("j9dd")
+	if got := text(); got != "a" {
+		t.Fatalf("a count past the end should delete to the last line. Got %q", got)
+	}
+	reset("a", "b", "c", "d")
+	keys("jdj")
+	if got := text(); got != "a|d" {
+		t.Fatalf("dj should delete the cursor line and the one below. Got %q", got)
+	}
+	reset("a", "b", "c")
+	keys("jjdk")
+	if got := text(); got != "a" {
+		t.Fatalf("dk should delete the cursor line and the one above. Got %q", got)
+	}
+
+	reset("one", "two")
+	keys("cc")
+	if got := text(); got != "|two" || d.Mode != Insert {
+		t.Fatalf("cc should empty the line and start insert mode. Got %q", got)
+	}
+	reset("one two")
+	keys("cw")
+	if got := text(); got != " two" || d.Mode != Insert || d.cursorPos().col != 0 {
+		t.Fatalf("cw should change up to the end of the word and start insert mode. Got %q", got)
+	}
+	reset("one two", "three four")
+	keys("2cw")
+	if got := text(); got != "|three four" {
+		t.Fatalf("2cw should change up to the end of the second word. Got %q", got)
+	}
+	reset("one two", "three four")
+	keys("3cw")
+	if got := text(); got != " four" {
+		t.Fatalf("3cw should change across the line break. Got %q", got)
+	}
+	reset("one  two")
+	keys("lllcw")
+	if got := text(); got != "onetwo" {
+		t.Fatalf("cw on blanks should change them as dw would. Got %q", got)
+	}
+
+	reset("one", "two")
+	keys("yyp")
+	if got := text(); got != "one|one|two" {
+		t.Fatalf("yy should yank the line. Got %q", got)
+	}
+	reset("x")
+	keys("yy3p")
+	if got := text(); got != "x|x|x|x" {
+		t.Fatalf("3p should paste three times. Got %q", got)
+	}
+	reset("one two")
+	keys(`"ay2w`)
+	if reg, _ := d.registers.get('a'); string(reg.text) != "one two" || d.cursorPos().col != 0 {
+		t.Fatalf("y should yank into the register given and leave the cursor. Got %q", string(reg.text))
+	}
+
+	reset("one", "two", "three")
+	keys("2>>")
+	if got := text(); got != "\tone|\ttwo|three" {
+		t.Fatalf("2>> should indent two lines. Got %q", got)
+	}
+	keys("<<")
+	if got := text(); got != "one|\ttwo|three" {
+		t.Fatalf("<< should outdent the line. Got %q", got)
+	}
+	keys(">j")
+	if got := text(); got != "\tone|\t\ttwo|three" {
+		t.Fatalf(">j should indent two lines. Got %q", got)
+	}
+
+	reset("foo bar baz")
+	keys("wdiw")
+	if got := text(); got != "foo  baz" {
+		t.Fatalf("diw should delete the word. Got %q", got)
+	}
+	reset("foo bar baz")
+	keys("wdaw")
+	if got := text(); got != "foo baz" {
+		t.Fatalf("daw should delete the word and the space after it. Got %q", got)
+	}
+	reset("foo bar")
+	keys("wdaw")
+	if got := text(); got != "foo" {
+		t.Fatalf("daw on the last word should take the space before it. Got %q", got)
+	}
+	reset("foo bar")
+	keys("wciw")
+	if got := text(); got != "foo " || d.Mode != Insert {
+		t.Fatalf("ciw should delete the word and start insert mode. Got %q", got)
+	}
+	reset("f(a, b) x")
+	keys("llci(")
+	if got := text(); got != "f() x" || d.Mode != Insert || d.cursorPos().col != 2 {
+		t.Fatalf("ci( should change the text in the parentheses. Got %q", got)
+	}
+	reset("f(a, (b)) x")
+	keys("8ldib")
+	if got := text(); got != "f() x" {
+		t.Fatalf("dib on a closing parenthesis should delete what it closes. Got %q", got)
+	}
+	reset("f(a, b) x")
+	keys("lda(")
+	if got := text(); got != "f x" {
+		t.Fatalf("da( should delete the parentheses too. Got %q", got)
+	}
+	reset(`x "hi there" y`)
+	keys(`da"`)
+	if got := text(); got != "x  y" {
+		t.Fatalf(`da" should delete the quoted text and its quotes. Got %q`, got)
+	}
+	reset(`x "hi there" y`)
+	keys(`yi"`)
+	if unnamed() != "hi there" {
+		t.Fatalf(`yi" should yank the quoted text. Got %q`, unnamed())
+	}
+	reset("if x {", "\ta", "\tb", "}", "z")
+	keys("jdi{")
+	if got := text(); got != "if x {|}|z" || d.registers.unnamed.kind != visualLine {
+		t.Fatalf("di{ should delete the lines of a block. Got %q", got)
+	}
+	reset("if x {", "\ta", "}", "z")
+	keys("jdaB")
+	if got := text(); got != "if x |z" {
+		t.Fatalf("daB should delete the block with its braces. Got %q", got)
+	}
+
+	reset("a", "b", "c")
+	keys("gj")
+	if d.cursorPos().line != 1 {
+		t.Fatalf("gj should move down a row. Got line %d", d.cursorPos().line)
+	}
+	keys("gk")
+	if d.cursorPos().line != 0 {
+		t.Fatalf("gk should move up a row. Got line %d", d.cursorPos().line)
+	}
+	keys("2gj")
+	if d.cursorPos().line != 2 {
+		t.Fatalf("2gj should move down two rows. Got line %d", d.cursorPos().line)
+	}
+
+	reset("a", "b", "c")
+	keys(`"a2d`)
+	d.clearMessage()
+	d.setStatusBar()
+	if !strings.HasSuffix(string(d.StatusBar), `"a2d`) {
+		t.Fatalf("a partly typed command should show in the status bar. Got %q", string(d.StatusBar))
+	}
+	d.runNormalMode(tcell.NewEventKey(tcell.KeyEscape, 0, tcell.ModNone))
+	if d.pending.active() || d.register != 0 {
+		t.Fatal("Esc should cancel a partly typed command")
+	}
+	keys("j")
+	if got := text(); got != "a|b|c" || d.cursorPos().line != 1 {
+		t.Fatalf("keys after Esc should start a new command. Got %q", got)
+	}
+	keys("dz")
+	if d.pending.active() {
+		t.Fatal("a key that ends no command should cancel it")
+	}
+	keys("k")
+	if got := text(); got != "a|b|c" || d.cursorPos().line != 0 {
+		t.Fatalf("a cancelled operator should not run. Got %q", got)
+	}
+
+	keys("3d")
+	seq := d.pending.seq
+	d.handleInterrupt(tcell.NewEventInterrupt(pendingTimedOut{seq - 1}))
+	if !d.pending.active() {
+		t.Fatal("a timeout for an earlier key should be ignored")
+	}
+	d.handleInterrupt(tcell.NewEventInterrupt(pendingTimedOut{seq}))
+	if d.pending.active() {
+		t.Fatal("a command should be cancelled when its next key takes too long")
+	}
+	keys("j")
+	if got := text(); got != "a|b|c" || d.cursorPos().line != 1 {
+		t.Fatalf("a timed out command should not run. Got %q", got)
 	}
 }
@@ -0,0 +1,150 @@
+package display
+
+import (
+	"github.com/cyamas/rizz/internal/highlighter"
+	"github.com/cyamas/rizz/internal/highlighter/token"
+)
+
+type position struct {
+	line int
+	col  int
+}
+
+type editKind int
+
+const (
+	INSERT_SPAN editKind = iota
+	DELETE_SPAN
+	REPLACE_SPAN
+)
+
+// Edit replaces oldText with newText at pos. Both texts may span lines, with
+// '\n' ending each line, so joining, splitting and removing lines are edits
+// like any other.
+type Edit struct {
+	kind    editKind
+	pos     position
+	oldText []rune
+	newText []rune
+}
+
+func newEdit(pos position, oldText, newText []rune) *Edit {
+	kind := REPLACE_SPAN
+	switch {
+	case len(oldText) == 0:
+		kind = INSERT_SPAN
+	case len(newText) == 0:
+		kind = DELETE_SPAN
+	}
+	return &Edit{
+		kind:    kind,
+		pos:     pos,
+		oldText: append([]rune(nil), oldText...),
+		newText: append([]rune(nil), newText...),
+	}
+}
+
+func (e *Edit) apply(la *LineArray, h *highlighter.Highlighter) {
+	la.replaceText(h, e.pos, e.oldText, e.newText)
+}
+
+func (e *Edit) revert(la *LineArray, h *highlighter.Highlighter) {
+	la.replaceText(h, e.pos, e.newText, e.oldText)
+}
+
+// advance returns the position just past text when it is placed at pos.
+func advance(pos position, text []rune) position {
+	for _, r := range text {
+		if r == '\n' {
+			pos.line++
+			pos.col = 0
+			continue
+		}
+		pos.col++
+	}
+	return pos
+}
+
+// diffRegion trims what old and new have in common at both ends and returns
+// the remaining change as an edit, or nil if they are the same.
+func diffRegion(first int, old, new []rune) *Edit {
+	p := 0
+	for p < len(old) && p < len(new) && old[p] == new[p] {
+		p++
+	}
+	if p == len(old) && p == len(new) {
+		return nil
+	}
+	s := 0
+	for s < len(old)-p && s < len(new)-p && old[len(old)-1-s] == new[len(new)-1-s] {
+		s++
+	}
+	pos := advance(position{line: first}, old[:p])
+	return newEdit(pos, old[p:len(old)-s], new[p:len(new)-s])
+}
+
+// regionText returns lines first through last, each ended by '\n'.
+func (la *LineArray) regionText(first, last int) []rune {
+	text := []rune{}
+	for i := first; i <= last && i < la.length(); i++ {
+		text = append(text, la.line(i).runes...)
+		text = append(text, '\n')
+	}
+	return text
+}
+
+func (la *LineArray) replaceText(h *highlighter.Highlighter, pos position, oldText, newText []rune) {
+	end := advance(pos, oldText)
+	last := min(end.line, la.length()-1)
+	region := la.regionText(pos.line, last)
+	endOff := len(region)
+	if end.line <= last {
+		endOff = end.col
+		for i, lines := 0, 0; lines < end.line-pos.line; i++ {
+			if region[i] == '\n' {
+				lines++
+				endOff = i + 1 + end.col
+			}
+		}
+	}
+	text := append([]rune(nil), region[:pos.col]...)
+	text = append(text, newText...)
+	text = append(text, region[endOff:]...)
+	la.replaceLines(h, pos.line, last, text)
+}
+
+// replaceLines swaps lines first through last for the lines in text.
+func (la *LineArray) replaceLines(h *highlighter.Highlighter, first, last int, text []rune) {
+	for i := last; i >= first; i-- {
+		la.removeLine(i)
+	}
+	idx := first
+	start := 0
+	for i, r := range text {
+		if r != '\n' {
+			continue
+		}
+		line := newLine(h)
+		line.runes = append([]rune(nil), text[start:i]...)
+		la.insertLine(idx, line)
+		idx++
+		start = i + 1
+	}
+	if start < len(text) {
+		line := newLine(h)
+		line.runes = append([]rune(nil), text[start:]...)
+		la.insertLine(idx, line)
+		idx++
+	}
+	if la.length() == 0 {
+		la.insertLine(0, newLine(h))
+		idx = 1
+	}
+	for i := first; i < idx && i < la.length(); i++ {
+		ctx := []token.TokenType{token.TYPE_NONE}
+		if i > 0 {
+			ctx = la.line(i - 1).Context()
+		}
+		la.line(i).highlight(ctx)
+	}
+}
@@ -0,0 +1,141 @@
+package display
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+)
+
+type fileEncoding struct {
+	name string
+	enc  encoding.Encoding
+	bom  []byte
+}
+
+var (
+	encUTF8        = fileEncoding{name: "utf-8", bom: utf8BOM}
+	encUTF16LE     = fileEncoding{"utf-16le", unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM), []byte{0xFF, 0xFE}}
+	encUTF16BE     = fileEncoding{"utf-16be", unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM), []byte{0xFE, 0xFF}}
+	encLatin1      = fileEncoding{name: "latin1", enc: charmap.ISO8859_1}
+	encWindows1252 = fileEncoding{name: "windows-1252", enc: charmap.Windows1252}
+)
+
+var encodings = []fileEncoding{encUTF8, encUTF16LE, encUTF16BE, encLatin1, encWindows1252}
+
+var encodingAliases = map[string]string{
+	"utf8":       "utf-8",
+	"utf-16":     "utf-16le",
+	"utf16":      "utf-16le",
+	"utf16le":    "utf-16le",
+	"utf16be":    "utf-16be",
+	"latin-1":    "latin1",
+	"iso-8859-1": "latin1",
+	"iso8859-1":  "latin1",
+	"cp1252":     "windows-1252",
+}
+
+func lookupEncoding(name string) (fileEncoding, error) {
+	name = strings.ToLower(name)
+	if alias, ok := encodingAliases[name]; ok {
+		name = alias
+	}
+	for _, enc := range encodings {
+		if enc.name == name {
+			return enc, nil
+		}
+	}
+	return fileEncoding{}, fmt.Errorf("unknown encoding: %s", name)
+}
+
+func detectEncoding(data []byte) fileEncoding {
+	for _, enc := range []fileEncoding{encUTF8, encUTF16LE, encUTF16BE} {
+		if bytes.HasPrefix(data, enc.bom) {
+			return enc
+		}
+	}
+	if enc, ok := detectUTF16(data); ok {
+		return enc
+	}
+	if utf8.Valid(data) {
+		return encUTF8
+	}
+	return encLatin1
+}
+
+// detectUTF16 looks for the null bytes that mostly-ASCII text leaves in every
+// other position when it is stored as UTF-16 without a byte order mark.
+func detectUTF16(data []byte) (fileEncoding, bool) {
+	sample := data[:min(len(data), 4096)]
+	pairs := len(sample) / 2
+	if pairs == 0 || len(data)%2 != 0 {
+		return fileEncoding{}, false
+	}
+	evenZeros, oddZeros := 0, 0
+	for i := 0; i < pairs*2; i += 2 {
+		if sample[i] == 0 {
+			evenZeros++
+		}
+		if sample[i+1] == 0 {
+			oddZeros++
+		}
+	}
+	switch {
+	case oddZeros*10 >= pairs*4 && evenZeros*10 < pairs:
+		return encUTF16LE, true
+	case evenZeros*10 >= pairs*4 && oddZeros*10 < pairs:
+		return encUTF16BE, true
+	}
+	return fileEncoding{}, false
+}
+
+func (e fileEncoding) decode(data []byte) (string, error) {
+	if e.enc == nil {
+		return string(data), nil
+	}
+	decoded, err := e.enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
+}
+
+func (e fileEncoding) encode(text string) ([]byte, error) {
+	if e.enc == nil {
+		return []byte(text), nil
+	}
+	encoded, err := e.enc.NewEncoder().Bytes([]byte(text))
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode file as %s: %w", e.name, err)
+	}
+	return encoded, nil
+}
+
+func (b *Buffer) SetEncoding(name string) error {
+	enc, err := lookupEncoding(name)
+	if err != nil {
+		return err
+	}
+	if enc.name == b.format.encoding.name {
+		return nil
+	}
+	b.format.encoding = enc
+	if enc.bom == nil {
+		b.format.bom = false
+	}
+	b.markChanged()
+	return nil
+}
+
+func (b *Buffer) cycleEncoding() {
+	for i, enc := range encodings {
+		if enc.name == b.format.encoding.name {
+			b.SetEncoding(encodings[(i+1)%len(encodings)].name)
+			return
+		}
+	}
+}
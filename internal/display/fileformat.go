@@ -0,0 +1,107 @@
+package display
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+const (
+	LF   = "\n"
+	CRLF = "\r\n"
+)
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+var fileFormats = map[string]string{
+	"unix": LF,
+	"dos":  CRLF,
+}
+
+// fileFormat is how a file's text is stored. empty marks a file with no
+// lines at all, which loads as a single empty line like a file holding just
+// a line ending does, so that it is written back as nothing.
+type fileFormat struct {
+	encoding     fileEncoding
+	lineEnding   string
+	finalNewline bool
+	bom          bool
+	empty        bool
+}
+
+func defaultFileFormat() fileFormat {
+	return fileFormat{encoding: encUTF8, lineEnding: LF, finalNewline: true, empty: true}
+}
+
+func detectFileFormat(data []byte) (fileFormat, string) {
+	return decodeFileFormat(data, detectEncoding(data))
+}
+
+func decodeFileFormat(data []byte, enc fileEncoding) (fileFormat, string) {
+	format := defaultFileFormat()
+	format.encoding = enc
+	if enc.bom != nil && bytes.HasPrefix(data, enc.bom) {
+		format.bom = true
+		data = data[len(enc.bom):]
+	}
+	text, err := enc.decode(data)
+	if err != nil {
+		format.encoding = encLatin1
+		format.bom = false
+		text, _ = encLatin1.decode(data)
+	}
+	lineCount := strings.Count(text, LF)
+	if lineCount > 0 && strings.Count(text, CRLF) == lineCount {
+		format.lineEnding = CRLF
+	}
+	format.finalNewline = len(text) == 0 || strings.HasSuffix(text, LF)
+	format.empty = len(text) == 0
+	return format, text
+}
+
+func (f fileFormat) splitLines(text string) []string {
+	if f.finalNewline {
+		text = strings.TrimSuffix(text, f.lineEnding)
+	}
+	return strings.Split(text, f.lineEnding)
+}
+
+func (f fileFormat) name() string {
+	for name, ending := range fileFormats {
+		if ending == f.lineEnding {
+			return name
+		}
+	}
+	return ""
+}
+
+func (f fileFormat) String() string {
+	info := f.encoding.name + " " + f.name()
+	if !f.finalNewline {
+		info += " [noeol]"
+	}
+	if f.bom {
+		info += " [bom]"
+	}
+	return info
+}
+
+func (b *Buffer) SetFileFormat(name string) error {
+	ending, ok := fileFormats[name]
+	if !ok {
+		return fmt.Errorf("invalid fileformat: %s", name)
+	}
+	if ending != b.format.lineEnding {
+		b.format.lineEnding = ending
+		b.markChanged()
+	}
+	return nil
+}
+
+func (b *Buffer) toggleFileFormat() {
+	if b.format.lineEnding == CRLF {
+		b.SetFileFormat("unix")
+		return
+	}
+	b.SetFileFormat("dos")
+}
@@ -0,0 +1,133 @@
+package display
+
+import (
+	"slices"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
+)
+
+// frame sits between the display and the terminal. Drawing goes into a model
+// of the next screen, and Show writes only the cells that differ from what
+// the terminal already shows, so repainting a window that did not change
+// costs nothing.
+type frame struct {
+	tcell.Screen
+	width   int
+	height  int
+	style   tcell.Style
+	next    []frameCell
+	shown   []frameCell
+	synced  bool
+	written int
+}
+
+type frameCell struct {
+	main  rune
+	comb  []rune
+	style tcell.Style
+}
+
+func newFrame(screen tcell.Screen) *frame {
+	f := &frame{Screen: screen}
+	f.resize()
+	return f
+}
+
+// resize matches the model to the size of the terminal, starting from a blank
+// screen that is written out in full on the next Show.
+func (f *frame) resize() {
+	f.width, f.height = f.Screen.Size()
+	f.next = make([]frameCell, f.width*f.height)
+	f.shown = make([]frameCell, f.width*f.height)
+	for i := range f.next {
+		f.next[i] = frameCell{main: ' ', style: f.style}
+	}
+	f.synced = false
+}
+
+func (f *frame) cell(x, y int) *frameCell {
+	if x < 0 || x >= f.width || y < 0 || y >= f.height {
+		return nil
+	}
+	return &f.next[y*f.width+x]
+}
+
+func (f *frame) SetContent(x, y int, main rune, comb []rune, style tcell.Style) {
+	if c := f.cell(x, y); c != nil {
+		*c = frameCell{main, slices.Clone(comb), style}
+	}
+}
+
+func (f *frame) SetCell(x, y int, style tcell.Style, ch ...rune) {
+	if len(ch) > 0 {
+		f.SetContent(x, y, ch[0], ch[1:], style)
+	}
+}
+
+func (f *frame) GetContent(x, y int) (rune, []rune, tcell.Style, int) {
+	c := f.cell(x, y)
+	if c == nil {
+		return ' ', nil, f.style, 1
+	}
+	return c.main, c.comb, c.style, max(runewidth.RuneWidth(c.main), 1)
+}
+
+func (f *frame) SetStyle(style tcell.Style) {
+	f.style = style
+	f.Screen.SetStyle(style)
+}
+
+func (f *frame) Clear() {
+	f.Fill(' ', f.style)
+}
+
+func (f *frame) Fill(r rune, style tcell.Style) {
+	for i := range f.next {
+		f.next[i] = frameCell{main: r, style: style}
+	}
+}
+
+// Show writes the cells that changed since the last Show to the terminal and
+// shows them.
+func (f *frame) Show() {
+	f.fit()
+	f.flush()
+	f.Screen.Show()
+}
+
+// Sync rewrites every cell, for when the terminal may no longer show what the
+// model thinks it does.
+func (f *frame) Sync() {
+	f.fit()
+	f.synced = false
+	f.flush()
+	f.Screen.Sync()
+}
+
+// fit resizes the model when the terminal has been resized, keeping what
+// was drawn in the part of the screen that is left.
+func (f *frame) fit() {
+	w, h := f.Screen.Size()
+	if w == f.width && h == f.height {
+		return
+	}
+	next, width, height := f.next, f.width, f.height
+	f.resize()
+	for y := range min(height, f.height) {
+		copy(f.next[y*f.width:y*f.width+min(width, f.width)], next[y*width:])
+	}
+}
+
+func (f *frame) flush() {
+	for i, c := range f.next {
+		s := f.shown[i]
+		if f.synced && c.main == s.main && c.style == s.style && slices.Equal(c.comb, s.comb) {
+			continue
+		}
+		f.Screen.SetContent(i%f.width, i/f.width, c.main, c.comb, c.style)
+		f.shown[i] = c
+		f.written++
+	}
+	f.synced = true
+}
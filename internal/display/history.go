@@ -1,100 +1,232 @@
 package display
 
+import (
+	"slices"
+	"time"
+
+	"github.com/cyamas/rizz/internal/highlighter"
+)
+
 type Action string
 
 const (
-	ADD    = "ADD"
-	REMOVE = "REMOVE"
-	UNDO   = "UNDO"
-	REDO   = "REDO"
+	ADD         = "ADD"
+	REMOVE      = "REMOVE"
+	SPLIT_LINE  = "SPLIT_LINE"
+	JOIN_LINES  = "JOIN_LINES"
+	INSERT_LINE = "INSERT_LINE"
+	DELETE_LINE = "DELETE_LINE"
+	DELETE      = "DELETE"
+	INDENT      = "INDENT"
+	CHANGE_CASE = "CHANGE_CASE"
+	PASTE       = "PASTE"
+	RELOAD      = "RELOAD"
 )
 
+// History is an undo tree: undoing and then making a new edit starts a new
+// branch instead of throwing the undone states away.
 type History struct {
-	undoStack []*Record
-	redoStack []*Record
+	root           *undoNode
+	curr           *undoNode
+	nodes          []*undoNode
+	savedNode      *undoNode
+	savedReachable bool
+	pending        *transaction
+}
+
+// undoNode is a state of the buffer. record holds the edits that lead to it
+// from its parent, and redo is the child that redo moves to.
+type undoNode struct {
+	seq      int
+	record   *Record
+	parent   *undoNode
+	children []*undoNode
+	redo     int
+	time     time.Time
 }
 
 func NewHistory() *History {
-	return &History{}
+	root := &undoNode{time: time.Now()}
+	return &History{
+		root:           root,
+		curr:           root,
+		nodes:          []*undoNode{root},
+		savedNode:      root,
+		savedReachable: true,
+	}
 }
 
-func (h *History) AddEvent(action Action, ogRunes []rune, line *Line) {
-	lastEvent := h.lastUndoRecord()
-	switch {
-	case action == UNDO:
-		if lastEvent == nil {
-			return
-		}
-		lastEvent.lastX = Cur.X
-		Cur.X = lastEvent.firstX
-		lastEvent.line.SetRunes(lastEvent.prevRunes)
-		lastEvent.prevRunes, lastEvent.currRunes = lastEvent.currRunes, lastEvent.prevRunes
-		h.PushRedoStack(h.PopUndoStack())
-	case action == REDO:
-		if len(h.redoStack) == 0 {
-			return
-		}
-		lastUndo := h.PopRedoStack()
-		Cur.X = lastUndo.lastX
-		lastUndo.line.SetRunes(lastUndo.prevRunes)
-		lastUndo.prevRunes, lastUndo.currRunes = lastUndo.currRunes, lastUndo.prevRunes
-		h.PushUndoStack(lastUndo)
-	case lastEvent != nil && lastEvent.action == action && lastEvent.line == line:
-		lastEvent.lastX = Cur.X
-		lastEvent.currRunes = line.Runes()
-	default:
-		h.PushUndoStack(CreateRecord(action, Cur.X, Cur.Y, ogRunes, line))
+func (h *History) markSaved() {
+	h.savedNode = h.curr
+	h.savedReachable = true
+}
+
+func (h *History) markUnrecordedEdit() {
+	h.savedReachable = false
+}
+
+func (h *History) atSavedState() bool {
+	return h.savedReachable && h.curr == h.savedNode
+}
+
+func (h *History) lastNode() *undoNode {
+	return h.nodes[len(h.nodes)-1]
+}
+
+// AddRecord adds a finished transaction as a new state after the current one.
+// Typing or deleting runes on the same line is merged into one state so it is
+// undone in one step.
+func (h *History) AddRecord(record *Record) {
+	curr := h.curr
+	if curr != h.root && curr != h.savedNode && curr == h.lastNode() && curr.record.action == record.action &&
+		(record.action == ADD || record.action == REMOVE) && curr.record.after.line == record.before.line {
+		curr.record.edits = append(curr.record.edits, record.edits...)
+		curr.record.after = record.after
+		curr.time = time.Now()
+		return
+	}
+	node := &undoNode{
+		seq:    h.lastNode().seq + 1,
+		record: record,
+		parent: curr,
+		time:   time.Now(),
 	}
+	curr.children = append(curr.children, node)
+	curr.redo = len(curr.children) - 1
+	h.nodes = append(h.nodes, node)
+	h.curr = node
 }
 
-func (h *History) lastUndoRecord() *Record {
-	if len(h.undoStack) == 0 {
-		return nil
+func (h *History) undo(la *LineArray, hl *highlighter.Highlighter) (position, bool) {
+	node := h.curr
+	if node.parent == nil {
+		return position{}, false
+	}
+	for i := len(node.record.edits) - 1; i >= 0; i-- {
+		node.record.edits[i].revert(la, hl)
 	}
-	return h.undoStack[len(h.undoStack)-1]
+	h.curr = node.parent
+	h.curr.redo = slices.Index(h.curr.children, node)
+	return node.record.before, true
 }
 
-func (h *History) PushUndoStack(record *Record) {
-	h.undoStack = append(h.undoStack, record)
+func (h *History) redo(la *LineArray, hl *highlighter.Highlighter) (position, bool) {
+	if len(h.curr.children) == 0 {
+		return position{}, false
+	}
+	node := h.curr.children[h.curr.redo]
+	for _, edit := range node.record.edits {
+		edit.apply(la, hl)
+	}
+	h.curr = node
+	return node.record.after, true
 }
 
-func (h *History) PopUndoStack() *Record {
-	idx := len(h.undoStack) - 1
-	record := h.undoStack[idx]
-	h.undoStack = h.undoStack[:idx]
-	return record
+// gotoNode undoes up to the closest common ancestor of the current state and
+// target, then redoes down the branch that leads to target.
+func (h *History) gotoNode(target *undoNode, la *LineArray, hl *highlighter.Highlighter) (position, bool) {
+	if target == h.curr {
+		return position{}, false
+	}
+	ancestors := map[*undoNode]bool{}
+	for n := target; n != nil; n = n.parent {
+		ancestors[n] = true
+	}
+	pos := position{}
+	for !ancestors[h.curr] {
+		pos, _ = h.undo(la, hl)
+	}
+	down := []*undoNode{}
+	for n := target; n != h.curr; n = n.parent {
+		down = append(down, n)
+	}
+	for i := len(down) - 1; i >= 0; i-- {
+		h.curr.redo = slices.Index(h.curr.children, down[i])
+		pos, _ = h.redo(la, hl)
+	}
+	return pos, true
 }
 
-func (h *History) PushRedoStack(record *Record) {
-	h.redoStack = append(h.redoStack, record)
+func (h *History) nodeBySeq(seq int) *undoNode {
+	for _, n := range h.nodes {
+		if n.seq == seq {
+			return n
+		}
+	}
+	return nil
 }
 
-func (h *History) PopRedoStack() *Record {
-	idx := len(h.redoStack) - 1
-	record := h.redoStack[idx]
-	h.redoStack = h.redoStack[:idx]
-	return record
+// stepTarget returns the state count steps from the current one in the order
+// the states were made, across branches.
+func (h *History) stepTarget(count int) *undoNode {
+	idx := slices.Index(h.nodes, h.curr) + count
+	return h.nodes[max(min(idx, len(h.nodes)-1), 0)]
+}
 
+// timeTarget returns the newest state made at or before t.
+func (h *History) timeTarget(t time.Time) *undoNode {
+	target := h.nodes[0]
+	for _, n := range h.nodes {
+		if !n.time.After(t) {
+			target = n
+		}
+	}
+	return target
 }
 
+// Record is one undoable step: the edits made by a single command, with the
+// cursor before and after them as buffer positions.
 type Record struct {
-	action    Action
-	line      *Line
-	firstX    int
-	lastX     int
-	y         int
-	prevRunes []rune
-	currRunes []rune
+	action Action
+	edits  []*Edit
+	before position
+	after  position
 }
 
-func CreateRecord(action Action, x, y int, ogRunes []rune, line *Line) *Record {
+func CreateRecord(action Action, before, after position, edits ...*Edit) *Record {
 	return &Record{
-		action:    action,
-		line:      line,
-		firstX:    x,
-		lastX:     x,
-		y:         y,
-		prevRunes: ogRunes,
-		currRunes: line.Runes(),
+		action: action,
+		edits:  edits,
+		before: before,
+		after:  after,
+	}
+}
+
+// transaction holds the lines a command may touch as they were before the
+// command ran; the edit is worked out by comparing them once it is done.
+type transaction struct {
+	first  int
+	last   int
+	length int
+	text   []rune
+	before position
+}
+
+func (h *History) begin(la *LineArray, first, last int, cursor position) {
+	first = max(first, 0)
+	last = min(last, la.length()-1)
+	h.pending = &transaction{
+		first:  first,
+		last:   last,
+		length: la.length(),
+		text:   la.regionText(first, last),
+		before: cursor,
+	}
+}
+
+// commit records the pending transaction and reports whether it changed
+// anything.
+func (h *History) commit(la *LineArray, action Action, cursor position) bool {
+	t := h.pending
+	h.pending = nil
+	if t == nil {
+		return false
+	}
+	last := t.last + la.length() - t.length
+	edit := diffRegion(t.first, t.text, la.regionText(t.first, last))
+	if edit == nil {
+		return false
 	}
+	h.AddRecord(CreateRecord(action, t.before, cursor, edit))
+	return true
 }
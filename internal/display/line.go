@@ -117,32 +117,14 @@ func (l *Line) getRuneStyle(idx int) tcell.Style {
 	return l.styles[idx]
 }
 
-func (l *Line) addRune(r rune) {
+func (l *Line) addRune(idx int, r rune) {
 	l.runes = append(l.runes, ' ')
-	copy(l.runes[bufPos.X+1:], l.runes[bufPos.X:])
-	l.runes[bufPos.X] = r
-
-}
-
-func (l *Line) addTabFromFile() {
-	l.runes = append(l.runes, '\t')
-	offset := nextTabStopOffsetFromIndex(len(l.runes) - 1)
-	for i := 1; i < offset-1; i++ {
-		l.runes = append(l.runes, ' ')
-	}
-	l.runes = append(l.runes, '\t')
+	copy(l.runes[idx+1:], l.runes[idx:])
+	l.runes[idx] = r
 }
 
 func (l *Line) convertRunesForWrite() string {
-	str := ""
-	for i := 0; i < len(l.runes); i++ {
-		str += string(l.runes[i])
-		if l.runes[i] == '\t' {
-			i += nextTabStopOffsetFromIndex(i) - 1
-		}
-	}
-	str += "\n"
-	return str
+	return string(l.runes)
 }
 
 func (l *Line) convertRunesForParsing() string {
@@ -157,15 +139,15 @@ func (l *Line) convertRunesForParsing() string {
 	return str
 }
 
-func (l *Line) curRune() rune {
-	if bufPos.X >= l.length() {
+func (l *Line) curRune(idx int) rune {
+	if idx >= l.length() {
 		return ' '
 	}
-	return l.runes[bufPos.X]
+	return l.runes[idx]
 }
 
-func (l *Line) prevRune() rune {
-	return l.runes[bufPos.X-1]
+func (l *Line) prevRune(idx int) rune {
+	return l.runes[idx-1]
 }
 
 func (l *Line) length() int {
@@ -176,88 +158,76 @@ func (l *Line) lastRune() rune {
 	return l.runes[l.length()-1]
 }
 
-func (l *Line) extractRestOfLine() []rune {
-	pushedRunes := append([]rune(nil), l.runes[bufPos.X:]...)
-	l.runes = l.runes[:bufPos.X]
+func (l *Line) extractRestOfLine(idx int) []rune {
+	pushedRunes := append([]rune(nil), l.runes[idx:]...)
+	l.runes = l.runes[:idx]
 	return pushedRunes
 }
 
-func (l *Line) addKeyTab() {
-	tab := createTabRunes()
-
-	for i := 0; i < len(tab); i++ {
-		l.runes = append(l.runes, ' ')
-	}
-	copy(l.runes[bufPos.X+len(tab):], l.runes[bufPos.X:])
-	for i := range tab {
-		l.runes[bufPos.X+i] = tab[i]
-	}
-}
-
-func (l *Line) removeTabRunes() {
-	idx := bufPos.X - 1
-	if l.runes[idx] != ' ' && l.runes[idx] != '\t' {
-		l.runes = append(l.runes[:bufPos.X], l.runes[bufPos.X+1:]...)
-		return
+func (l *Line) addKeyTab(idx int, s Settings) int {
+	if !s.ExpandTab {
+		l.addRune(idx, '\t')
+		return 1
 	}
-	for {
-		if l.runes[idx] == '\t' {
-			break
-		}
-		idx--
+	col := l.colAt(idx, s.TabWidth)
+	spaces := s.ShiftWidth - col%s.ShiftWidth
+	for range spaces {
+		l.addRune(idx, ' ')
 	}
-	l.runes = append(l.runes[:idx], l.runes[bufPos.X+1:]...)
-	Cur.X = idx + LeftMarginSize
+	return spaces
 }
 
 func (l *Line) setHighlights() {
 
 }
-func (l *Line) nextWordPos(sepFound bool) (int, bool) {
-	if sepFound && l.runes[bufPos.X] != ' ' && l.runes[bufPos.X] != '\t' {
-		return bufPos.X + LeftMarginSize, true
-	}
-	for i := bufPos.X + 1; i < len(l.runes); i++ {
+func (l *Line) nextWordPos(idx int) (int, bool) {
+	starts := l.clusterStarts()
+	for i := idx + 1; i < len(l.runes); i++ {
 		curr := l.runes[i]
 		prev := l.runes[i-1]
 		switch {
+		case !starts[i]:
+			continue
 		case curr == ' ' || curr == '\t' || isApostrophe(l.runes, i):
 			continue
 		case isLetterOrNumber(curr) && isLetterOrNumber(prev):
 			continue
 		case isLetterOrNumber(prev) && isNonSpaceSeparator(curr):
-			return i + LeftMarginSize, true
+			return i, true
 		default:
-			return i + LeftMarginSize, true
+			return i, true
 		}
 	}
 	return -1, false
 }
 
-func (l *Line) prevWordPos() (int, bool) {
-	if l.prevRuneIsPrevWord() {
-		return bufPos.X - 1 + LeftMarginSize, true
+func (l *Line) prevWordPos(idx int) (int, bool) {
+	if l.prevRuneIsPrevWord(idx) {
+		return l.prevCluster(idx), true
 	}
-	for i := bufPos.X - 1; i > 0; i-- {
+	starts := l.clusterStarts()
+	for i := idx - 1; i > 0; i-- {
 		curr, next := l.runes[i], l.runes[i-1]
 		switch {
+		case !starts[i]:
+			continue
 		case curr == ' ' || curr == '\t' || isApostrophe(l.runes, i):
 			continue
 		case l.prevWordFound(curr, next):
-			return i + LeftMarginSize, true
+			return i, true
 		}
 	}
 	if isLetterOrNumber(l.runes[0]) || isNonSpaceSeparator(l.runes[0]) {
-		return LeftMarginSize, true
+		return 0, true
 	}
 	return -1, false
 }
 
-func (l *Line) prevRuneIsPrevWord() bool {
+func (l *Line) prevRuneIsPrevWord(idx int) bool {
 	switch {
-	case isLetterOrNumber(l.curRune()) && isNonSpaceSeparator(l.prevRune()):
+	case isLetterOrNumber(l.curRune(idx)) && isNonSpaceSeparator(l.prevRune(idx)):
 		return true
-	case isNonSpaceSeparator(l.curRune()) && isNonSpaceSeparator(l.prevRune()):
+	case isNonSpaceSeparator(l.curRune(idx)) && isNonSpaceSeparator(l.prevRune(idx)):
 		return true
 	}
 	return false
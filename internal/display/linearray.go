@@ -6,59 +6,76 @@ import (
 )
 
 type LineArray struct {
-	lines []*Line
+	lines *rope
 }
 
 func newLineArray(h *highlighter.Highlighter) *LineArray {
-	arr := &LineArray{}
-	line := newLine(h)
-	arr.lines = append(arr.lines, line)
-	return arr
+	return &LineArray{lines: newRope([]*Line{newLine(h)})}
 }
 
-func (la *LineArray) insertNewLine(line *Line) {
-	if bufPos.Y == len(la.lines)-1 {
-		la.lines = append(la.lines, line)
-		return
+// lineArrayFromStrings makes a LineArray holding one line for each of texts,
+// highlighted from the top down.
+func lineArrayFromStrings(texts []string, h *highlighter.Highlighter) *LineArray {
+	lines := make([]*Line, len(texts))
+	context := []token.TokenType{token.TYPE_NONE}
+	for i, text := range texts {
+		line := newLine(h)
+		line.runes = []rune(text)
+		line.highlight(context)
+		context = line.Context()
+		lines[i] = line
 	}
-	la.lines = append(la.lines, nil)
-	copy(la.lines[bufPos.Y+2:], la.lines[bufPos.Y+1:])
-	la.lines[bufPos.Y+1] = line
+	if len(lines) == 0 {
+		lines = append(lines, newLine(h))
+	}
+	return &LineArray{lines: newRope(lines)}
 }
 
-func (la *LineArray) newLineFromKeyEnter(h *highlighter.Highlighter) *Line {
-	newLine := newLine(h)
-	runes := la.lines[bufPos.Y].extractRestOfLine()
-	tabCount := la.lines[bufPos.Y].tabCountForNewLine()
-	newLine.autoIndent(tabCount)
-	currContext := la.currLine().Context()
-	newLine.highlight(currContext)
-	newLine.runes = append(newLine.runes, runes...)
-	return newLine
+func (la *LineArray) length() int {
+	return la.lines.length()
 }
 
-func (la *LineArray) currLine() *Line {
-	return la.lines[bufPos.Y]
+func (la *LineArray) line(idx int) *Line {
+	return la.lines.get(idx)
 }
 
-func (la *LineArray) addLineFromFile(text string, h *highlighter.Highlighter) {
-	line := newLine(h)
-	for _, ch := range text {
-		switch ch {
-		case '\n':
-			break
-		case '\t':
-			line.addTabFromFile()
-		default:
-			line.runes = append(line.runes, ch)
-		}
-	}
-	if len(la.lines) == 1 && len(la.lines[0].runes) == 0 {
-		la.lines[0] = line
-		line.highlight([]token.TokenType{token.TYPE_NONE})
-		return
-	}
-	currContext := la.currLine().Context()
-	line.highlight(currContext)
-	la.lines = append(la.lines, line)
+func (la *LineArray) lastLine() *Line {
+	return la.line(la.length() - 1)
+}
+
+func (la *LineArray) setLine(idx int, line *Line) {
+	la.lines.set(idx, line)
+}
+
+func (la *LineArray) insertLine(idx int, line *Line) {
+	la.lines.insert(idx, line)
+}
+
+func (la *LineArray) removeLine(idx int) *Line {
+	return la.lines.remove(idx)
+}
+
+func (la *LineArray) appendLine(line *Line) {
+	la.lines.insert(la.length(), line)
+}
+
+func (la *LineArray) slice(start, end int) []*Line {
+	return la.lines.slice(start, end)
+}
+
+func (la *LineArray) allLines() []*Line {
+	return la.slice(0, la.length())
+}
+
+// newLineFromKeyEnter splits the line at pos, returning the indented rest of
+// it as a new line for the caller to insert.
+func (la *LineArray) newLineFromKeyEnter(pos position, h *highlighter.Highlighter, s Settings) *Line {
+	line := la.line(pos.line)
+	newLine := newLine(h)
+	runes := line.extractRestOfLine(pos.col)
+	indent := line.indentForNewLine(s)
+	newLine.autoIndent(indent, s)
+	newLine.highlight(line.Context())
+	newLine.runes = append(newLine.runes, runes...)
+	return newLine
 }
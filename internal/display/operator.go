@@ -0,0 +1,439 @@
+package display
+
+import (
+	"strconv"
+	"time"
+	"unicode"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// pendingTimeout is how long a partly typed command waits for its next key.
+const pendingTimeout = time.Second
+
+// pendingCommand is a normal-mode command being typed, one of
+//
+//	[count] operator [count] motion
+//	[count] operator [count] text-object
+//	[count] operator operator
+//	[count] motion
+//	[count] command
+//
+// The counts multiply. keys is what has been typed so far, for the status
+// bar, and prefix is a key that needs another to make a motion or text
+// object: g, or i or a after an operator.
+type pendingCommand struct {
+	keys        []rune
+	count       int
+	operator    rune
+	motionCount int
+	prefix      rune
+	seq         int
+}
+
+// pendingTimedOut is posted when a pending command has waited too long.
+type pendingTimedOut struct {
+	seq int
+}
+
+func isOperator(r rune) bool {
+	return r == 'd' || r == 'c' || r == 'y' || r == '>' || r == '<'
+}
+
+// motion moves the cursor once. A linewise motion makes an operator act on
+// whole lines; any other leaves out the position it ends on.
+type motion struct {
+	linewise bool
+	move     func(d *Display)
+}
+
+var motions = map[string]motion{
+	"h":  {false, (*Display).moveCursorLeft},
+	"l":  {false, (*Display).moveCursorRight},
+	"w":  {false, (*Display).moveCursorToNextWord},
+	"b":  {false, (*Display).moveCursorToPrevWord},
+	"j":  {true, (*Display).moveCursorDown},
+	"k":  {true, (*Display).moveCursorUp},
+	"J":  {true, (*Display).moveCursorHalfWindowDown},
+	"K":  {true, (*Display).moveCursorHalfWindowUp},
+	"gj": {false, (*Display).moveCursorScreenDown},
+	"gk": {false, (*Display).moveCursorScreenUp},
+}
+
+func (p *pendingCommand) active() bool {
+	return len(p.keys) > 0
+}
+
+// total is the number of times the command is run.
+func (p *pendingCommand) total() int {
+	return max(p.count, 1) * max(p.motionCount, 1)
+}
+
+// pendingKeys returns what has been typed of the command, including the
+// register it was given.
+func (d *Display) pendingKeys() string {
+	keys := string(d.pending.keys)
+	if d.register != 0 {
+		keys = "\"" + string(d.register) + keys
+	}
+	return keys
+}
+
+func (d *Display) clearPending() {
+	d.pending = pendingCommand{seq: d.pending.seq}
+}
+
+// cancelPending drops a partly typed command along with its register.
+func (d *Display) cancelPending() {
+	d.clearPending()
+	d.register = 0
+}
+
+// waitForKey adds r to the pending command and gives up on it if the next
+// key takes too long.
+func (d *Display) waitForKey(r rune) {
+	p := &d.pending
+	p.keys = append(p.keys, r)
+	p.seq++
+	seq, screen := p.seq, d.Screen
+	time.AfterFunc(pendingTimeout, func() {
+		screen.PostEvent(tcell.NewEventInterrupt(pendingTimedOut{seq}))
+	})
+}
+
+func (d *Display) handlePendingTimeout(ev pendingTimedOut) {
+	if d.Mode == Normal && ev.seq == d.pending.seq && d.pending.active() {
+		d.cancelPending()
+	}
+}
+
+// runPendingKey feeds r to the command being typed and reports whether it
+// was taken as part of one. Keys that are not are commands of their own,
+// which the count typed so far applies to.
+func (d *Display) runPendingKey(r rune) bool {
+	p := &d.pending
+	switch {
+	case p.prefix == 'g':
+		if _, ok := motions["g"+string(r)]; !ok {
+			d.cancelPending()
+			return true
+		}
+		d.runMotion("g" + string(r))
+	case p.prefix != 0:
+		d.runTextObject(p.prefix, r)
+	case '1' <= r && r <= '9', r == '0' && (p.operator == 0 && p.count > 0 || p.motionCount > 0):
+		digit, _ := strconv.Atoi(string(r))
+		if p.operator == 0 {
+			p.count = p.count*10 + digit
+		} else {
+			p.motionCount = p.motionCount*10 + digit
+		}
+		d.waitForKey(r)
+	case p.operator == 0 && isOperator(r):
+		p.operator = r
+		d.waitForKey(r)
+	case p.operator != 0 && r == p.operator:
+		d.operateOnLines()
+	case r == 'g', p.operator != 0 && (r == 'i' || r == 'a'):
+		p.prefix = r
+		d.waitForKey(r)
+	case motions[string(r)].move != nil:
+		d.runMotion(string(r))
+	case p.operator != 0:
+		d.cancelPending()
+	default:
+		return false
+	}
+	return true
+}
+
+// runMotion moves the cursor by the motion as many times as the count asks,
+// and runs the pending operator, if any, over the text moved across.
+func (d *Display) runMotion(name string) {
+	m := motions[name]
+	op, n := d.pending.operator, d.pending.total()
+	d.clearPending()
+	d.setBufPos()
+	start := d.bufWindow.bufPos()
+	la := d.ActiveBuf.content
+	// like vim, cw on a word changes only up to its end, as ce would
+	if op == 'c' && name == "w" {
+		if runes := la.line(start.line).runes; start.col < len(runes) && wordClass(runes[start.col]) != 0 {
+			d.operateUpTo(op, start, la.wordEnd(start, n))
+			return
+		}
+	}
+	for range n {
+		before := d.bufWindow.bufPos()
+		m.move(d)
+		d.setBufPos()
+		if d.bufWindow.bufPos() == before {
+			break
+		}
+	}
+	if op == 0 {
+		return
+	}
+	end := d.bufWindow.bufPos()
+	if m.linewise {
+		d.operate(op, visualLine, start, end)
+		return
+	}
+	if end.line < start.line || end.line == start.line && end.col < start.col {
+		start, end = end, start
+	}
+	// like vim, a motion that ends at the start of a later line stops at the
+	// end of the line before it, and so does a word motion that ends on the
+	// first word of one
+	if end.line > start.line && (end.col == 0 || name == "w" && end.col <= la.line(end.line).firstWordIndex()) {
+		end.line--
+		end.col = la.line(end.line).length()
+	}
+	d.operateUpTo(op, start, end)
+}
+
+// operateOnLines runs the pending operator over count lines from the cursor
+// down, for a doubled operator such as dd.
+func (d *Display) operateOnLines() {
+	op, n := d.pending.operator, d.pending.total()
+	d.clearPending()
+	d.setBufPos()
+	start := d.bufWindow.bufPos()
+	end := position{line: min(start.line+n-1, d.ActiveBuf.length()-1)}
+	d.operate(op, visualLine, start, end)
+}
+
+// operateUpTo runs op over the text from start up to but not including end.
+// Changing nothing starts insert mode at start.
+func (d *Display) operateUpTo(op rune, start, end position) {
+	if end.line == start.line && end.col <= start.col {
+		if op == 'c' {
+			d.moveToBufPos(start)
+			d.Mode = Insert
+		}
+		return
+	}
+	if end.col > 0 {
+		end.col = d.ActiveBuf.getLine(end.line).prevCluster(end.col)
+	} else {
+		end.line--
+		end.col = d.ActiveBuf.getLine(end.line).length()
+	}
+	d.operate(op, visualChar, start, end)
+}
+
+// operate runs op over the text from start to end, both included, the way it
+// runs over a visual selection of the same kind.
+func (d *Display) operate(op rune, kind visualKind, start, end position) {
+	d.visual, d.visualStart = kind, start
+	d.moveToBufPos(end)
+	d.setBufPos()
+	switch op {
+	case 'd':
+		d.deleteSelection()
+	case 'c':
+		d.changeSelection()
+	case 'y':
+		d.yankSelection()
+	case '>':
+		d.indentSelection(1)
+	case '<':
+		d.indentSelection(-1)
+	}
+}
+
+// runTextObject runs the pending operator over the text object named by the
+// prefix, i for inner or a for around, and r.
+func (d *Display) runTextObject(prefix, r rune) {
+	op := d.pending.operator
+	d.clearPending()
+	d.setBufPos()
+	pos := d.bufWindow.bufPos()
+	around := prefix == 'a'
+	switch r {
+	case 'w':
+		start, end, ok := d.currLine().wordObject(pos.col, around)
+		if ok {
+			d.operateUpTo(op, position{line: pos.line, col: start}, position{line: pos.line, col: end})
+		}
+	case '"', '\'', '`':
+		start, end, ok := d.currLine().quoteObject(pos.col, r, around)
+		if ok {
+			d.operateUpTo(op, position{line: pos.line, col: start}, position{line: pos.line, col: end})
+		}
+	default:
+		open, close, ok := bracketPair(r)
+		if !ok {
+			return
+		}
+		d.runBracketObject(op, pos, open, close, around)
+	}
+}
+
+func bracketPair(r rune) (rune, rune, bool) {
+	switch r {
+	case '(', ')', 'b':
+		return '(', ')', true
+	case '[', ']':
+		return '[', ']', true
+	case '{', '}', 'B':
+		return '{', '}', true
+	case '<', '>':
+		return '<', '>', true
+	}
+	return 0, 0, false
+}
+
+func wordClass(r rune) int {
+	switch {
+	case unicode.IsSpace(r):
+		return 0
+	case isLetterOrNumber(r) || r == '_':
+		return 1
+	}
+	return 2
+}
+
+// wordObject returns the run of word, punctuation or space runes at idx, and
+// around it the spaces after it, or before it when there are none after.
+func (l *Line) wordObject(idx int, around bool) (int, int, bool) {
+	if len(l.runes) == 0 {
+		return 0, 0, false
+	}
+	idx = min(idx, len(l.runes)-1)
+	class := wordClass(l.runes[idx])
+	start, end := idx, idx+1
+	for start > 0 && wordClass(l.runes[start-1]) == class {
+		start--
+	}
+	for end < len(l.runes) && wordClass(l.runes[end]) == class {
+		end++
+	}
+	if !around {
+		return start, end, true
+	}
+	if class == 0 {
+		if end < len(l.runes) {
+			next := wordClass(l.runes[end])
+			for end < len(l.runes) && wordClass(l.runes[end]) == next {
+				end++
+			}
+		}
+		return start, end, true
+	}
+	spaces := end
+	for spaces < len(l.runes) && wordClass(l.runes[spaces]) == 0 {
+		spaces++
+	}
+	if spaces > end {
+		return start, spaces, true
+	}
+	for start > 0 && wordClass(l.runes[start-1]) == 0 {
+		start--
+	}
+	return start, end, true
+}
+
+// quoteObject returns the text inside the quotes around idx, or the first
+// quoted text after it, and around it the quotes too.
+func (l *Line) quoteObject(idx int, quote rune, around bool) (int, int, bool) {
+	quotes := []int{}
+	for i, r := range l.runes {
+		if r == quote && (i == 0 || l.runes[i-1] != '\\') {
+			quotes = append(quotes, i)
+		}
+	}
+	for i := 0; i+1 < len(quotes); i += 2 {
+		open, close := quotes[i], quotes[i+1]
+		if close < idx {
+			continue
+		}
+		if around {
+			return open, close + 1, true
+		}
+		return open + 1, close, true
+	}
+	return 0, 0, false
+}
+
+// runBracketObject runs op over what is inside the brackets around pos, and
+// around it the brackets too. Inside a block whose brackets sit on lines of
+// their own, the lines in between are taken whole.
+func (d *Display) runBracketObject(op rune, pos position, open, close rune, around bool) {
+	la := d.ActiveBuf.content
+	start, ok := la.findBracket(pos, open, close, -1)
+	if !ok {
+		return
+	}
+	end, ok := la.findBracket(start, close, open, 1)
+	if !ok {
+		return
+	}
+	if around {
+		d.operateUpTo(op, start, position{line: end.line, col: end.col + 1})
+		return
+	}
+	first, last := la.line(start.line), la.line(end.line)
+	if end.line > start.line+1 && start.col == first.length()-1 && last.firstWordIndex() == end.col {
+		d.operate(op, visualLine, position{line: start.line + 1}, position{line: end.line - 1})
+		return
+	}
+	d.operateUpTo(op, position{line: start.line, col: start.col + 1}, end)
+}
+
+// wordEnd returns the position just past the end of the count-th word from
+// pos, counting the one pos is in, the way vim's e motion moves from inside a
+// word.
+func (la *LineArray) wordEnd(pos position, count int) position {
+	for i := range count {
+		runes := la.line(pos.line).runes
+		for i > 0 && (pos.col >= len(runes) || wordClass(runes[pos.col]) == 0) {
+			if pos.col < len(runes) {
+				pos.col++
+				continue
+			}
+			if pos.line == la.length()-1 {
+				return pos
+			}
+			pos = position{line: pos.line + 1}
+			runes = la.line(pos.line).runes
+		}
+		class := wordClass(runes[pos.col])
+		for pos.col < len(runes) && wordClass(runes[pos.col]) == class {
+			pos.col++
+		}
+	}
+	return pos
+}
+
+// findBracket looks from pos in direction dir, -1 or 1, for the bracket
+// that is not matched by one of other on the way. Looking back, the rune at
+// pos counts unless it is one of other; looking ahead it never does.
+func (la *LineArray) findBracket(pos position, bracket, other rune, dir int) (position, bool) {
+	depth := 0
+	for y := pos.line; y >= 0 && y < la.length(); y += dir {
+		runes := la.line(y).runes
+		x := len(runes) - 1
+		if dir > 0 {
+			x = 0
+		}
+		if y == pos.line {
+			x = min(pos.col, len(runes)-1)
+			if x >= 0 && (dir > 0 || runes[x] == other) {
+				x += dir
+			}
+		}
+		for ; x >= 0 && x < len(runes); x += dir {
+			switch runes[x] {
+			case other:
+				depth++
+			case bracket:
+				if depth == 0 {
+					return position{line: y, col: x}, true
+				}
+				depth--
+			}
+		}
+	}
+	return position{}, false
+}
@@ -0,0 +1,53 @@
+package display
+
+import (
+	"fmt"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+type choice struct {
+	key    rune
+	label  string
+	action func()
+}
+
+type prompt struct {
+	message string
+	choices []choice
+}
+
+func (p *prompt) text() string {
+	text := p.message
+	for _, c := range p.choices {
+		text += fmt.Sprintf("  [%c]%s", c.key, c.label)
+	}
+	return text
+}
+
+func (d *Display) ask(message string, choices ...choice) {
+	d.prompt = &prompt{message: message, choices: choices}
+	d.Mode = Prompt
+}
+
+func (d *Display) runPromptMode(ev tcell.Event) {
+	switch ev := ev.(type) {
+	case *tcell.EventKey:
+		if ev.Key() == tcell.KeyEscape {
+			d.prompt = nil
+			d.Mode = Normal
+			return
+		}
+		for _, c := range d.prompt.choices {
+			if ev.Rune() == c.key {
+				p := d.prompt
+				d.Mode = Normal
+				c.action()
+				if d.prompt == p && d.Mode != Diff {
+					d.prompt = nil
+				}
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package display
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// ringSize is how many yanks and deletes the ring keeps.
+const ringSize = 10
+
+// register is text taken from the buffer by a yank or a delete, along with
+// how it was taken: by characters, whole lines, or as a block, which is kept
+// as its rows, one per line.
+type register struct {
+	kind visualKind
+	text []rune
+}
+
+// registers hold the text of yanks and deletes. Each one goes to the unnamed
+// register and to the front of the ring, which "0 to "9 read from newest to
+// oldest, and to the named register a to z it was given. Naming the register
+// in upper case appends to it instead. "+ and "* are the system clipboard.
+type registers struct {
+	unnamed register
+	named   map[rune]register
+	ring    []register
+}
+
+func isRegisterName(r rune) bool {
+	return r == '"' || isClipboardRegister(r) || '0' <= r && r <= '9' || unicode.IsLetter(r) && r < unicode.MaxASCII
+}
+
+func (rs *registers) get(name rune) (register, bool) {
+	var reg register
+	switch {
+	case name == 0 || name == '"':
+		reg = rs.unnamed
+	case '0' <= name && name <= '9':
+		if i := int(name - '0'); i < len(rs.ring) {
+			reg = rs.ring[i]
+		}
+	default:
+		reg = rs.named[unicode.ToLower(name)]
+	}
+	return reg, len(reg.text) > 0
+}
+
+func (rs *registers) store(name rune, reg register) {
+	if lower := unicode.ToLower(name); 'a' <= lower && lower <= 'z' {
+		if rs.named == nil {
+			rs.named = map[rune]register{}
+		}
+		if lower != name {
+			reg = rs.named[lower].appended(reg)
+		}
+		rs.named[lower] = reg
+	}
+	rs.unnamed = reg
+	rs.ring = slices.Insert(rs.ring, 0, reg)
+	rs.ring = rs.ring[:min(len(rs.ring), ringSize)]
+}
+
+// appended returns reg with more added to its end. Either being made of
+// whole lines makes the result whole lines.
+func (reg register) appended(more register) register {
+	if len(reg.text) == 0 {
+		return more
+	}
+	text := slices.Clone(reg.text)
+	if reg.kind == visualChar && more.kind == visualChar {
+		return register{visualChar, append(text, more.text...)}
+	}
+	if text[len(text)-1] != '\n' {
+		text = append(text, '\n')
+	}
+	text = append(text, more.text...)
+	if text[len(text)-1] != '\n' {
+		text = append(text, '\n')
+	}
+	kind := visualLine
+	if reg.kind == visualBlock && more.kind == visualBlock {
+		kind = visualBlock
+	}
+	return register{kind, text}
+}
+
+// repeated returns reg with its text n times over, each row side by side
+// with itself for a block.
+func (reg register) repeated(n int) register {
+	if n <= 1 {
+		return reg
+	}
+	if reg.kind != visualBlock {
+		return register{reg.kind, []rune(strings.Repeat(string(reg.text), n))}
+	}
+	rows := strings.Split(strings.TrimSuffix(string(reg.text), "\n"), "\n")
+	for i, row := range rows {
+		rows[i] = strings.Repeat(row, n)
+	}
+	return register{visualBlock, []rune(strings.Join(rows, "\n") + "\n")}
+}
+
+// storeRegister keeps reg in the register named for the command, if any.
+func (d *Display) storeRegister(reg register) error {
+	name := d.register
+	d.register = 0
+	d.registers.store(name, reg)
+	if isClipboardRegister(name) {
+		return d.clipboard.copy(d.terminal(), reg.text)
+	}
+	return nil
+}
+
+// takeRegister returns the register named for the command, or the unnamed
+// one.
+func (d *Display) takeRegister() (register, error) {
+	name := d.register
+	d.register = 0
+	if isClipboardRegister(name) {
+		return d.clipboardRegister()
+	}
+	reg, ok := d.registers.get(name)
+	if !ok {
+		if name == 0 {
+			name = '"'
+		}
+		return reg, fmt.Errorf("register %c is empty", name)
+	}
+	return reg, nil
+}
+
+// startRegister waits for the name of the register the next command uses.
+func (d *Display) startRegister() {
+	d.registerReturnMode = d.Mode
+	d.Mode = Register
+}
+
+func (d *Display) runRegisterMode(ev tcell.Event) {
+	d.Mode = d.registerReturnMode
+	if ev, ok := ev.(*tcell.EventKey); ok && ev.Key() == tcell.KeyRune {
+		if !isRegisterName(ev.Rune()) {
+			d.ShowError(fmt.Errorf("no register %c", ev.Rune()))
+			return
+		}
+		d.register = ev.Rune()
+	}
+}
+
+// pasteRegister puts the register named for the command after the cursor,
+// or before it, count times over.
+func (d *Display) pasteRegister(before bool, count int) {
+	reg, err := d.takeRegister()
+	if err != nil {
+		d.ShowError(err)
+		return
+	}
+	d.put(reg.repeated(count), before)
+}
+
+// put pastes reg after the cursor, or before it. Lines go below or above the
+// cursor line, and the rows of a block go into the lines from the cursor
+// down, at the cursor column, padding short lines with spaces to reach it.
+func (d *Display) put(reg register, before bool) {
+	la := d.ActiveBuf.content
+	h := d.Highlighter
+	pos := d.bufWindow.bufPos()
+	line := d.currLine()
+	d.clearBufWindow()
+	var cursor position
+	switch reg.kind {
+	case visualLine:
+		d.beginEdit(pos.line, pos.line)
+		if before {
+			la.replaceText(h, position{line: pos.line}, nil, reg.text)
+			cursor.line = pos.line
+		} else {
+			text := append([]rune{'\n'}, reg.text[:len(reg.text)-1]...)
+			la.replaceText(h, position{line: pos.line, col: line.length()}, nil, text)
+			cursor.line = pos.line + 1
+		}
+		cursor.col = la.line(cursor.line).firstWordIndex()
+	case visualBlock:
+		col := line.colAt(pos.col, d.tabWidth())
+		if !before && pos.col < line.length() {
+			col = line.colAt(line.nextCluster(pos.col), d.tabWidth())
+		}
+		rows := strings.Split(strings.TrimSuffix(string(reg.text), "\n"), "\n")
+		d.beginEdit(pos.line, pos.line+len(rows)-1)
+		for i, row := range rows {
+			y := pos.line + i
+			if y == la.length() {
+				la.replaceText(h, position{line: y - 1, col: la.line(y - 1).length()}, nil, []rune{'\n'})
+			}
+			l := la.line(y)
+			if width := l.displayWidth(d.tabWidth()); width < col {
+				la.replaceText(h, position{line: y, col: l.length()}, nil, []rune(strings.Repeat(" ", col-width)))
+				l = la.line(y)
+			}
+			la.replaceText(h, position{line: y, col: l.indexAt(col, d.tabWidth())}, nil, []rune(row))
+		}
+		cursor = position{line: pos.line, col: la.line(pos.line).indexAt(col, d.tabWidth())}
+	default:
+		at := pos
+		if !before && pos.col < line.length() {
+			at.col = line.nextCluster(pos.col)
+		}
+		d.beginEdit(pos.line, pos.line)
+		la.replaceText(h, at, nil, reg.text)
+		cursor = at
+		if end := advance(at, reg.text); end.line == at.line {
+			cursor.col = la.line(at.line).prevCluster(end.col)
+		}
+	}
+	d.moveToBufPos(cursor)
+	d.endEdit(PASTE)
+	d.bufWindow.update(d.bufWindow.bufIdx)
+	d.SetBufWindow()
+	if n := countLines(reg.text); reg.kind != visualChar && n > 1 {
+		d.showMessage(fmt.Sprintf("%d more lines", n))
+	}
+}
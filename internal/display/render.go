@@ -0,0 +1,218 @@
+package display
+
+import (
+	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
+	"github.com/rivo/uniseg"
+)
+
+func nextTabStop(col, tabWidth int) int {
+	return col + tabWidth - (col % tabWidth)
+}
+
+// cluster is a grapheme cluster of a line: the runes from start to end, which
+// are drawn together from column col over width cells.
+type cluster struct {
+	start, end int
+	col, width int
+}
+
+// clusters splits the line into grapheme clusters. A cluster is as wide as
+// its first rune, the way the terminal draws it, and a tab reaches the next
+// tab stop.
+func (l *Line) clusters(tabWidth int) []cluster {
+	clusters := make([]cluster, 0, len(l.runes))
+	col := 0
+	add := func(start, end int) {
+		width := max(runewidth.RuneWidth(l.runes[start]), 1)
+		if l.runes[start] == '\t' {
+			width = nextTabStop(col, tabWidth) - col
+		}
+		clusters = append(clusters, cluster{start, end, col, width})
+		col += width
+	}
+	if isASCII(l.runes) {
+		for i := range l.runes {
+			add(i, i+1)
+		}
+		return clusters
+	}
+	start := 0
+	g := uniseg.NewGraphemes(string(l.runes))
+	for g.Next() {
+		end := start + len(g.Runes())
+		add(start, end)
+		start = end
+	}
+	return clusters
+}
+
+func isASCII(runes []rune) bool {
+	for _, r := range runes {
+		if r >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// clusterStarts reports for each index of the line, and the end of it,
+// whether a grapheme cluster starts there.
+func (l *Line) clusterStarts() []bool {
+	starts := make([]bool, len(l.runes)+1)
+	for _, c := range l.clusters(1) {
+		starts[c.start] = true
+	}
+	starts[len(l.runes)] = true
+	return starts
+}
+
+// nextCluster returns the index of the cluster after the one at idx.
+func (l *Line) nextCluster(idx int) int {
+	starts := l.clusterStarts()
+	for idx++; idx < len(l.runes) && !starts[idx]; idx++ {
+	}
+	return min(idx, len(l.runes))
+}
+
+// prevCluster returns the index of the cluster before idx.
+func (l *Line) prevCluster(idx int) int {
+	starts := l.clusterStarts()
+	for idx--; idx > 0 && !starts[idx]; idx-- {
+	}
+	return max(idx, 0)
+}
+
+// clusterText returns the runes of the cluster at idx.
+func (l *Line) clusterText(idx int) string {
+	if idx >= len(l.runes) {
+		return ""
+	}
+	return string(l.runes[idx:l.nextCluster(idx)])
+}
+
+func (l *Line) colAt(idx, tabWidth int) int {
+	col := 0
+	for _, c := range l.clusters(tabWidth) {
+		if c.start >= idx {
+			return c.col
+		}
+		col = c.col + c.width
+	}
+	return col
+}
+
+func (l *Line) indexAt(col, tabWidth int) int {
+	for _, c := range l.clusters(tabWidth) {
+		if col < c.col+c.width {
+			return c.start
+		}
+	}
+	return len(l.runes)
+}
+
+func (l *Line) displayWidth(tabWidth int) int {
+	return l.colAt(len(l.runes), tabWidth)
+}
+
+func (d *Display) tabWidth() int {
+	return d.ActiveBuf.settings.TabWidth
+}
+
+func (d *Display) drawLine(y int, line *Line) {
+	d.drawWindowLine(d.bufWindow, y, line)
+}
+
+// drawWindowLine draws the window line at y, carrying on onto the rows below
+// it when the window wraps. A wide cluster that would be cut by an edge of the
+// window is left blank. Selected clusters are drawn over the selection
+// background.
+func (d *Display) drawWindowLine(bw *BufWindow, y int, line *Line) {
+	clusters := line.clusters(bw.buf.settings.TabWidth)
+	selected := d.selectedClusters(bw, bw.bufIdx+y, line)
+	style := func(c cluster) tcell.Style {
+		if selected != nil && selected(c) {
+			return d.selectionStyle(line.getRuneStyle(c.start))
+		}
+		return line.getRuneStyle(c.start)
+	}
+	if selected != nil && len(clusters) == 0 && d.visual != visualBlock && bw.leftCol == 0 {
+		d.setWindowContent(bw, bw.gutter, bw.rowOf(y), ' ', d.selectionStyle(d.BufStyle))
+	}
+	if bw.wraps() {
+		row, width := bw.rowOf(y), bw.textWidth()
+		cell := 0
+		for _, c := range clusters {
+			cell = bw.padCell(cell, c, line)
+			d.drawCluster(bw, line, c, style(c), func(j int) (int, int) {
+				return bw.gutter + (cell+j)%width, row + (cell+j)/width
+			})
+			cell += c.width
+		}
+		return
+	}
+	start := bw.gutter - bw.leftCol
+	for _, c := range clusters {
+		x := start + c.col
+		if x+c.width <= bw.gutter || x >= bw.width {
+			continue
+		}
+		if line.runes[c.start] != '\t' && (x < bw.gutter || x+c.width > bw.width) {
+			for j := max(x, bw.gutter); j < min(x+c.width, bw.width); j++ {
+				d.setWindowContent(bw, j, y, ' ', style(c))
+			}
+			continue
+		}
+		d.drawCluster(bw, line, c, style(c), func(j int) (int, int) {
+			if x+j < bw.gutter {
+				return -1, y
+			}
+			return x + j, y
+		})
+	}
+	d.drawOverflowMarkers(bw, y, line.displayWidth(bw.buf.settings.TabWidth))
+}
+
+// drawCluster draws c at the cells cellAt gives for each of its columns. A
+// tab fills its cells with spaces; anything else is drawn once, with its
+// combining runes, and the terminal covers the rest of its width.
+func (d *Display) drawCluster(bw *BufWindow, line *Line, c cluster, style tcell.Style, cellAt func(int) (int, int)) {
+	if line.runes[c.start] == '\t' {
+		for j := range c.width {
+			x, y := cellAt(j)
+			d.setWindowContent(bw, x, y, ' ', style)
+		}
+		return
+	}
+	x, y := cellAt(0)
+	if x < 0 || x+c.width > bw.width || y < 0 || y >= bw.size {
+		return
+	}
+	runes := line.runes[c.start:c.end]
+	d.Screen.SetContent(bw.left+x, bw.top+y, runes[0], runes[1:], style)
+}
+
+// drawOverflowMarkers marks the edges of a row whose line carries on past
+// the columns the window shows.
+func (d *Display) drawOverflowMarkers(bw *BufWindow, y, lineWidth int) {
+	if bw.leftCol > 0 && lineWidth > 0 {
+		d.setWindowContent(bw, bw.gutter, y, '<', d.LineNoStyle)
+	}
+	if lineWidth > bw.leftCol+bw.textWidth() {
+		d.setWindowContent(bw, bw.width-1, y, '>', d.LineNoStyle)
+	}
+}
+
+// setWindowContent sets a cell given relative to the window, dropping cells
+// that fall outside of it.
+func (d *Display) setWindowContent(bw *BufWindow, x, y int, r rune, style tcell.Style) {
+	if x < 0 || x >= bw.width || y < 0 || y >= bw.size {
+		return
+	}
+	d.Screen.SetContent(bw.left+x, bw.top+y, r, nil, style)
+}
+
+func (d *Display) setCursorIndex(idx int) {
+	d.bufWindow.pos.X = idx
+	d.bufWindow.cur.X = LeftMarginSize + d.currLine().colAt(idx, d.tabWidth())
+}
@@ -0,0 +1,212 @@
+package display
+
+import "fmt"
+
+// rope is a height-balanced (AVL) tree of lines keyed implicitly by position.
+// Every node keeps the size of its subtree so lookups, inserts and removals
+// by line index all run in O(log n).
+type rope struct {
+	root *ropeNode
+}
+
+type ropeNode struct {
+	line   *Line
+	left   *ropeNode
+	right  *ropeNode
+	height int
+	size   int
+}
+
+func newRope(lines []*Line) *rope {
+	return &rope{root: buildRope(lines)}
+}
+
+func buildRope(lines []*Line) *ropeNode {
+	if len(lines) == 0 {
+		return nil
+	}
+	mid := len(lines) / 2
+	n := &ropeNode{
+		line:  lines[mid],
+		left:  buildRope(lines[:mid]),
+		right: buildRope(lines[mid+1:]),
+	}
+	n.fix()
+	return n
+}
+
+func (r *rope) length() int {
+	return r.root.count()
+}
+
+// checkIndex panics like a slice index out of range, so a bad index fails
+// where it is used rather than as a nil line somewhere later.
+func (r *rope) checkIndex(idx int) {
+	if idx < 0 || idx >= r.length() {
+		panic(fmt.Sprintf("rope: index out of range [%d] with length %d", idx, r.length()))
+	}
+}
+
+func (r *rope) get(idx int) *Line {
+	r.checkIndex(idx)
+	n := r.root
+	for n != nil {
+		leftSize := n.left.count()
+		switch {
+		case idx < leftSize:
+			n = n.left
+		case idx == leftSize:
+			return n.line
+		default:
+			idx -= leftSize + 1
+			n = n.right
+		}
+	}
+	return nil
+}
+
+func (r *rope) set(idx int, line *Line) {
+	r.checkIndex(idx)
+	n := r.root
+	for n != nil {
+		leftSize := n.left.count()
+		switch {
+		case idx < leftSize:
+			n = n.left
+		case idx == leftSize:
+			n.line = line
+			return
+		default:
+			idx -= leftSize + 1
+			n = n.right
+		}
+	}
+}
+
+func (r *rope) insert(idx int, line *Line) {
+	r.root = r.root.insert(idx, line)
+}
+
+func (r *rope) remove(idx int) *Line {
+	var removed *Line
+	r.root = r.root.remove(idx, &removed)
+	return removed
+}
+
+func (r *rope) slice(start, end int) []*Line {
+	lines := make([]*Line, 0, end-start)
+	r.root.collect(start, end, &lines)
+	return lines
+}
+
+func (n *ropeNode) count() int {
+	if n == nil {
+		return 0
+	}
+	return n.size
+}
+
+func (n *ropeNode) depth() int {
+	if n == nil {
+		return 0
+	}
+	return n.height
+}
+
+func (n *ropeNode) fix() {
+	n.size = n.left.count() + n.right.count() + 1
+	n.height = max(n.left.depth(), n.right.depth()) + 1
+}
+
+func (n *ropeNode) balance() int {
+	return n.left.depth() - n.right.depth()
+}
+
+func (n *ropeNode) rotateRight() *ropeNode {
+	l := n.left
+	n.left = l.right
+	n.fix()
+	l.right = n
+	l.fix()
+	return l
+}
+
+func (n *ropeNode) rotateLeft() *ropeNode {
+	r := n.right
+	n.right = r.left
+	n.fix()
+	r.left = n
+	r.fix()
+	return r
+}
+
+func (n *ropeNode) rebalance() *ropeNode {
+	n.fix()
+	switch {
+	case n.balance() > 1:
+		if n.left.balance() < 0 {
+			n.left = n.left.rotateLeft()
+		}
+		return n.rotateRight()
+	case n.balance() < -1:
+		if n.right.balance() > 0 {
+			n.right = n.right.rotateRight()
+		}
+		return n.rotateLeft()
+	}
+	return n
+}
+
+func (n *ropeNode) insert(idx int, line *Line) *ropeNode {
+	if n == nil {
+		return &ropeNode{line: line, height: 1, size: 1}
+	}
+	leftSize := n.left.count()
+	if idx <= leftSize {
+		n.left = n.left.insert(idx, line)
+	} else {
+		n.right = n.right.insert(idx-leftSize-1, line)
+	}
+	return n.rebalance()
+}
+
+func (n *ropeNode) remove(idx int, removed **Line) *ropeNode {
+	if n == nil {
+		return nil
+	}
+	leftSize := n.left.count()
+	switch {
+	case idx < leftSize:
+		n.left = n.left.remove(idx, removed)
+	case idx > leftSize:
+		n.right = n.right.remove(idx-leftSize-1, removed)
+	default:
+		*removed = n.line
+		if n.left == nil {
+			return n.right
+		}
+		if n.right == nil {
+			return n.left
+		}
+		var successor *Line
+		n.right = n.right.remove(0, &successor)
+		n.line = successor
+	}
+	return n.rebalance()
+}
+
+func (n *ropeNode) collect(start, end int, lines *[]*Line) {
+	if n == nil || start >= end {
+		return
+	}
+	leftSize := n.left.count()
+	if start < leftSize {
+		n.left.collect(start, min(end, leftSize), lines)
+	}
+	if start <= leftSize && leftSize < end {
+		*lines = append(*lines, n.line)
+	}
+	if end > leftSize+1 {
+		n.right.collect(max(start-leftSize-1, 0), end-leftSize-1, lines)
+	}
+}
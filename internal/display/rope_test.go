@@ -0,0 +1,164 @@
+package display
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/cyamas/rizz/internal/highlighter"
+	"github.com/cyamas/rizz/internal/highlighter/lexer"
+)
+
+func TestRope(t *testing.T) {
+	h := highlighter.New(lexer.New())
+	r := newRope(nil)
+	expected := []*Line{}
+	rng := rand.New(rand.NewSource(1))
+	for i := range 5000 {
+		switch {
+		case len(expected) > 0 && rng.Intn(3) == 0:
+			idx := rng.Intn(len(expected))
+			removed := r.remove(idx)
+			if removed != expected[idx] {
+				t.Fatalf("step %d: removed wrong line at %d", i, idx)
+			}
+			expected = append(expected[:idx], expected[idx+1:]...)
+		default:
+			idx := rng.Intn(len(expected) + 1)
+			line := testLine(fmt.Sprintf("line %d", i), h)
+			r.insert(idx, line)
+			expected = append(expected, nil)
+			copy(expected[idx+1:], expected[idx:])
+			expected[idx] = line
+		}
+		if r.length() != len(expected) {
+			t.Fatalf("step %d: length should be %d. Got %d", i, len(expected), r.length())
+		}
+	}
+
+	for i := range expected {
+		if r.get(i) != expected[i] {
+			t.Fatalf("line %d should be %s. Got %s", i, string(expected[i].runes), string(r.get(i).runes))
+		}
+	}
+
+	tests := []struct {
+		start, end int
+	}{
+		{0, 0},
+		{0, 10},
+		{5, 49},
+		{len(expected) - 20, len(expected)},
+		{0, len(expected)},
+	}
+	for _, tt := range tests {
+		res := r.slice(tt.start, tt.end)
+		if len(res) != tt.end-tt.start {
+			t.Fatalf("slice(%d, %d) length should be %d. Got %d", tt.start, tt.end, tt.end-tt.start, len(res))
+		}
+		for i, line := range res {
+			if line != expected[tt.start+i] {
+				t.Fatalf("slice(%d, %d): line %d is wrong", tt.start, tt.end, i)
+			}
+		}
+	}
+
+	if r.root.depth() > 2*bitLength(r.length()) {
+		t.Fatalf("rope is unbalanced: height %d for %d lines", r.root.depth(), r.length())
+	}
+}
+
+func TestRopeIndexOutOfRange(t *testing.T) {
+	h := highlighter.New(lexer.New())
+	r := newRope([]*Line{testLine("one", h), testLine("two", h)})
+	tests := []struct {
+		name string
+		call func()
+	}{
+		{"get past the end", func() { r.get(2) }},
+		{"get negative", func() { r.get(-1) }},
+		{"set past the end", func() { r.set(2, testLine("three", h)) }},
+	}
+	for _, tt := range tests {
+		func() {
+			defer func() {
+				err := recover()
+				if err == nil {
+					t.Fatalf("%s should panic", tt.name)
+				}
+				if msg := fmt.Sprint(err); !strings.Contains(msg, "with length 2") {
+					t.Fatalf("%s should panic with the index and length. Got %q", tt.name, msg)
+				}
+			}()
+			tt.call()
+		}()
+	}
+}
+
+func bitLength(n int) int {
+	count := 0
+	for ; n > 0; n >>= 1 {
+		count++
+	}
+	return count
+}
+
+var benchSizes = []int{1000, 10000, 100000}
+
+func benchLines(num int, h *highlighter.Highlighter) []*Line {
+	lines := []*Line{}
+	for i := range num {
+		lines = append(lines, testLine(fmt.Sprintf("%d: this is a test line", i), h))
+	}
+	return lines
+}
+
+// sliceInsertNewLine and sliceRemoveLine reproduce the []*Line storage that
+// LineArray used before the rope so the benchmarks have a baseline.
+func sliceInsertNewLine(lines []*Line, idx int, line *Line) []*Line {
+	lines = append(lines, nil)
+	copy(lines[idx+1:], lines[idx:])
+	lines[idx] = line
+	return lines
+}
+
+func sliceRemoveLine(lines []*Line, idx int) []*Line {
+	return append(lines[:idx], lines[idx+1:]...)
+}
+
+func BenchmarkInsertRemoveNearTop(b *testing.B) {
+	h := highlighter.New(lexer.New())
+	line := testLine("inserted", h)
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprintf("rope/%d", size), func(b *testing.B) {
+			la := &LineArray{lines: newRope(benchLines(size, h))}
+			b.ResetTimer()
+			for range b.N {
+				la.insertLine(1, line)
+				la.removeLine(1)
+			}
+		})
+		b.Run(fmt.Sprintf("slice/%d", size), func(b *testing.B) {
+			lines := benchLines(size, h)
+			b.ResetTimer()
+			for range b.N {
+				lines = sliceInsertNewLine(lines, 1, line)
+				lines = sliceRemoveLine(lines, 1)
+			}
+		})
+	}
+}
+
+func BenchmarkLineAccess(b *testing.B) {
+	h := highlighter.New(lexer.New())
+	for _, size := range benchSizes {
+		b.Run(fmt.Sprintf("rope/%d", size), func(b *testing.B) {
+			la := &LineArray{lines: newRope(benchLines(size, h))}
+			b.ResetTimer()
+			for i := range b.N {
+				la.slice(i%(size-50), i%(size-50)+50)
+			}
+		})
+	}
+}
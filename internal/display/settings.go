@@ -0,0 +1,81 @@
+package display
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+)
+
+type Settings struct {
+	TabWidth   int
+	ShiftWidth int
+	ExpandTab  bool
+	// SideScrollOff is how many columns are kept between the cursor and the
+	// edges of a window that scrolls sideways.
+	SideScrollOff int
+}
+
+func defaultSettings() Settings {
+	return Settings{TabWidth: 8, ShiftWidth: 8, ExpandTab: false, SideScrollOff: 5}
+}
+
+var filetypeSettings = map[string]Settings{
+	".py":   {TabWidth: 4, ShiftWidth: 4, ExpandTab: true},
+	".yaml": {TabWidth: 2, ShiftWidth: 2, ExpandTab: true},
+	".yml":  {TabWidth: 2, ShiftWidth: 2, ExpandTab: true},
+	".json": {TabWidth: 2, ShiftWidth: 2, ExpandTab: true},
+}
+
+func settingsForPath(path string) Settings {
+	s := defaultSettings()
+	if ft, ok := filetypeSettings[filepath.Ext(path)]; ok {
+		s.TabWidth, s.ShiftWidth, s.ExpandTab = ft.TabWidth, ft.ShiftWidth, ft.ExpandTab
+	}
+	return s
+}
+
+func (b *Buffer) Settings() Settings {
+	return b.settings
+}
+
+func (b *Buffer) SetOption(name, value string) error {
+	switch name {
+	case "tabwidth", "ts", "shiftwidth", "sw":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid %s: %q", name, value)
+		}
+		if name == "tabwidth" || name == "ts" {
+			b.settings.TabWidth = n
+		} else {
+			b.settings.ShiftWidth = n
+		}
+	case "expandtab", "et":
+		b.settings.ExpandTab = true
+	case "noexpandtab", "noet":
+		b.settings.ExpandTab = false
+	case "sidescrolloff", "siso":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid %s: %q", name, value)
+		}
+		b.settings.SideScrollOff = n
+	default:
+		return fmt.Errorf("unknown option: %s", name)
+	}
+	return nil
+}
+
+func (s Settings) indentRunes(col int) []rune {
+	indent := []rune{}
+	if !s.ExpandTab {
+		for range col / s.TabWidth {
+			indent = append(indent, '\t')
+		}
+		col %= s.TabWidth
+	}
+	for range col {
+		indent = append(indent, ' ')
+	}
+	return indent
+}
@@ -0,0 +1,245 @@
+package display
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// swapFile is what gets written for a buffer with unsaved changes so the
+// edits survive a crash or a lost terminal.
+type swapFile struct {
+	PID   int       `json:"pid"`
+	Host  string    `json:"host"`
+	Path  string    `json:"path"`
+	Time  time.Time `json:"time"`
+	Lines []string  `json:"lines"`
+}
+
+type hangup struct{}
+
+// stateDir returns the directory rizz keeps per-file state of the given kind
+// in, following the XDG base directory spec.
+func stateDir(kind string) (string, error) {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "rizz", kind), nil
+}
+
+// statePath names the state file of the given kind for path, with the path
+// separators flattened so every file gets its own entry.
+func statePath(kind, path, ext string) (string, error) {
+	dir, err := stateDir(kind)
+	if err != nil {
+		return "", err
+	}
+	name := strings.ReplaceAll(filepath.ToSlash(path), "/", "%") + ext
+	return filepath.Join(dir, name), nil
+}
+
+func (b *Buffer) swapPath() (string, error) {
+	if b.path == "" {
+		return "", errors.New("no file name")
+	}
+	return statePath("swap", b.path, ".swp")
+}
+
+func (b *Buffer) writeSwap() error {
+	path, err := b.swapPath()
+	if err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	data, err := json.Marshal(swapFile{
+		PID:   os.Getpid(),
+		Host:  host,
+		Path:  b.path,
+		Time:  time.Now(),
+		Lines: b.lineStrings(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return err
+	}
+	b.swapEdits = b.edits
+	b.hasSwap = true
+	return nil
+}
+
+func (b *Buffer) removeSwap() error {
+	if !b.hasSwap {
+		return nil
+	}
+	path, err := b.swapPath()
+	if err != nil {
+		return err
+	}
+	b.hasSwap = false
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// flushSwap brings the swap file in line with the buffer: written when there
+// are unsaved edits it does not hold yet, removed once the buffer is clean.
+func (b *Buffer) flushSwap() error {
+	if b.path == "" || b.noSwap {
+		return nil
+	}
+	if !b.modified {
+		return b.removeSwap()
+	}
+	if b.hasSwap && b.swapEdits == b.edits {
+		return nil
+	}
+	return b.writeSwap()
+}
+
+func (b *Buffer) readSwap() (*swapFile, error) {
+	path, err := b.swapPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	swap := &swapFile{}
+	if err := json.Unmarshal(data, swap); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return swap, nil
+}
+
+func (b *Buffer) recoverSwap(swap *swapFile) {
+	b.content = lineArrayFromStrings(swap.Lines, b.highlighter)
+	b.history = NewHistory()
+	b.markChanged()
+	b.hasSwap = true
+}
+
+// ownerAlive reports whether the process that wrote the swap file is still
+// running on this machine, i.e. the file is open in another rizz.
+func (s *swapFile) ownerAlive() bool {
+	host, _ := os.Hostname()
+	if s.PID == os.Getpid() || s.Host != host {
+		return false
+	}
+	p, err := os.FindProcess(s.PID)
+	if err != nil {
+		return false
+	}
+	return p.Signal(syscall.Signal(0)) == nil
+}
+
+// WriteSwapFiles writes the swap file of every modified buffer right away. It
+// is meant for the panic handler, where the event loop is no longer running.
+func (d *Display) WriteSwapFiles() {
+	for _, buf := range d.buffers {
+		if buf.modified {
+			buf.writeSwap()
+		}
+	}
+}
+
+func (d *Display) flushSwapFiles() {
+	for _, buf := range d.buffers {
+		if err := buf.flushSwap(); err != nil {
+			d.ShowError(fmt.Errorf("swap file: %w", err))
+		}
+	}
+}
+
+func (d *Display) removeSwapFiles() {
+	for _, buf := range d.buffers {
+		buf.removeSwap()
+	}
+}
+
+func (d *Display) watchSignals(stop <-chan struct{}) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	select {
+	case <-stop:
+	case <-sigs:
+		d.Screen.PostEvent(tcell.NewEventInterrupt(hangup{}))
+	}
+}
+
+func (d *Display) hangUp() {
+	d.WriteSwapFiles()
+	d.keepSwaps = true
+	d.Mode = Exit
+}
+
+// CheckSwapFile looks for a swap file left behind for the active buffer and
+// asks what to do with it.
+func (d *Display) CheckSwapFile() {
+	buf := d.ActiveBuf
+	buf.swapChecked = true
+	if buf.path == "" {
+		return
+	}
+	swap, err := buf.readSwap()
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && swap.Path != buf.path) {
+		return
+	}
+	if err != nil {
+		d.ShowError(err)
+		return
+	}
+	message := fmt.Sprintf("Found swap file from %s.", swap.Time.Format(time.DateTime))
+	if swap.ownerAlive() {
+		message = fmt.Sprintf("File is being edited by another rizz (pid %d).", swap.PID)
+	}
+	d.ask(message,
+		choice{'r', "ecover", func() { d.recoverActiveBuf(swap) }},
+		choice{'d', "iff", func() { d.showSwapDiff(swap) }},
+		choice{'x', " delete", d.deleteSwap},
+		choice{'i', "gnore", func() { buf.noSwap = swap.ownerAlive() }},
+	)
+}
+
+func (d *Display) recoverActiveBuf(swap *swapFile) {
+	d.clearBufWindow()
+	d.ActiveBuf.recoverSwap(swap)
+	d.bufWindow.update(0)
+	d.bufWindow.cur.X, d.bufWindow.cur.Y = LeftMarginSize, 0
+	d.SetBufWindow()
+	d.setBufPos()
+	d.showMessage(fmt.Sprintf("Recovered \"%s\" from swap file", swap.Path))
+}
+
+func (d *Display) showSwapDiff(swap *swapFile) {
+	title := "Diff against swap file"
+	d.showDiff(title, unifiedDiff(swap.Path, swap.Path+" (swap)", d.ActiveBuf.lineStrings(), swap.Lines), Prompt)
+}
+
+func (d *Display) deleteSwap() {
+	d.ActiveBuf.hasSwap = true
+	if err := d.ActiveBuf.removeSwap(); err != nil {
+		d.ShowError(err)
+	}
+}
@@ -0,0 +1,293 @@
+package display
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// maxUndoFileSize caps the undo file; the oldest states are dropped first.
+const maxUndoFileSize = 1 << 20
+
+type undoFile struct {
+	Path    string       `json:"path"`
+	Hash    string       `json:"hash"`
+	Current int          `json:"current"`
+	Nodes   []nodeOnDisk `json:"nodes"`
+}
+
+// nodeOnDisk is an undoNode with its links stored as sequence numbers. The
+// root has parent -1 and no record.
+type nodeOnDisk struct {
+	Seq    int           `json:"seq"`
+	Parent int           `json:"parent"`
+	Redo   int           `json:"redo"`
+	Time   time.Time     `json:"time"`
+	Record *recordOnDisk `json:"record,omitempty"`
+}
+
+type recordOnDisk struct {
+	Action Action         `json:"action"`
+	Before positionOnDisk `json:"before"`
+	After  positionOnDisk `json:"after"`
+	Edits  []editOnDisk   `json:"edits"`
+}
+
+type positionOnDisk struct {
+	Line int `json:"line"`
+	Col  int `json:"col"`
+}
+
+type editOnDisk struct {
+	Pos positionOnDisk `json:"pos"`
+	Old string         `json:"old"`
+	New string         `json:"new"`
+}
+
+func toDisk(pos position) positionOnDisk {
+	return positionOnDisk{Line: pos.line, Col: pos.col}
+}
+
+func (p positionOnDisk) position() position {
+	return position{line: p.Line, col: p.Col}
+}
+
+func (b *Buffer) undoPath() (string, error) {
+	if b.path == "" {
+		return "", errors.New("no file name")
+	}
+	return statePath("undo", b.path, ".json")
+}
+
+func (b *Buffer) writeUndoFile() error {
+	path, err := b.undoPath()
+	if err != nil {
+		return err
+	}
+	h := b.history
+	if len(h.nodes) == 1 {
+		return b.removeUndoFile()
+	}
+	data, err := json.Marshal(undoFile{
+		Path:    b.path,
+		Hash:    hex.EncodeToString(b.disk.hash[:]),
+		Current: h.curr.seq,
+		Nodes:   capTree(nodesOnDisk(h), h.curr.seq, maxUndoFileSize),
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+func nodesOnDisk(h *History) []nodeOnDisk {
+	nodes := []nodeOnDisk{}
+	for _, n := range h.nodes {
+		node := nodeOnDisk{Seq: n.seq, Parent: -1, Redo: -1, Time: n.time}
+		if n.parent != nil {
+			node.Parent = n.parent.seq
+			node.Record = recordToDisk(n.record)
+		}
+		if len(n.children) > 0 {
+			node.Redo = n.children[n.redo].seq
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+func recordToDisk(r *Record) *recordOnDisk {
+	edits := []editOnDisk{}
+	for _, e := range r.edits {
+		edits = append(edits, editOnDisk{
+			Pos: toDisk(e.pos),
+			Old: string(e.oldText),
+			New: string(e.newText),
+		})
+	}
+	return &recordOnDisk{
+		Action: r.action,
+		Before: toDisk(r.before),
+		After:  toDisk(r.after),
+		Edits:  edits,
+	}
+}
+
+// capTree drops states until the encoded nodes fit in limit bytes: first the
+// branches off the root that do not lead to the current state, then the root
+// itself, moving it one state closer to the current one. Once the current
+// state is the root, the states that can only be redone go last.
+func capTree(nodes []nodeOnDisk, current, limit int) []nodeOnDisk {
+	size := func(n nodeOnDisk) int {
+		data, _ := json.Marshal(n)
+		return len(data) + 1
+	}
+	bySeq := map[int]*nodeOnDisk{}
+	children := map[int][]int{}
+	total := 0
+	root := -1
+	for i := range nodes {
+		n := &nodes[i]
+		bySeq[n.Seq] = n
+		children[n.Parent] = append(children[n.Parent], n.Seq)
+		total += size(*n)
+		if n.Parent == -1 {
+			root = n.Seq
+		}
+	}
+	toCurrent := map[int]bool{}
+	for seq := current; seq != -1; seq = bySeq[seq].Parent {
+		toCurrent[seq] = true
+	}
+	var drop func(seq int)
+	drop = func(seq int) {
+		for _, child := range children[seq] {
+			drop(child)
+		}
+		total -= size(*bySeq[seq])
+		delete(bySeq, seq)
+	}
+	for total > limit {
+		branches := []int{}
+		for _, child := range children[root] {
+			if _, ok := bySeq[child]; ok && !toCurrent[child] {
+				branches = append(branches, child)
+			}
+		}
+		switch {
+		case len(branches) > 0 && root != current:
+			drop(branches[0])
+		case root != current:
+			next := -1
+			for _, child := range children[root] {
+				if toCurrent[child] {
+					next = child
+				}
+			}
+			total -= size(*bySeq[root])
+			delete(bySeq, root)
+			n := bySeq[next]
+			total -= size(*n)
+			n.Parent, n.Record = -1, nil
+			total += size(*n)
+			root = next
+		case len(branches) > 0:
+			drop(branches[0])
+		default:
+			return keptNodes(nodes, bySeq)
+		}
+	}
+	return keptNodes(nodes, bySeq)
+}
+
+func keptNodes(nodes []nodeOnDisk, kept map[int]*nodeOnDisk) []nodeOnDisk {
+	result := []nodeOnDisk{}
+	for _, n := range nodes {
+		if k, ok := kept[n.Seq]; ok {
+			result = append(result, *k)
+		}
+	}
+	return result
+}
+
+// loadUndoFile restores the history saved alongside the file, as long as the
+// file has not changed since.
+func (b *Buffer) loadUndoFile() *History {
+	path, err := b.undoPath()
+	if err != nil || !b.disk.exists {
+		return NewHistory()
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return NewHistory()
+	}
+	saved := undoFile{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return NewHistory()
+	}
+	if saved.Path != b.path || saved.Hash != hex.EncodeToString(b.disk.hash[:]) {
+		return NewHistory()
+	}
+	history, ok := historyFromDisk(saved)
+	if !ok {
+		return NewHistory()
+	}
+	return history
+}
+
+func historyFromDisk(saved undoFile) (*History, bool) {
+	h := &History{savedReachable: true}
+	bySeq := map[int]*undoNode{}
+	redo := map[*undoNode]int{}
+	for _, n := range saved.Nodes {
+		node := &undoNode{seq: n.Seq, time: n.Time}
+		if n.Parent == -1 {
+			if h.root != nil {
+				return nil, false
+			}
+			h.root = node
+		} else {
+			parent, ok := bySeq[n.Parent]
+			if !ok || n.Record == nil {
+				return nil, false
+			}
+			node.parent = parent
+			node.record = recordFromDisk(n.Record)
+			parent.children = append(parent.children, node)
+		}
+		bySeq[n.Seq] = node
+		redo[node] = n.Redo
+		h.nodes = append(h.nodes, node)
+	}
+	h.curr = bySeq[saved.Current]
+	if h.root == nil || h.curr == nil {
+		return nil, false
+	}
+	for node, seq := range redo {
+		node.redo = max(len(node.children)-1, 0)
+		if child, ok := bySeq[seq]; ok && child.parent == node {
+			node.redo = slices.Index(node.children, child)
+		}
+	}
+	h.markSaved()
+	return h, true
+}
+
+func recordFromDisk(r *recordOnDisk) *Record {
+	edits := []*Edit{}
+	for _, e := range r.Edits {
+		edits = append(edits, newEdit(e.Pos.position(), []rune(e.Old), []rune(e.New)))
+	}
+	return CreateRecord(r.Action, r.Before.position(), r.After.position(), edits...)
+}
+
+func (b *Buffer) removeUndoFile() error {
+	path, err := b.undoPath()
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// ClearUndoHistory forgets the undo history, both in memory and on disk.
+func (b *Buffer) ClearUndoHistory() error {
+	b.history = NewHistory()
+	if b.modified {
+		b.history.markUnrecordedEdit()
+	}
+	if b.path == "" {
+		return nil
+	}
+	return b.removeUndoFile()
+}
@@ -0,0 +1,199 @@
+package display
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// parseUndoTarget reads the argument of earlier and later: a number of states,
+// or an amount of time such as 30s, 5m, 2h or 1d.
+func parseUndoTarget(arg string) (int, time.Duration, error) {
+	if arg == "" {
+		return 1, 0, nil
+	}
+	if n, err := strconv.Atoi(arg); err == nil && n >= 0 {
+		return n, 0, nil
+	}
+	units := map[byte]time.Duration{'s': time.Second, 'm': time.Minute, 'h': time.Hour, 'd': 24 * time.Hour}
+	unit, ok := units[arg[len(arg)-1]]
+	n, err := strconv.Atoi(arg[:len(arg)-1])
+	if !ok || err != nil || n < 0 {
+		return 0, 0, fmt.Errorf("invalid count or time: %q", arg)
+	}
+	return 0, time.Duration(n) * unit, nil
+}
+
+// Earlier moves the buffer back to an older state, by count or by time.
+func (d *Display) Earlier(arg string) error {
+	return d.timeTravel(arg, -1)
+}
+
+// Later moves the buffer forward to a newer state, by count or by time.
+func (d *Display) Later(arg string) error {
+	return d.timeTravel(arg, 1)
+}
+
+func (d *Display) timeTravel(arg string, dir int) error {
+	steps, dur, err := parseUndoTarget(arg)
+	if err != nil {
+		return err
+	}
+	h := d.ActiveBuf.history
+	target := h.stepTarget(dir * steps)
+	if dur != 0 {
+		target = h.timeTarget(h.curr.time.Add(time.Duration(dir) * dur))
+	}
+	d.restoreUndoState(target)
+	return nil
+}
+
+func (d *Display) restoreUndoState(target *undoNode) {
+	d.clearBufWindow()
+	buf := d.ActiveBuf
+	if pos, ok := buf.history.gotoNode(target, buf.content, buf.highlighter); ok {
+		d.moveToBufPos(pos)
+	}
+	buf.updateModified()
+	d.SetBufWindow()
+	d.showMessage(fmt.Sprintf("state %d of %d, %s", target.seq, buf.history.lastNode().seq, target.time.Format(time.TimeOnly)))
+}
+
+// previewUndoState returns the lines of the buffer as they were at target.
+// The history is walked over a copy of the lines, so the buffer and the
+// windows showing it keep theirs.
+func (b *Buffer) previewUndoState(target *undoNode) []string {
+	h := b.history
+	curr := h.curr
+	redo := curr.redo
+	content := lineArrayFromStrings(b.lineStrings(), b.highlighter)
+	h.gotoNode(target, content, b.highlighter)
+	lines := content.lineStrings()
+	h.gotoNode(curr, content, b.highlighter)
+	curr.redo = redo
+	return lines
+}
+
+type undoTreeRow struct {
+	node  *undoNode
+	depth int
+}
+
+// undoTreeRows lists the states depth first. The newest child of a state
+// continues its column and older branches are indented under it.
+func (h *History) undoTreeRows() []undoTreeRow {
+	rows := []undoTreeRow{}
+	var walk func(n *undoNode, depth int)
+	walk = func(n *undoNode, depth int) {
+		rows = append(rows, undoTreeRow{n, depth})
+		for i, child := range n.children {
+			if i < len(n.children)-1 {
+				walk(child, depth+1)
+			}
+		}
+		if len(n.children) > 0 {
+			walk(n.children[len(n.children)-1], depth)
+		}
+	}
+	walk(h.root, 0)
+	return rows
+}
+
+func (h *History) undoTreeRowText(row undoTreeRow) string {
+	marker := "o"
+	if row.node == h.curr {
+		marker = "@"
+	}
+	action := "original"
+	if row.node.record != nil {
+		action = strings.ToLower(string(row.node.record.action))
+	}
+	text := fmt.Sprintf("%s%s %4d  %s  %s", strings.Repeat("| ", row.depth), marker, row.node.seq, row.node.time.Format(time.TimeOnly), action)
+	if row.node == h.savedNode && h.savedReachable {
+		text += "  (saved)"
+	}
+	return text
+}
+
+func (d *Display) showUndoTree() {
+	d.undoTreeRows = d.ActiveBuf.history.undoTreeRows()
+	d.undoTreeSel = 0
+	for i, row := range d.undoTreeRows {
+		if row.node == d.ActiveBuf.history.curr {
+			d.undoTreeSel = i
+		}
+	}
+	d.undoTreeTop = max(d.undoTreeSel-(d.height-1)/2, 0)
+	d.Mode = UndoTree
+	d.Screen.HideCursor()
+}
+
+func (d *Display) drawUndoTree() {
+	h := d.ActiveBuf.history
+	for y := 0; y < d.height-1; y++ {
+		text := []rune{}
+		style := d.BufStyle
+		if idx := d.undoTreeTop + y; idx < len(d.undoTreeRows) {
+			text = []rune(h.undoTreeRowText(d.undoTreeRows[idx]))
+			if idx == d.undoTreeSel {
+				style = style.Reverse(true)
+			}
+		}
+		for x := 0; x < d.width; x++ {
+			r := ' '
+			if x < len(text) {
+				r = text[x]
+			}
+			d.Screen.SetContent(x, y, r, nil, style)
+		}
+	}
+	d.drawStatusBar([]rune("Undo tree (j/k to move, p to preview, Enter to restore, q to go back)"), d.StatusBarStyle)
+}
+
+func (d *Display) runUndoTreeMode(ev tcell.Event) {
+	switch ev := ev.(type) {
+	case *tcell.EventKey:
+		switch {
+		case ev.Rune() == 'j':
+			if d.undoTreeSel < len(d.undoTreeRows)-1 {
+				d.undoTreeSel++
+			}
+		case ev.Rune() == 'k':
+			if d.undoTreeSel > 0 {
+				d.undoTreeSel--
+			}
+		case ev.Rune() == 'p':
+			d.previewSelectedState()
+		case ev.Key() == tcell.KeyEnter:
+			d.closeUndoTree()
+			d.restoreUndoState(d.undoTreeRows[d.undoTreeSel].node)
+		case ev.Rune() == 'q' || ev.Key() == tcell.KeyEscape:
+			d.closeUndoTree()
+		}
+	}
+	if d.undoTreeSel < d.undoTreeTop {
+		d.undoTreeTop = d.undoTreeSel
+	}
+	if d.undoTreeSel >= d.undoTreeTop+d.height-1 {
+		d.undoTreeTop = d.undoTreeSel - d.height + 2
+	}
+}
+
+func (d *Display) previewSelectedState() {
+	buf := d.ActiveBuf
+	node := d.undoTreeRows[d.undoTreeSel].node
+	curr := buf.lineStrings()
+	lines := buf.previewUndoState(node)
+	name := fmt.Sprintf("state %d", node.seq)
+	d.showDiff("Preview of "+name, unifiedDiff("current", name, curr, lines), UndoTree)
+}
+
+func (d *Display) closeUndoTree() {
+	d.Mode = Normal
+	d.Screen.Clear()
+	d.bufWindow.update(d.bufWindow.bufIdx)
+	d.SetBufWindow()
+}
@@ -0,0 +1,486 @@
+package display
+
+import (
+	"fmt"
+	"slices"
+	"unicode"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+type visualKind int
+
+const (
+	visualChar visualKind = iota
+	visualLine
+	visualBlock
+)
+
+var visualNames = map[visualKind]string{
+	visualChar:  "Visual",
+	visualLine:  "Visual Line",
+	visualBlock: "Visual Block",
+}
+
+// blockInsert is a change of a block selection in progress. The text typed
+// on the first line is repeated on the other lines when insert mode ends.
+type blockInsert struct {
+	first, last int
+	col         int
+	length      int
+}
+
+func (d *Display) startVisual(kind visualKind) {
+	d.setBufPos()
+	d.visual = kind
+	d.visualStart = d.bufWindow.bufPos()
+	d.Mode = Visual
+}
+
+func (d *Display) exitVisual() {
+	d.Mode = Normal
+	d.drawWindow(d.bufWindow)
+}
+
+func (d *Display) runVisualMode(ev tcell.Event) {
+	key, ok := ev.(*tcell.EventKey)
+	if !ok {
+		return
+	}
+	switch key.Key() {
+	case tcell.KeyEscape, tcell.KeyCtrlN:
+		d.exitVisual()
+		return
+	case tcell.KeyCtrlV:
+		d.switchVisual(visualBlock)
+		return
+	}
+	switch key.Rune() {
+	case 'h':
+		d.moveCursorLeft()
+	case 'l':
+		d.moveCursorRight()
+	case 'j':
+		d.moveCursorDown()
+	case 'k':
+		d.moveCursorUp()
+	case 'J':
+		d.moveCursorHalfWindowDown()
+	case 'K':
+		d.moveCursorHalfWindowUp()
+	case 'w':
+		d.moveCursorToNextWord()
+	case 'b':
+		d.moveCursorToPrevWord()
+	case 'o':
+		pos := d.bufWindow.bufPos()
+		d.moveToBufPos(d.visualStart)
+		d.visualStart = pos
+	case '"':
+		d.startRegister()
+	case 'v':
+		d.switchVisual(visualChar)
+	case 'V':
+		d.switchVisual(visualLine)
+	case 'd', 'x':
+		d.deleteSelection()
+		d.exitVisual()
+	case 'y':
+		d.yankSelection()
+		d.exitVisual()
+	case 'c':
+		d.changeSelection()
+	case '>':
+		d.indentSelection(1)
+		d.exitVisual()
+	case '<':
+		d.indentSelection(-1)
+		d.exitVisual()
+	case '~':
+		d.mapSelection(toggleCase)
+		d.exitVisual()
+	case 'u':
+		d.mapSelection(unicode.ToLower)
+		d.exitVisual()
+	case 'U':
+		d.mapSelection(unicode.ToUpper)
+		d.exitVisual()
+	}
+	d.setBufPos()
+}
+
+// switchVisual changes the kind of selection, or leaves visual mode when it
+// already is of that kind.
+func (d *Display) switchVisual(kind visualKind) {
+	if d.visual == kind {
+		d.exitVisual()
+		return
+	}
+	d.visual = kind
+}
+
+func toggleCase(r rune) rune {
+	if unicode.IsUpper(r) {
+		return unicode.ToLower(r)
+	}
+	return unicode.ToUpper(r)
+}
+
+// selection returns the ends of the selection in buffer order. Both ends are
+// included in it.
+func (d *Display) selection() (position, position) {
+	start, end := d.visualStart, d.bufWindow.bufPos()
+	if end.line < start.line || end.line == start.line && end.col < start.col {
+		start, end = end, start
+	}
+	return start, end
+}
+
+// blockColumns returns the screen columns a block selection covers, from
+// left up to right.
+func (d *Display) blockColumns() (int, int) {
+	tw := d.tabWidth()
+	a, b := d.visualStart, d.bufWindow.bufPos()
+	aLeft, aRight := d.ActiveBuf.getLine(a.line).clusterColumns(a.col, tw)
+	bLeft, bRight := d.ActiveBuf.getLine(b.line).clusterColumns(b.col, tw)
+	return min(aLeft, bLeft), max(aRight, bRight)
+}
+
+// clusterColumns returns the screen columns the cluster at idx covers. Past
+// the end of the line it takes up a single column.
+func (l *Line) clusterColumns(idx, tabWidth int) (int, int) {
+	for _, c := range l.clusters(tabWidth) {
+		if c.start == idx {
+			return c.col, c.col + c.width
+		}
+	}
+	width := l.displayWidth(tabWidth)
+	return width, width + 1
+}
+
+// columnRange returns the indexes of the clusters that are at least partly
+// within the screen columns left up to right.
+func (l *Line) columnRange(left, right, tabWidth int) (int, int) {
+	start, end := len(l.runes), len(l.runes)
+	for _, c := range l.clusters(tabWidth) {
+		if start == len(l.runes) && c.col+c.width > left {
+			start = c.start
+		}
+		if c.col >= right {
+			end = c.start
+			break
+		}
+	}
+	return start, max(start, end)
+}
+
+// selectedClusters returns whether each cluster of a line of bw is selected,
+// or nil when none of the line is.
+func (d *Display) selectedClusters(bw *BufWindow, idx int, line *Line) func(cluster) bool {
+	if d.Mode != Visual || bw != d.bufWindow {
+		return nil
+	}
+	start, end := d.selection()
+	if idx < start.line || idx > end.line {
+		return nil
+	}
+	switch d.visual {
+	case visualLine:
+		return func(cluster) bool { return true }
+	case visualBlock:
+		left, right := d.blockColumns()
+		return func(c cluster) bool { return c.col+c.width > left && c.col < right }
+	}
+	return func(c cluster) bool {
+		return (idx > start.line || c.start >= start.col) && (idx < end.line || c.start <= end.col)
+	}
+}
+
+func (d *Display) selectionStyle(style tcell.Style) tcell.Style {
+	_, bg, _ := d.SelectionStyle.Decompose()
+	return style.Background(bg)
+}
+
+// selectedLines returns the first and last line the selection touches.
+func (d *Display) selectedLines() (int, int) {
+	start, end := d.selection()
+	return start.line, end.line
+}
+
+// selectedText returns the text of the selection, and for a charwise
+// selection the position just past its end.
+func (d *Display) selectedText() (register, position) {
+	la := d.ActiveBuf.content
+	start, end := d.selection()
+	switch d.visual {
+	case visualLine:
+		return register{visualLine, la.regionText(start.line, end.line)}, end
+	case visualBlock:
+		left, right := d.blockColumns()
+		text := []rune{}
+		for i := start.line; i <= end.line; i++ {
+			line := la.line(i)
+			s, e := line.columnRange(left, right, d.tabWidth())
+			text = append(text, line.runes[s:e]...)
+			text = append(text, '\n')
+		}
+		return register{visualBlock, text}, end
+	}
+	after := d.afterSelection()
+	return register{visualChar, la.textBetween(start, after)}, after
+}
+
+// afterSelection returns the position just past the end of a charwise
+// selection, which is on the next line when the selection takes in the line
+// break.
+func (d *Display) afterSelection() position {
+	la := d.ActiveBuf.content
+	_, end := d.selection()
+	line := la.line(end.line)
+	if end.col >= line.length() && end.line < la.length()-1 {
+		return position{line: end.line + 1}
+	}
+	return position{line: end.line, col: line.nextCluster(end.col)}
+}
+
+// textBetween returns the text from one position up to another.
+func (la *LineArray) textBetween(from, to position) []rune {
+	text := []rune{}
+	for i := from.line; i <= to.line; i++ {
+		runes := la.line(i).runes
+		lo, hi := 0, len(runes)
+		if i == from.line {
+			lo = min(from.col, hi)
+		}
+		if i == to.line {
+			hi = min(to.col, hi)
+		}
+		text = append(text, runes[lo:hi]...)
+		if i < to.line {
+			text = append(text, '\n')
+		}
+	}
+	return text
+}
+
+func (d *Display) yankSelection() {
+	text, _ := d.selectedText()
+	err := d.storeRegister(text)
+	start, _ := d.selection()
+	if d.visual == visualBlock {
+		left, _ := d.blockColumns()
+		start.col = d.ActiveBuf.getLine(start.line).indexAt(left, d.tabWidth())
+	}
+	d.moveToBufPos(start)
+	if err != nil {
+		d.ShowError(err)
+		return
+	}
+	d.showMessage(yankMessage(text, "yanked"))
+}
+
+func yankMessage(text register, verb string) string {
+	n := countLines(text.text)
+	switch {
+	case text.kind == visualBlock:
+		return fmt.Sprintf("block of %d lines %s", n, verb)
+	case text.kind == visualChar && n <= 1:
+		return fmt.Sprintf("%d characters %s", len(text.text), verb)
+	}
+	return fmt.Sprintf("%d lines %s", n, verb)
+}
+
+func countLines(text []rune) int {
+	n := 0
+	for _, r := range text {
+		if r == '\n' {
+			n++
+		}
+	}
+	if len(text) > 0 && text[len(text)-1] != '\n' {
+		n++
+	}
+	return n
+}
+
+// editSelection runs edit on the selection, given by its ends, as one
+// undoable change and leaves the cursor on the position edit returns.
+func (d *Display) editSelection(action Action, edit func(start, end position) position) {
+	start, end := d.selection()
+	last := end.line
+	if d.visual == visualChar {
+		// a line break at the end joins the next line on, which the undo
+		// step has to cover too
+		last = d.afterSelection().line
+	}
+	d.clearBufWindow()
+	d.moveToBufPos(start)
+	d.beginEdit(start.line, last)
+	pos := edit(start, end)
+	d.moveToBufPos(pos)
+	d.endEdit(action)
+	d.bufWindow.update(d.bufWindow.bufIdx)
+	d.SetBufWindow()
+}
+
+func (d *Display) deleteSelection() {
+	text, after := d.selectedText()
+	err := d.storeRegister(text)
+	left, right := d.blockColumns()
+	d.editSelection(DELETE, func(start, end position) position {
+		la := d.ActiveBuf.content
+		switch d.visual {
+		case visualLine:
+			la.replaceLines(d.Highlighter, start.line, end.line, nil)
+			line := min(start.line, la.length()-1)
+			return position{line: line, col: la.line(line).firstWordIndex()}
+		case visualBlock:
+			lines := []rune{}
+			for i := start.line; i <= end.line; i++ {
+				line := la.line(i)
+				s, e := line.columnRange(left, right, d.tabWidth())
+				lines = append(lines, line.runes[:s]...)
+				lines = append(lines, line.runes[e:]...)
+				lines = append(lines, '\n')
+			}
+			la.replaceLines(d.Highlighter, start.line, end.line, lines)
+			return position{line: start.line, col: la.line(start.line).indexAt(left, d.tabWidth())}
+		}
+		la.replaceText(d.Highlighter, start, la.textBetween(start, after), nil)
+		return start
+	})
+	switch {
+	case err != nil:
+		d.ShowError(err)
+	case text.kind != visualChar || countLines(text.text) > 1:
+		d.showMessage(yankMessage(text, "deleted"))
+	}
+}
+
+// changeSelection deletes the selection and starts insert mode in its place.
+// Changed lines are replaced by an empty one, and a changed block gets what
+// is typed on each of its lines.
+func (d *Display) changeSelection() {
+	switch d.visual {
+	case visualLine:
+		text, _ := d.selectedText()
+		if err := d.storeRegister(text); err != nil {
+			d.ShowError(err)
+		}
+		d.editSelection(DELETE, func(start, end position) position {
+			d.ActiveBuf.content.replaceLines(d.Highlighter, start.line, end.line, []rune{'\n'})
+			return position{line: start.line}
+		})
+	case visualBlock:
+		first, last := d.selectedLines()
+		d.deleteSelection()
+		d.blockInsert = &blockInsert{
+			first:  first,
+			last:   last,
+			col:    d.bufWindow.pos.X,
+			length: d.currLine().length(),
+		}
+	default:
+		d.deleteSelection()
+	}
+	d.Mode = Insert
+	d.drawWindow(d.bufWindow)
+}
+
+// finishBlockInsert repeats the text typed on the first line of a changed
+// block on the rest of its lines.
+func (d *Display) finishBlockInsert() {
+	b := d.blockInsert
+	d.blockInsert = nil
+	if b == nil || d.bufWindow.pos.Y != b.first || b.last == b.first {
+		return
+	}
+	line := d.ActiveBuf.getLine(b.first)
+	n := line.length() - b.length
+	if n <= 0 || b.col+n > line.length() {
+		return
+	}
+	text := slices.Clone(line.runes[b.col : b.col+n])
+	col := line.colAt(b.col, d.tabWidth())
+	la := d.ActiveBuf.content
+	pos := d.bufWindow.bufPos()
+	d.clearBufWindow()
+	d.beginEdit(b.first+1, b.last)
+	for i := b.first + 1; i <= b.last; i++ {
+		l := la.line(i)
+		if l.displayWidth(d.tabWidth()) < col {
+			continue
+		}
+		idx := l.indexAt(col, d.tabWidth())
+		la.replaceText(d.Highlighter, position{line: i, col: idx}, nil, text)
+	}
+	d.endEdit(ADD)
+	d.moveToBufPos(pos)
+	d.bufWindow.update(d.bufWindow.bufIdx)
+	d.SetBufWindow()
+}
+
+// indentSelection shifts the selected lines by steps of the shift width,
+// right for a positive count and left for a negative one. Blank lines are
+// left alone.
+func (d *Display) indentSelection(steps int) {
+	s := d.ActiveBuf.settings
+	first, last := d.selectedLines()
+	d.editSelection(INDENT, func(start, end position) position {
+		la := d.ActiveBuf.content
+		text := []rune{}
+		for i := start.line; i <= end.line; i++ {
+			line := la.line(i)
+			idx := line.firstWordIndex()
+			if idx < line.length() {
+				col := max(line.colAt(idx, s.TabWidth)+steps*s.ShiftWidth, 0)
+				text = append(text, s.indentRunes(col)...)
+			}
+			text = append(text, line.runes[idx:]...)
+			text = append(text, '\n')
+		}
+		la.replaceLines(d.Highlighter, start.line, end.line, text)
+		return position{line: start.line, col: la.line(start.line).firstWordIndex()}
+	})
+	if last > first {
+		d.showMessage(fmt.Sprintf("%d lines indented", last-first+1))
+	}
+}
+
+// mapSelection replaces each selected rune with what f maps it to.
+func (d *Display) mapSelection(f func(rune) rune) {
+	_, after := d.selectedText()
+	left, right := d.blockColumns()
+	d.editSelection(CHANGE_CASE, func(start, end position) position {
+		la := d.ActiveBuf.content
+		lines := []rune{}
+		for i := start.line; i <= end.line; i++ {
+			runes := slices.Clone(la.line(i).runes)
+			s, e := 0, len(runes)
+			switch {
+			case d.visual == visualBlock:
+				s, e = la.line(i).columnRange(left, right, d.tabWidth())
+			case d.visual == visualChar:
+				if i == start.line {
+					s = start.col
+				}
+				if i == after.line {
+					e = min(after.col, e)
+				}
+			}
+			for j := s; j < e; j++ {
+				runes[j] = f(runes[j])
+			}
+			lines = append(lines, runes...)
+			lines = append(lines, '\n')
+		}
+		la.replaceLines(d.Highlighter, start.line, end.line, lines)
+		switch d.visual {
+		case visualLine:
+			start.col = 0
+		case visualBlock:
+			start.col = la.line(start.line).indexAt(left, d.tabWidth())
+		}
+		return start
+	})
+}
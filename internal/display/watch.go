@@ -0,0 +1,167 @@
+package display
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+const diskCheckInterval = 2 * time.Second
+
+type diskState struct {
+	exists  bool
+	modTime time.Time
+	size    int64
+	hash    [sha256.Size]byte
+}
+
+type diskCheck struct{}
+
+func newDiskState(info fs.FileInfo, data []byte) diskState {
+	return diskState{
+		exists:  true,
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		hash:    sha256.Sum256(data),
+	}
+}
+
+func (b *Buffer) recordDiskState(data []byte) {
+	info, err := os.Stat(b.path)
+	if err != nil {
+		b.disk = diskState{}
+		return
+	}
+	b.disk = newDiskState(info, data)
+	b.seenDisk = b.disk
+}
+
+// diskChanged reports whether the file differs from known. The hash is only
+// compared when the modification time or size moved, so idle checks stay cheap.
+func (b *Buffer) diskChanged(known diskState) (diskState, bool, error) {
+	if b.path == "" {
+		return known, false, nil
+	}
+	info, err := os.Stat(b.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return diskState{}, false, nil
+	}
+	if err != nil {
+		return known, false, err
+	}
+	if known.exists && info.ModTime().Equal(known.modTime) && info.Size() == known.size {
+		return known, false, nil
+	}
+	data, err := os.ReadFile(b.path)
+	if err != nil {
+		return known, false, err
+	}
+	current := newDiskState(info, data)
+	return current, current.hash != known.hash, nil
+}
+
+func (b *Buffer) diskDiff() ([]string, error) {
+	data, err := os.ReadFile(b.path)
+	if err != nil {
+		return nil, err
+	}
+	_, text := decodeFileFormat(data, b.format.encoding)
+	return unifiedDiff(b.path+" (on disk)", b.path+" (buffer)", b.format.splitLines(text), b.lineStrings()), nil
+}
+
+func (d *Display) watchFiles(stop <-chan struct{}) {
+	ticker := time.NewTicker(diskCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			d.Screen.PostEvent(tcell.NewEventInterrupt(diskCheck{}))
+		}
+	}
+}
+
+func (d *Display) handleInterrupt(ev *tcell.EventInterrupt) {
+	switch data := ev.Data().(type) {
+	case pendingTimedOut:
+		d.handlePendingTimeout(data)
+	case diskCheck:
+		d.flushSwapFiles()
+		if d.Mode == Normal || d.Mode == Insert {
+			d.checkActiveBufOnDisk()
+		}
+	case hangup:
+		d.hangUp()
+	}
+}
+
+func (d *Display) checkActiveBufOnDisk() {
+	buf := d.ActiveBuf
+	current, changed, err := buf.diskChanged(buf.seenDisk)
+	if err != nil || !changed {
+		return
+	}
+	buf.seenDisk = current
+	if !buf.modified {
+		if err := d.reloadBuffer(); err != nil {
+			d.ShowError(err)
+			return
+		}
+		d.showMessage(fmt.Sprintf("\"%s\" changed on disk and was reloaded", buf.path))
+		return
+	}
+	d.askAboutDiskChange("File changed on disk since it was read.")
+}
+
+func (d *Display) askAboutDiskChange(message string) {
+	returnMode := d.Mode
+	if returnMode == Prompt {
+		returnMode = Normal
+	}
+	d.ask(message,
+		choice{'r', "eload", d.reloadActiveBuf},
+		choice{'o', "verwrite", d.forceWriteActiveBuf},
+		choice{'d', "iff", d.showDiskDiff},
+		choice{'c', "ancel", func() { d.Mode = returnMode }},
+	)
+}
+
+func (d *Display) showDiskDiff() {
+	lines, err := d.ActiveBuf.diskDiff()
+	if err != nil {
+		d.prompt = nil
+		d.ShowError(err)
+		return
+	}
+	d.showDiff("Diff against file on disk", lines, Prompt)
+}
+
+func (d *Display) reloadActiveBuf() {
+	if err := d.reloadBuffer(); err != nil {
+		d.ShowError(err)
+	}
+}
+
+// reloadBuffer reads the file over the active buffer and keeps the cursor
+// where it was. The buffer is not touched if the file cannot be read.
+func (d *Display) reloadBuffer() error {
+	buf, bw := d.ActiveBuf, d.bufWindow
+	d.setBufPos()
+	pos, leftCol := bw.bufPos(), bw.leftCol
+	if err := buf.reload(pos); err != nil {
+		return err
+	}
+	d.clearBufWindow()
+	d.moveToBufPos(pos)
+	bw.leftCol = leftCol
+	bw.scrollToCursorColumn()
+	d.SetBufWindow()
+	d.Mode = Normal
+	return nil
+}
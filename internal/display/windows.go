@@ -0,0 +1,325 @@
+package display
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// splitNode is a node of the window layout: either a window, or a split whose
+// children sit side by side (vertical) or on top of each other. weight is the
+// share of the parent split the node gets.
+type splitNode struct {
+	parent   *splitNode
+	vertical bool
+	children []*splitNode
+	window   *BufWindow
+	weight   int
+}
+
+// layout gives the node the rectangle at x, y and shares it out between its
+// children, leaving a one cell separator between them.
+func (n *splitNode) layout(x, y, width, height int) {
+	if n.window != nil {
+		n.window.left, n.window.top = x, y
+		n.window.width, n.window.size = width, height
+		return
+	}
+	space := height
+	if n.vertical {
+		space = width
+	}
+	space -= len(n.children) - 1
+	total := 0
+	for _, c := range n.children {
+		total += max(c.weight, 1)
+	}
+	pos, used, weights := 0, 0, 0
+	for i, c := range n.children {
+		weights += max(c.weight, 1)
+		size := space*weights/total - used
+		if i == len(n.children)-1 {
+			size = space - used
+		}
+		size = max(size, 1)
+		c.weight = size
+		if n.vertical {
+			c.layout(x+pos, y, size, height)
+		} else {
+			c.layout(x, y+pos, width, size)
+		}
+		pos += size + 1
+		used += size
+	}
+}
+
+func (n *splitNode) windows() []*BufWindow {
+	if n.window != nil {
+		return []*BufWindow{n.window}
+	}
+	windows := []*BufWindow{}
+	for _, c := range n.children {
+		windows = append(windows, c.windows()...)
+	}
+	return windows
+}
+
+func (n *splitNode) equalize() {
+	for _, c := range n.children {
+		c.weight = 1
+		c.equalize()
+	}
+}
+
+func (d *Display) windows() []*BufWindow {
+	return d.layoutRoot.windows()
+}
+
+// layoutWindows fits the windows between the tab line and the status bar and
+// redraws them.
+func (d *Display) layoutWindows() {
+	pos := d.cursorPos()
+	top := d.textTop()
+	d.layoutRoot.layout(0, top, max(d.width, 1), max(d.height-1-top, 1))
+	d.Screen.Clear()
+	for _, bw := range d.windows() {
+		bw.update(bw.bufIdx)
+	}
+	d.moveToBufPos(pos)
+	d.SetBufWindow()
+	d.drawWindows()
+}
+
+// splitWindow shows the focused buffer in a new window above or to the left
+// of the focused one, and focuses it.
+func (d *Display) splitWindow(vertical bool) {
+	curr := d.bufWindow
+	bw := newBufWindow(curr.size)
+	bw.buf = curr.buf
+	bw.bufIdx = curr.bufIdx
+	bw.wrap = curr.wrap
+	bw.cur, bw.pos = curr.cur, curr.pos
+	leaf := &splitNode{window: bw}
+	bw.node = leaf
+
+	node := curr.node
+	parent := node.parent
+	if parent == nil || parent.vertical != vertical {
+		split := &splitNode{parent: parent, vertical: vertical, weight: node.weight}
+		if parent == nil {
+			d.layoutRoot = split
+		} else {
+			parent.children[slices.Index(parent.children, node)] = split
+		}
+		node.parent = split
+		split.children = []*splitNode{node}
+		parent = split
+	}
+	half := max(node.weight/2, 1)
+	leaf.weight, node.weight = half, max(node.weight-half, 1)
+	leaf.parent = parent
+	idx := slices.Index(parent.children, node)
+	parent.children = slices.Insert(parent.children, idx, leaf)
+	d.bufWindow = bw
+	d.layoutWindows()
+}
+
+func (d *Display) closeWindow() error {
+	curr := d.bufWindow
+	node := curr.node
+	parent := node.parent
+	if parent == nil {
+		return errors.New("cannot close the last window")
+	}
+	idx := slices.Index(parent.children, node)
+	parent.children = slices.Delete(parent.children, idx, idx+1)
+	sibling := parent.children[max(idx-1, 0)]
+	sibling.weight += node.weight + 1
+	if len(parent.children) == 1 {
+		child := parent.children[0]
+		child.parent = parent.parent
+		child.weight = parent.weight
+		if parent.parent == nil {
+			d.layoutRoot = child
+		} else {
+			siblings := parent.parent.children
+			siblings[slices.Index(siblings, parent)] = child
+		}
+	}
+	d.focusWindow(sibling.windows()[0])
+	d.layoutWindows()
+	return nil
+}
+
+func (d *Display) focusWindow(bw *BufWindow) {
+	if bw == d.bufWindow {
+		return
+	}
+	d.bufWindow = bw
+	d.ActiveBuf = bw.buf
+	d.moveToBufPos(bw.bufPos())
+	d.checkActiveBufOnDisk()
+}
+
+func (d *Display) focusNextWindow() {
+	windows := d.windows()
+	idx := slices.Index(windows, d.bufWindow)
+	d.focusWindow(windows[(idx+1)%len(windows)])
+}
+
+// focusDirection focuses the closest window in the direction of dx, dy that
+// lines up with the focused one.
+func (d *Display) focusDirection(dx, dy int) {
+	curr := d.bufWindow
+	var best *BufWindow
+	bestDist := 0
+	for _, bw := range d.windows() {
+		dist := -1
+		switch {
+		case dx > 0 && overlaps(bw.top, bw.size, curr.top, curr.size):
+			dist = bw.left - (curr.left + curr.width)
+		case dx < 0 && overlaps(bw.top, bw.size, curr.top, curr.size):
+			dist = curr.left - (bw.left + bw.width)
+		case dy > 0 && overlaps(bw.left, bw.width, curr.left, curr.width):
+			dist = bw.top - (curr.top + curr.size)
+		case dy < 0 && overlaps(bw.left, bw.width, curr.left, curr.width):
+			dist = curr.top - (bw.top + bw.size)
+		}
+		if bw != curr && dist >= 0 && (best == nil || dist < bestDist) {
+			best, bestDist = bw, dist
+		}
+	}
+	if best != nil {
+		d.focusWindow(best)
+	}
+}
+
+func overlaps(start, length, otherStart, otherLength int) bool {
+	return start < otherStart+otherLength && otherStart < start+length
+}
+
+// resizeWindow grows the focused window by delta rows, or columns when
+// vertical, taking the space from its neighbour.
+func (d *Display) resizeWindow(vertical bool, delta int) {
+	node := d.bufWindow.node
+	for node.parent != nil && node.parent.vertical != vertical {
+		node = node.parent
+	}
+	if node.parent == nil {
+		return
+	}
+	siblings := node.parent.children
+	idx := slices.Index(siblings, node)
+	next := idx + 1
+	if next == len(siblings) {
+		next = idx - 1
+	}
+	sibling := siblings[next]
+	delta = min(max(delta, 1-node.weight), sibling.weight-1)
+	node.weight += delta
+	sibling.weight -= delta
+	d.layoutWindows()
+}
+
+func (d *Display) equalizeWindows() {
+	d.layoutRoot.equalize()
+	d.layoutWindows()
+}
+
+// drawWindows redraws every window but the focused one, which is kept up to
+// date as it is edited, so edits show up in other views of the same buffer.
+// A wrapping focused window is redrawn too, as an edit can change how many
+// rows the lines below it start on, and so is one with a selection, which
+// moves with the cursor.
+func (d *Display) drawWindows() {
+	for _, bw := range d.windows() {
+		if bw == d.bufWindow && !bw.wraps() && d.Mode != Visual {
+			continue
+		}
+		d.drawWindow(bw)
+	}
+	d.drawSeparators(d.layoutRoot)
+}
+
+func (d *Display) drawWindow(bw *BufWindow) {
+	bw.update(bw.bufIdx)
+	for y := range bw.size {
+		for x := bw.gutter; x < bw.width; x++ {
+			d.setWindowContent(bw, x, y, ' ', d.BufStyle)
+		}
+	}
+	for y, line := range bw.lines {
+		d.drawWindowLine(bw, y, line)
+	}
+	d.drawLineNumbers(bw)
+}
+
+func (d *Display) drawSeparators(n *splitNode) {
+	for i, c := range n.children {
+		d.drawSeparators(c)
+		if i == len(n.children)-1 {
+			continue
+		}
+		x, y, w, h := c.rect()
+		if n.vertical {
+			for row := y; row < y+h; row++ {
+				d.Screen.SetContent(x+w, row, '│', nil, d.LineNoStyle)
+			}
+		} else {
+			for col := x; col < x+w; col++ {
+				d.Screen.SetContent(col, y+h, '─', nil, d.LineNoStyle)
+			}
+		}
+	}
+}
+
+// rect returns the rectangle covered by the windows under n.
+func (n *splitNode) rect() (int, int, int, int) {
+	windows := n.windows()
+	first := windows[0]
+	x, y := first.left, first.top
+	right, bottom := x, y
+	for _, bw := range windows {
+		right = max(right, bw.left+bw.width)
+		bottom = max(bottom, bw.top+bw.size)
+	}
+	return x, y, right - x, bottom - y
+}
+
+func (d *Display) runWindowMode(ev tcell.Event) {
+	d.Mode = Normal
+	switch ev := ev.(type) {
+	case *tcell.EventKey:
+		switch ev.Rune() {
+		case 's':
+			d.splitWindow(false)
+		case 'v':
+			d.splitWindow(true)
+		case 'c', 'q':
+			if err := d.closeWindow(); err != nil {
+				d.ShowError(err)
+			}
+		case 'w':
+			d.focusNextWindow()
+		case 'h':
+			d.focusDirection(-1, 0)
+		case 'j':
+			d.focusDirection(0, 1)
+		case 'k':
+			d.focusDirection(0, -1)
+		case 'l':
+			d.focusDirection(1, 0)
+		case '+':
+			d.resizeWindow(false, 1)
+		case '-':
+			d.resizeWindow(false, -1)
+		case '>':
+			d.resizeWindow(true, 1)
+		case '<':
+			d.resizeWindow(true, -1)
+		case '=':
+			d.equalizeWindows()
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package display
+
+// toggleWrap turns wrapping on or off in the focused window, leaving other
+// windows on the same buffer as they are.
+func (d *Display) toggleWrap() {
+	d.bufWindow.wrap = !d.bufWindow.wrap
+	d.layoutWindows()
+	if d.bufWindow.wrap {
+		d.showMessage("wrap")
+	} else {
+		d.showMessage("nowrap")
+	}
+}
+
+// keepCursorInView scrolls the focused window sideways to the cursor column
+// when it does not wrap. A wrapping window is scrolled down until the cursor
+// line fits in it instead, as the line may have grown onto more rows, or
+// scrolling may have brought taller lines in above it.
+func (d *Display) keepCursorInView() {
+	bw := d.bufWindow
+	if bw.scrollToCursorColumn() {
+		d.drawWindow(bw)
+	}
+	if !bw.wraps() {
+		return
+	}
+	line := bw.pos.Y
+	bw.update(bw.bufIdx)
+	for line-bw.bufIdx >= bw.length() && bw.bufIdx < line {
+		start := bw.bufIdx
+		bw.update(start + 1)
+		if bw.bufIdx == start {
+			break
+		}
+	}
+	bw.cur.Y = line - bw.bufIdx
+}
+
+// moveCursorScreenDown moves the cursor down a row on the screen, which keeps
+// it on the same line while the line wraps onto the row below.
+func (d *Display) moveCursorScreenDown() {
+	bw := d.bufWindow
+	if !bw.wraps() {
+		d.moveCursorDown()
+		return
+	}
+	width := bw.textWidth()
+	line := d.currLine()
+	cell := bw.wrapCell(line, bw.cur.X-bw.gutter)
+	if cell/width+1 < bw.lineRows(line) {
+		d.setCursorColumn(bw.wrapCol(line, cell+width))
+		return
+	}
+	y := bw.pos.Y
+	d.moveCursorDown()
+	d.setBufPos()
+	if bw.pos.Y != y {
+		d.setCursorColumn(bw.wrapCol(d.currLine(), cell%width))
+	}
+}
+
+func (d *Display) moveCursorScreenUp() {
+	bw := d.bufWindow
+	if !bw.wraps() {
+		d.moveCursorUp()
+		return
+	}
+	width := bw.textWidth()
+	line := d.currLine()
+	cell := bw.wrapCell(line, bw.cur.X-bw.gutter)
+	if cell >= width {
+		d.setCursorColumn(bw.wrapCol(line, cell-width))
+		return
+	}
+	y := bw.pos.Y
+	d.moveCursorUp()
+	d.setBufPos()
+	if bw.pos.Y != y {
+		line = d.currLine()
+		last := bw.lineRows(line) - 1
+		d.setCursorColumn(bw.wrapCol(line, last*width+cell))
+	}
+}
+
+// setCursorColumn puts the cursor on the rune at col on the current line, or
+// after the last rune when the line is shorter.
+func (d *Display) setCursorColumn(col int) {
+	d.setCursorIndex(d.currLine().indexAt(col, d.tabWidth()))
+}